@@ -2,24 +2,49 @@ package mfs
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
+	balanced "github.com/ipfs/go-unixfs/importer/balanced"
+	helpers "github.com/ipfs/go-unixfs/importer/helpers"
 	uio "github.com/ipfs/go-unixfs/io"
 
 	cid "github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	cbor "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
 var ErrNotYetImplemented = errors.New("not yet implemented")
 var ErrInvalidChild = errors.New("invalid child node")
 var ErrDirExists = errors.New("directory already has entry by that name")
+var ErrNotPropagated = errors.New("update not propagated to parent directory")
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+var ErrTooDeep = errors.New("directory nesting exceeds the maximum depth")
+var ErrNotSharded = errors.New("directory is not sharded")
+var ErrDirNotEmpty = errors.New("directory not empty")
+var ErrCycleDetected = errors.New("directory would contain itself")
+var ErrDuplicateContent = errors.New("directory already has an entry with the same content")
+var ErrDetached = errors.New("directory no longer linked from its parent")
+var ErrCidBuilderMismatch = errors.New("CID builder differs from the one of existing entries")
+var ErrSymlinkLoop = errors.New("symlink loop detected")
+var ErrInvalidName = errors.New("invalid entry name")
+var ErrResolutionBudgetExceeded = errors.New("path resolution budget exceeded")
 
 // TODO: There's too much functionality associated with this structure,
 // let's organize it (and if possible extract part of it elsewhere)
@@ -40,7 +65,55 @@ type Directory struct {
 	// reading and editing directories.
 	unixfsDir uio.Directory
 
+	// Fanout of `unixfsDir` if it's a HAMT (the shards don't expose it
+	// without serializing them, see `computeNode`).
+	shardWidth int
+
+	// Last time the directory was modified, only tracked in memory:
+	// zero for directories loaded from the DAG and not yet modified.
 	modTime time.Time
+
+	// Time the entries not tracking their own modification time (i.e.,
+	// not cached) were placed in the directory, by `AddChild` or `Swap`.
+	entryModTimes map[string]time.Time
+
+	// Set when the directory is modified, cleared once its node has
+	// been propagated to its parent (through `Flush` or as part of the
+	// `updateChildEntry` chain).
+	dirty bool
+
+	// CID of the last node of this directory propagated to its parent
+	// (initially the one it was constructed from).
+	flushedCid cid.Cid
+
+	// Cumulative size of the directory node and the part of it due to
+	// each of its links (see `CachedCumulativeSize`), the map is nil
+	// while the size isn't known.
+	cumSize   uint64
+	linkSizes map[string]uint64
+
+	// CID of the last node of this directory added to the DAG service,
+	// to avoid adding it again while it doesn't change (e.g., flushing
+	// the root with changes elsewhere in the tree) and is still stored.
+	addedCid cid.Cid
+
+	// Counter of the flush syncing the directory or of its switch to
+	// sharding (nil otherwise), for the nodes the HAMT shards add without
+	// a context (see `dirDagServ`).
+	flushAdds *addCounter
+
+	// Entries new directories created beneath this one start with (see
+	// `SetTemplate`).
+	template map[string]ipld.Node
+
+	// Mutations of the directory held back from the `MutationLogger`
+	// while a `Batch` is committed with its lock taken (nil otherwise).
+	pendingLog *[]Mutation
+
+	// Set once the directory is unlinked or replaced in its parent, its
+	// updates must not be propagated anymore (see `ErrDetached`).
+	// Protected by the lock of the parent.
+	detached bool
 }
 
 // NewDirectory constructs a new MFS directory.
@@ -48,22 +121,104 @@ type Directory struct {
 // You probably don't want to call this directly. Instead, construct a new root
 // using NewRoot.
 func NewDirectory(ctx context.Context, name string, node ipld.Node, parent parent, dserv ipld.DAGService) (*Directory, error) {
-	db, err := uio.NewDirectoryFromNode(dserv, node)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Directory{
+	d := &Directory{
 		inode: inode{
 			name:       name,
 			parent:     parent,
 			dagService: dserv,
+			root:       rootOf(parent),
 		},
-		ctx:          ctx,
-		unixfsDir:    db,
-		entriesCache: make(map[string]FSNode),
-		modTime:      time.Now(),
-	}, nil
+		ctx:           ctx,
+		shardWidth:    hamtFanout(node),
+		entriesCache:  make(map[string]FSNode),
+		entryModTimes: make(map[string]time.Time),
+		flushedCid:    node.Cid(),
+	}
+
+	db, err := uio.NewDirectoryFromNode(d.unixfsDagServ(), node)
+	if err != nil {
+		return nil, err
+	}
+	d.unixfsDir = db
+	return d, nil
+}
+
+// NewDirectoryWithChildren constructs a new (empty) directory with the CID
+// builder 'b' and adds all of 'children' to it in a single pass, without the
+// locking and per-entry existence checks of `AddChild`. The names and the
+// depth of the directory children are validated as with `AddChild` (with
+// `Root.CaseInsensitive` names differing only in case are rejected). The
+// directory is switched to sharding as with `AddChild`.
+// As with `NewDirectory` the new directory isn't linked into 'parent'.
+func NewDirectoryWithChildren(ctx context.Context, name string, parent parent, dserv ipld.DAGService, children map[string]ipld.Node, b cid.Builder) (*Directory, error) {
+	node := ft.EmptyDirNode()
+	if b != nil {
+		node.SetCidBuilder(b)
+	}
+
+	d, err := NewDirectory(ctx, name, node, parent, dserv)
+	if err != nil {
+		return nil, err
+	}
+
+	// Insert them in a stable order, the links of basic
+	// directories are stored in insertion order.
+	names := make([]string, 0, len(children))
+	nodes := make([]ipld.Node, 0, len(children))
+	var folded map[string]string
+	if d.caseInsensitive() {
+		folded = make(map[string]string, len(children))
+	}
+	for cname, nd := range children {
+		if cname == "" {
+			return nil, fmt.Errorf("cannot add child with empty name")
+		}
+		if err := d.checkName(cname); err != nil {
+			return nil, err
+		}
+		if folded != nil {
+			if other, ok := folded[foldCase(cname)]; ok {
+				return nil, fmt.Errorf("%w: %s and %s differ only in case", ErrDirExists, other, cname)
+			}
+			folded[foldCase(cname)] = cname
+		}
+		if err := checkChildNode(nd); err != nil {
+			return nil, err
+		}
+		names = append(names, cname)
+		nodes = append(nodes, nd)
+	}
+	sort.Strings(names)
+
+	err = dserv.AddMany(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cname := range names {
+		// The subtrees are walked once their nodes are added.
+		err = d.checkChildNodeDepth(ctx, children[cname])
+		if err != nil {
+			return nil, err
+		}
+		err = d.addUnixFSChild(ctx, child{cname, children[cname]})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	d.modTime = time.Now()
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	err = dserv.Add(ctx, nd)
+	if err != nil {
+		return nil, err
+	}
+	d.flushedCid = nd.Cid()
+
+	return d, nil
 }
 
 // GetCidBuilder gets the CID builder of the root node
@@ -71,39 +226,261 @@ func (d *Directory) GetCidBuilder() cid.Builder {
 	return d.unixfsDir.GetCidBuilder()
 }
 
-// SetCidBuilder sets the CID builder
+// SetCidBuilder sets the CID builder used for the nodes of this directory
+// from now on. The existing entries are not rebuilt, so changing to a
+// builder with a different CID version or hash function leaves a tree of
+// mixed CIDs: use `CheckCidBuilder` to detect it beforehand, or
+// `RebuildWithCidBuilder` to migrate the whole subtree.
 func (d *Directory) SetCidBuilder(b cid.Builder) {
 	d.unixfsDir.SetCidBuilder(b)
 }
 
+// SetTemplate registers the entries every directory created by `Mkdir` (or
+// `MkdirContext`) beneath this one, at any depth, starts with, e.g., a
+// `.keep` file. The nearest template among the ancestors of the new
+// directory (including its parent) applies, and is added to it with the CID
+// builder of the new directory (only the template nodes are re-encoded, the
+// nodes they link to, which must be available, are kept as they are). A nil
+// or empty 'children' removes the template of this directory.
+func (d *Directory) SetTemplate(children map[string]ipld.Node) error {
+	var template map[string]ipld.Node
+	if len(children) > 0 {
+		template = make(map[string]ipld.Node, len(children))
+		for name, nd := range children {
+			if name == "" {
+				return fmt.Errorf("cannot add child with empty name")
+			}
+			if err := d.checkName(name); err != nil {
+				return err
+			}
+			if err := checkChildNode(nd); err != nil {
+				return err
+			}
+			template[name] = nd
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.template = template
+	return nil
+}
+
+// templateFor returns the template (see `SetTemplate`) of the nearest
+// directory, starting from this one, that has one. It must be called
+// without the lock of this directory or of any of its ancestors taken, each
+// one is read with its lock taken (one at a time, going up).
+func (d *Directory) templateFor() map[string]ipld.Node {
+	for cur := d; cur != nil; {
+		cur.lock.Lock()
+		template := cur.template
+		next, _ := cur.parent.(*Directory)
+		cur.lock.Unlock()
+		if template != nil {
+			return template
+		}
+		cur = next
+	}
+	return nil
+}
+
+// templateForUnsync implements `templateFor` for the callers holding the
+// locks of this directory and of all its ancestors (e.g., a `Batch`).
+func (d *Directory) templateForUnsync() map[string]ipld.Node {
+	for cur := d; cur != nil; cur, _ = cur.parent.(*Directory) {
+		if cur.template != nil {
+			return cur.template
+		}
+	}
+	return nil
+}
+
+// applyTemplate adds the entries of 'template' to the new (and still
+// unlinked) directory 'd', encoded with its CID builder, checking the
+// `Root.MaxDepth` of the directories among them as `AddChild` does.
+func (d *Directory) applyTemplate(ctx context.Context, template map[string]ipld.Node) error {
+	names := make([]string, 0, len(template))
+	for name := range template {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := d.GetCidBuilder()
+	for _, name := range names {
+		var nd ipld.Node
+		switch tnd := template[name].(type) {
+		case *dag.ProtoNode:
+			pbnd := tnd.Copy().(*dag.ProtoNode)
+			pbnd.SetCidBuilder(b.WithCodec(cid.DagProtobuf))
+			nd = pbnd
+		case *dag.RawNode:
+			var err error
+			nd, err = dag.NewRawNodeWPrefix(tnd.RawData(), b.WithCodec(cid.Raw))
+			if err != nil {
+				return err
+			}
+		}
+
+		err := d.checkChildNodeDepth(ctx, nd)
+		if err != nil {
+			return err
+		}
+		err = d.addEntryNode(ctx, nd)
+		if err != nil {
+			return err
+		}
+		err = d.addUnixFSChild(ctx, child{name, nd})
+		if err != nil {
+			return err
+		}
+	}
+
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return err
+	}
+	d.flushedCid = nd.Cid()
+	return nil
+}
+
+// CheckCidBuilder checks that the CIDs of the (direct) entries of this
+// directory have the CID version and hash function of the builder 'b',
+// returning `ErrCidBuilderMismatch` (with the name of the first entry that
+// doesn't) otherwise. The codec is not compared (e.g., raw leaves).
+func (d *Directory) CheckCidBuilder(ctx context.Context, b cid.Builder) error {
+	c, err := b.Sum(nil)
+	if err != nil {
+		return err
+	}
+	want := c.Prefix()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.sync(ctx); err != nil {
+		return err
+	}
+	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		p := l.Cid.Prefix()
+		if p.Version != want.Version || p.MhType != want.MhType {
+			return fmt.Errorf("%w: %s", ErrCidBuilderMismatch, l.Name)
+		}
+		return nil
+	})
+}
+
 // This method implements the `parent` interface. It first does the local
 // update of the child entry in the underlying UnixFS directory and saves
 // the newly created directory node with the updated entry in the DAG
 // service. Then it propagates the update upwards (through this same
 // interface) repeating the whole process in the parent.
 func (d *Directory) updateChildEntry(c child) error {
-	newDirNode, err := d.localUpdate(c)
+	return d.updateDirEntry(nil, c)
+}
+
+// updateDirEntry implements `updateChildEntry` for the update 'c' of the
+// directory 'from' (nil for files), which is rejected with `ErrDetached` if
+// it was unlinked or replaced.
+func (d *Directory) updateDirEntry(from *Directory, c child) error {
+	newDirNode, err := d.localUpdate(from, c)
 	if err != nil {
 		return err
 	}
 
 	// Continue to propagate the update process upwards
 	// (all the way up to the root).
-	return d.parent.updateChildEntry(child{d.name, newDirNode})
+	err = d.propagate(newDirNode)
+	if err != nil {
+		return err
+	}
+
+	d.setFlushed(newDirNode)
+	return nil
+}
+
+// propagate updates the entry of this directory in its parent with 'nd'.
+func (d *Directory) propagate(nd ipld.Node) error {
+	if p, ok := d.parent.(*Directory); ok {
+		return p.updateDirEntry(d, child{d.name, nd})
+	}
+	return d.parent.updateChildEntry(child{d.name, nd})
+}
+
+// isDetached reports whether the directory was unlinked or replaced in its
+// parent (see `detached`), propagating its node would resurrect it. A
+// directory only dropped from the cache of its parent is still attached.
+func (d *Directory) isDetached() bool {
+	p, ok := d.parent.(*Directory)
+	if !ok {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return d.detached
+}
+
+// detachEntry flags the entry 'fsn' of this directory, just unlinked or
+// replaced, as detached if it's a directory. It must be called with the
+// lock taken.
+func detachEntry(fsn FSNode) {
+	if dir, ok := fsn.(*Directory); ok {
+		dir.detached = true
+	}
+}
+
+// markDirty marks the directory as modified (see `dirty`). It must be
+// called with the lock taken.
+func (d *Directory) markDirty() {
+	if !d.dirty && d.root != nil && d.root.MaxDirtyDirs > 0 {
+		d.root.trackDirty(d)
+	}
+	d.dirty = true
+}
+
+// markClean clears the `dirty` flag of the directory. It must be called
+// with the lock taken.
+func (d *Directory) markClean() {
+	if d.dirty && d.root != nil && d.root.MaxDirtyDirs > 0 {
+		d.root.untrackDirty(d)
+	}
+	d.dirty = false
+}
+
+// checkDirtyBudget enforces the `Root.MaxDirtyDirs` of the root after a
+// mutation of this directory. It must be called without the lock taken.
+func (d *Directory) checkDirtyBudget() {
+	if d.root != nil {
+		d.root.enforceDirtyBudget()
+	}
+}
+
+// setFlushed records `nd` as the last node of this directory propagated
+// to its parent, marking the directory as clean.
+func (d *Directory) setFlushed(nd ipld.Node) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.markClean()
+	d.flushedCid = nd.Cid()
 }
 
 // This method implements the part of `updateChildEntry` that needs
 // to be locked around: in charge of updating the UnixFS layer and
 // generating the new node reflecting the update. It also stores the
-// new node in the DAG layer.
-func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
+// new node in the DAG layer. The update of a detached directory 'from'
+// is rejected.
+func (d *Directory) localUpdate(from *Directory, c child) (*dag.ProtoNode, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	if from != nil && from.detached {
+		return nil, ErrDetached
+	}
+
 	err := d.updateChild(c)
 	if err != nil {
 		return nil, err
 	}
+	d.markDirty()
 	// TODO: Clearly define how are we propagating changes to lower layers
 	// like UnixFS.
 
@@ -117,7 +494,7 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 		return nil, dag.ErrNotProtobuf
 	}
 
-	err = d.dagService.Add(d.ctx, nd)
+	err = d.addNode(d.ctx, nd)
 	if err != nil {
 		return nil, err
 	}
@@ -128,7 +505,7 @@ func (d *Directory) localUpdate(c child) (*dag.ProtoNode, error) {
 
 // Update child entry in the underlying UnixFS directory.
 func (d *Directory) updateChild(c child) error {
-	err := d.addUnixFSChild(c)
+	err := d.addUnixFSChild(d.ctx, c)
 	if err != nil {
 		return err
 	}
@@ -142,19 +519,123 @@ func (d *Directory) Type() NodeType {
 	return TDir
 }
 
+// isSharded reports whether the directory uses the HAMT implementation.
+func (d *Directory) isSharded() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.unixfsDir.(*uio.HAMTDirectory)
+	return ok
+}
+
+// depth returns the number of directories between this one and the
+// root directory (which has depth zero).
+func (d *Directory) depth() int {
+	depth := 0
+	for cur, ok := d.parent.(*Directory); ok; cur, ok = cur.parent.(*Directory) {
+		depth++
+	}
+	return depth
+}
+
+// checkChildDepth returns `ErrTooDeep` if a directory created under this
+// one would exceed the `MaxDepth` of the root.
+func (d *Directory) checkChildDepth() error {
+	if d.root == nil || d.root.MaxDepth <= 0 {
+		return nil
+	}
+	if d.depth()+1 > d.root.MaxDepth {
+		return ErrTooDeep
+	}
+	return nil
+}
+
+// checkChildNodeDepth returns `ErrTooDeep` if adding the node 'nd' under
+// this directory would nest a directory beyond the `MaxDepth` of the root.
+// The subtree of a directory node is walked (fetching its nodes with 'ctx')
+// down to the limit.
+func (d *Directory) checkChildNodeDepth(ctx context.Context, nd ipld.Node) error {
+	if !isDirNode(nd) {
+		return nil
+	}
+	if err := d.checkChildDepth(); err != nil {
+		return err
+	}
+	if d.root == nil || d.root.MaxDepth <= 0 {
+		return nil
+	}
+	return checkSubtreeDepth(ctx, d.dagService, nd, d.root.MaxDepth-d.depth()-1)
+}
+
+// checkSubtreeDepth returns `ErrTooDeep` if the directory node 'nd' has
+// directories nested more than 'left' levels below it.
+func checkSubtreeDepth(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, left int) error {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return err
+	}
+	return dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if l.Cid.Type() == cid.Raw {
+			return nil
+		}
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		if !isDirNode(cnd) {
+			return nil
+		}
+		if left <= 0 {
+			return ErrTooDeep
+		}
+		return checkSubtreeDepth(ctx, dserv, cnd, left-1)
+	})
+}
+
+// isDirNode reports whether `nd` is a UnixFS directory (basic or HAMT).
+func isDirNode(nd ipld.Node) bool {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return false
+	}
+	return fsn.IsDir()
+}
+
+// isSymlinkNode reports whether `nd` is a UnixFS symlink.
+func isSymlinkNode(nd ipld.Node) bool {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	return err == nil && fsn.Type() == ft.TSymlink
+}
+
 // childNode returns a FSNode under this directory by the given name if it exists.
 // it does *not* check the cached dirs and files
-func (d *Directory) childNode(name string) (FSNode, error) {
-	nd, err := d.childFromDag(name)
+func (d *Directory) childNode(ctx context.Context, name string) (FSNode, error) {
+	nd, err := d.childFromDag(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return d.cacheNode(name, nd)
+	return d.cacheNode(ctx, name, nd)
 }
 
-// cacheNode caches a node into d.childDirs or d.files and returns the FSNode.
-func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
+// cacheNode caches a node into d.childDirs or d.files and returns the FSNode
+// (decoding it first with the `Root.NodeTransformer`, if any).
+func (d *Directory) cacheNode(ctx context.Context, name string, nd ipld.Node) (FSNode, error) {
+	if d.root != nil && d.root.NodeTransformer != nil {
+		var err error
+		nd, err = d.root.NodeTransformer.Decode(ctx, nd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	switch nd := nd.(type) {
 	case *dag.ProtoNode:
 		fsn, err := ft.FSNodeFromBytes(nd.Data())
@@ -164,6 +645,11 @@ func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
 
 		switch fsn.Type() {
 		case ft.TDirectory, ft.THAMTShard:
+			if ndir := d.evictedDir(name, nd.Cid()); ndir != nil {
+				d.entriesCache[name] = ndir
+				return ndir, nil
+			}
+
 			ndir, err := NewDirectory(d.ctx, name, nd, d, d.dagService)
 			if err != nil {
 				return nil, err
@@ -195,59 +681,516 @@ func (d *Directory) cacheNode(name string, nd ipld.Node) (FSNode, error) {
 	}
 }
 
-// Child returns the child of this directory by the given name
-func (d *Directory) Child(name string) (FSNode, error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	return d.childUnsync(name)
-}
-
-func (d *Directory) Uncache(name string) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	delete(d.entriesCache, name)
-}
-
-// childFromDag searches through this directories dag node for a child link
-// with the given name
-func (d *Directory) childFromDag(name string) (ipld.Node, error) {
-	return d.unixfsDir.Find(d.ctx, name)
-}
+// checkChildNode returns `ErrInvalidChild` if `nd` isn't a node that can
+// be loaded as an entry of a directory (see `cacheNode`).
+func checkChildNode(nd ipld.Node) error {
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return ErrInvalidChild
+		}
 
-// childUnsync returns the child under this directory by the given name
-// without locking, useful for operations which already hold a lock
-func (d *Directory) childUnsync(name string) (FSNode, error) {
-	entry, ok := d.entriesCache[name]
-	if ok {
-		return entry, nil
+		switch fsn.Type() {
+		case ft.TDirectory, ft.THAMTShard, ft.TFile, ft.TRaw, ft.TSymlink:
+			return nil
+		default:
+			return ErrInvalidChild
+		}
+	case *dag.RawNode:
+		return nil
+	default:
+		return ErrInvalidChild
 	}
-
-	return d.childNode(name)
 }
 
-type NodeListing struct {
-	Name string
-	Type int
-	Size int64
-	Hash string
+// Child returns the child of this directory by the given name
+func (d *Directory) Child(name string) (FSNode, error) {
+	return d.ChildContext(d.ctx, name)
 }
 
-func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
+// ChildContext returns the child of this directory as `Child`, using 'ctx'
+// to fetch its node if it isn't cached.
+func (d *Directory) ChildContext(ctx context.Context, name string) (FSNode, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	return d.childUnsync(ctx, name)
+}
 
-	var out []string
-	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
-		out = append(out, l.Name)
-		return nil
-	})
+// RawData returns the raw UnixFS data of the node of the entry 'name' (as
+// `GetNode` of the entry returns it): the `Data` of a dag-pb node or the
+// whole content of a raw node. The entry is loaded (and cached) as with
+// `Child`.
+func (d *Directory) RawData(ctx context.Context, name string) ([]byte, error) {
+	d.lock.Lock()
+	c, err := d.childUnsync(ctx, name)
+	d.lock.Unlock()
 	if err != nil {
 		return nil, err
 	}
 
-	return out, nil
-}
-
+	nd, err := c.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		return nd.Data(), nil
+	case *dag.RawNode:
+		return nd.RawData(), nil
+	default:
+		return nil, ErrInvalidChild
+	}
+}
+
+// PathExists reports whether 'pth' (relative to this directory) resolves to
+// an entry. Unlike `Child` (and `DirLookup`) it doesn't cache the entries
+// it goes through, already cached ones are used (as they may have unsynced
+// changes) but the rest of the path is resolved directly in the DAG.
+func (d *Directory) PathExists(ctx context.Context, pth string) (bool, error) {
+	pth = strings.Trim(pth, "/")
+	if pth == "" {
+		return true, nil
+	}
+
+	// Only one of `cached` or `uncached` is set at a time.
+	cached := d
+	var uncached uio.Directory
+	parts := strings.Split(pth, "/")
+	for i, name := range parts {
+		var fsn FSNode
+		var nd ipld.Node
+		var err error
+		if cached != nil {
+			fsn, nd, err = cached.peekChild(ctx, name)
+		} else {
+			nd, err = uncached.Find(ctx, name)
+		}
+		if err == os.ErrNotExist {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		if i == len(parts)-1 {
+			return true, nil
+		}
+
+		// Intermediate entries need to be directories.
+		if fsn != nil {
+			dir, ok := fsn.(*Directory)
+			if !ok {
+				return false, nil
+			}
+			cached, uncached = dir, nil
+			continue
+		}
+
+		uncached, err = uio.NewDirectoryFromNode(d.dagService, nd)
+		if err == uio.ErrNotADir {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		cached = nil
+	}
+	return true, nil
+}
+
+// peekChild returns the cached entry under `name` or, if it isn't cached,
+// its node (without caching it).
+func (d *Directory) peekChild(ctx context.Context, name string) (FSNode, ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	name, err := d.storedName(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, ok := d.entriesCache[name]
+	if ok {
+		return entry, nil, nil
+	}
+
+	nd, err := d.unixfsDir.Find(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, nd, nil
+}
+
+func (d *Directory) Uncache(name string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if entry, ok := d.entriesCache[name]; ok {
+		delete(d.entriesCache, name)
+		d.logEviction(name)
+		d.keepEvicted(entry)
+	}
+}
+
+// keepEvicted stores the evicted 'entry', if it's an unmodified directory,
+// in the shared cache of the root (see `Root.DirCacheSize`).
+func (d *Directory) keepEvicted(entry FSNode) {
+	dir, ok := entry.(*Directory)
+	if !ok || d.root == nil {
+		return
+	}
+	cache := d.root.sharedDirCache()
+	if cache == nil {
+		return
+	}
+
+	dir.lock.Lock()
+	dirty, c := dir.dirty, dir.flushedCid
+	dir.lock.Unlock()
+	if !dirty {
+		cache.put(c, dir)
+	}
+}
+
+// evictedDir returns the directory previously evicted from the entry 'name'
+// of this directory if it's in the shared cache of the root and it's still
+// unmodified with the CID 'c', nil otherwise.
+func (d *Directory) evictedDir(name string, c cid.Cid) *Directory {
+	if d.root == nil {
+		return nil
+	}
+	cache := d.root.sharedDirCache()
+	if cache == nil {
+		return nil
+	}
+	dir := cache.get(c)
+	if dir == nil {
+		return nil
+	}
+
+	dir.lock.Lock()
+	valid := dir.parent == d && dir.name == name && !dir.dirty && dir.flushedCid.Equals(c)
+	dir.lock.Unlock()
+	if !valid {
+		cache.remove(c, dir)
+		return nil
+	}
+	return dir
+}
+
+// logMutation notifies the `MutationLogger` of the root, if any, of the
+// mutation 'm' (timestamping it), or holds it back while a `Batch` is
+// being committed. It must be called with the lock taken.
+func (d *Directory) logMutation(m Mutation) {
+	if d.root != nil && d.root.MutationLogger != nil {
+		m.Time = time.Now()
+		if d.pendingLog != nil {
+			*d.pendingLog = append(*d.pendingLog, m)
+			return
+		}
+		d.root.MutationLogger.LogMutation(m)
+	}
+}
+
+// logWrite notifies the `MutationLogger` of the root, if any, of the new
+// content 'nd' of the file 'fi' cached as the entry 'name', unless it was
+// unlinked or replaced meanwhile.
+func (d *Directory) logWrite(name string, fi *File, nd ipld.Node) {
+	if d.root == nil || d.root.MutationLogger == nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.entriesCache[name] != FSNode(fi) {
+		return
+	}
+	d.logMutation(Mutation{Op: MutationWrite, Path: path.Join(d.Path(), name), Cid: nd.Cid()})
+}
+
+// logEviction notifies the `EventLogger` of the root, if any, that the
+// entry 'name' was dropped from the cache.
+func (d *Directory) logEviction(name string) {
+	if d.root != nil && d.root.EventLogger != nil {
+		d.root.EventLogger.CacheEvicted(path.Join(d.Path(), name))
+	}
+}
+
+// dropCache drops all the cached entries of the directory and, recursively,
+// of its cached directories.
+func (d *Directory) dropCache() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for name, entry := range d.entriesCache {
+		if dir, ok := entry.(*Directory); ok {
+			dir.dropCache()
+		}
+		delete(d.entriesCache, name)
+		d.logEviction(name)
+		d.keepEvicted(entry)
+	}
+}
+
+// UncacheBelow drops the cached entries more than 'depth' levels below this
+// directory (all of them with zero), keeping the upper levels of the tree
+// loaded. The dropped entries are first synced into the directories above
+// them (which keep their changes until flushed).
+func (d *Directory) UncacheBelow(depth int) error {
+	if depth < 0 {
+		return fmt.Errorf("invalid uncache depth: %d", depth)
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if depth > 0 {
+		for _, entry := range d.entriesCache {
+			if dir, ok := entry.(*Directory); ok {
+				if err := dir.UncacheBelow(depth - 1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	err := d.sync(d.ctx)
+	if err != nil {
+		return err
+	}
+	for name, entry := range d.entriesCache {
+		if dir, ok := entry.(*Directory); ok {
+			dir.dropCache()
+		}
+		delete(d.entriesCache, name)
+		d.logEviction(name)
+		d.keepEvicted(entry)
+	}
+	return nil
+}
+
+// CachedChildren returns the (sorted) names of the entries of this directory
+// currently cached in memory, without loading anything from the DAG.
+func (d *Directory) CachedChildren() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	names := make([]string, 0, len(d.entriesCache))
+	for name := range d.entriesCache {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// childFromDag searches through this directories dag node for a child link
+// with the given name
+func (d *Directory) childFromDag(ctx context.Context, name string) (ipld.Node, error) {
+	return d.unixfsDir.Find(ctx, name)
+}
+
+// entryType returns the type of the entry 'name' (`TSymlink` for
+// symlinks, see `PathType`), from its node if it isn't cached (without
+// loading it as an entry).
+func (d *Directory) entryType(ctx context.Context, name string) (NodeType, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if entry, ok := d.entriesCache[name]; ok {
+		if fi, ok := entry.(*File); ok && fi.isSymlink() {
+			return TSymlink, nil
+		}
+		return entry.Type(), nil
+	}
+
+	nd, err := d.childFromDag(ctx, name)
+	if err == os.ErrNotExist && d.caseInsensitive() {
+		if stored, ferr := d.foldedName(ctx, name); ferr != nil {
+			return 0, ferr
+		} else if stored != "" {
+			nd, err = d.childFromDag(ctx, stored)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if d.root != nil && d.root.NodeTransformer != nil {
+		nd, err = d.root.NodeTransformer.Decode(ctx, nd)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		if _, ok := nd.(*dag.RawNode); ok {
+			return TFile, nil
+		}
+		return 0, ErrInvalidChild
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return 0, ErrInvalidChild
+	}
+	switch fsn.Type() {
+	case ft.TDirectory, ft.THAMTShard:
+		return TDir, nil
+	case ft.TSymlink:
+		return TSymlink, nil
+	case ft.TFile, ft.TRaw:
+		return TFile, nil
+	default:
+		return 0, ErrInvalidChild
+	}
+}
+
+// childUnsync returns the child under this directory by the given name
+// without locking, useful for operations which already hold a lock
+func (d *Directory) childUnsync(ctx context.Context, name string) (FSNode, error) {
+	entry, ok := d.entriesCache[name]
+	if ok {
+		return entry, nil
+	}
+
+	c, err := d.childNode(ctx, name)
+	if err == os.ErrNotExist && d.caseInsensitive() {
+		if stored, ferr := d.foldedName(ctx, name); ferr != nil {
+			return nil, ferr
+		} else if stored != "" {
+			return d.childUnsync(ctx, stored)
+		}
+	}
+	return c, err
+}
+
+// caseInsensitive reports whether the root folds the case of the names of
+// the entries (see `Root.CaseInsensitive`).
+func (d *Directory) caseInsensitive() bool {
+	return d.root != nil && d.root.CaseInsensitive
+}
+
+// foldCase returns the name 'name' maps to ignoring case: two names map
+// to the same one exactly when `strings.EqualFold` reports them equal (each
+// rune is replaced by the lowest of its case folding orbit).
+func foldCase(name string) string {
+	return strings.Map(func(r rune) rune {
+		low := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < low {
+				low = f
+			}
+		}
+		return low
+	}, name)
+}
+
+// foldedName returns the name of the entry equal to 'name' ignoring case
+// ("" if none) scanning all the links of the directory.
+func (d *Directory) foldedName(ctx context.Context, name string) (string, error) {
+	var stored string
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if strings.EqualFold(l.Name, name) {
+			stored = l.Name
+			return errStopListing
+		}
+		return nil
+	})
+	if err != nil && err != errStopListing {
+		return "", err
+	}
+	return stored, nil
+}
+
+// storedName returns the spelling under which the entry 'name' is stored:
+// with `Root.CaseInsensitive` the one of the entry equal to it ignoring case
+// (if any), 'name' itself otherwise. It must be called with the lock taken.
+func (d *Directory) storedName(ctx context.Context, name string) (string, error) {
+	if !d.caseInsensitive() {
+		return name, nil
+	}
+	if _, ok := d.entriesCache[name]; ok {
+		return name, nil
+	}
+	stored, err := d.foldedName(ctx, name)
+	if err != nil || stored == "" {
+		return name, err
+	}
+	return stored, nil
+}
+
+// entryName returns the name of the entry 'c' of a directory.
+func entryName(c FSNode) string {
+	switch c := c.(type) {
+	case *Directory:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.name
+	case *File:
+		c.nodeLock.RLock()
+		defer c.nodeLock.RUnlock()
+		return c.name
+	}
+	return ""
+}
+
+type NodeListing struct {
+	Name string
+	Type int
+	Size int64
+	Hash string
+
+	// Sharded is set for directories using the HAMT implementation.
+	Sharded bool
+
+	// ModTime is the last modification time of the entry, only tracked
+	// in memory (it isn't persisted in the UnixFS nodes): it's the zero
+	// time for entries loaded from the DAG and not modified since.
+	ModTime time.Time
+
+	// Local is set, with `ListOptions.CheckLocal`, if the node of the
+	// entry is available without fetching it from the network.
+	Local bool
+}
+
+func (d *Directory) ListNames(ctx context.Context) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var out []string
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		out = append(out, l.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ListWithPrefix returns the (sorted) names of the entries of the directory
+// starting with 'prefix', e.g., for autocompletion. Only the names of the
+// links are read, no entry is loaded. HAMT shards are indexed by the hash of
+// the names, so sharded directories are scanned in full as well.
+func (d *Directory) ListWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var out []string
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if strings.HasPrefix(l.Name, prefix) {
+			out = append(out, l.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(out)
+	return out, nil
+}
+
 func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
 	var out []NodeListing
 	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
@@ -257,152 +1200,2809 @@ func (d *Directory) List(ctx context.Context) ([]NodeListing, error) {
 	return out, err
 }
 
-func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
-		c, err := d.childUnsync(l.Name)
-		if err != nil {
+// ListRecursive lists the entries of the subtree of the directory with
+// their `Name` set to the path relative to it, visiting up to `maxDepth`
+// levels (0 lists the whole subtree). The entries of each directory are
+// listed before the ones of its subdirectories.
+func (d *Directory) ListRecursive(ctx context.Context, maxDepth int) ([]NodeListing, error) {
+	return d.ListRecursiveWithOptions(ctx, RecursiveListOptions{MaxDepth: maxDepth})
+}
+
+// RecursiveListOptions configures `ListRecursiveWithOptions`.
+type RecursiveListOptions struct {
+	// Levels of the subtree visited, 0 lists the whole subtree.
+	MaxDepth int
+
+	// List the symlinks as their targets (see `WalkOptions.FollowSymlinks`),
+	// descending into the directories they point to.
+	FollowSymlinks bool
+}
+
+// ListRecursiveWithOptions lists the entries of the subtree of the
+// directory as `ListRecursive`, as configured by `opts`.
+func (d *Directory) ListRecursiveWithOptions(ctx context.Context, opts RecursiveListOptions) ([]NodeListing, error) {
+	var out []NodeListing
+	err := d.listRecursive(ctx, "", 1, opts, nil, &out)
+	return out, err
+}
+
+// listRecursive appends to `out` the entries of `d` under the path
+// `prefix`, `depth` being the level of its entries and `ancestors` the
+// directories above `d` in the listing.
+func (d *Directory) listRecursive(ctx context.Context, prefix string, depth int, opts RecursiveListOptions, ancestors []*Directory, out *[]NodeListing) error {
+	ancestors = append(ancestors, d)
+
+	// Index in `out` of the entries that may need a second look.
+	listed := make(map[string]int)
+	var names []string
+	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
+		name := nl.Name
+		nl.Name = path.Join(prefix, name)
+		if nl.Type == int(TDir) || opts.FollowSymlinks {
+			listed[name] = len(*out)
+			names = append(names, name)
+		}
+		*out = append(*out, nl)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Resolves the entries in a second pass, `Child` (and following a
+	// symlink) takes the lock of `d` (held by `ForEachEntry`).
+	var subdirs []*Directory
+	var subnames []string
+	for _, name := range names {
+		c, err := d.ChildContext(ctx, name)
+		if err != nil {
+			return err
+		}
+		if opts.FollowSymlinks {
+			target, err := d.followSymlink(ctx, name, c, ancestors)
+			if err != nil {
+				return err
+			}
+			if target != c {
+				nl, err := nodeListing(path.Join(prefix, name), target, false)
+				if err != nil {
+					return err
+				}
+				(*out)[listed[name]] = nl
+				c = target
+			}
+		}
+		if sub, ok := c.(*Directory); ok {
+			subdirs = append(subdirs, sub)
+			subnames = append(subnames, name)
+		}
+	}
+
+	if opts.MaxDepth > 0 && depth >= opts.MaxDepth {
+		return nil
+	}
+
+	for i, sub := range subdirs {
+		if err := sub.listRecursive(ctx, path.Join(prefix, subnames[i]), depth+1, opts, ancestors, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxSymlinkHops bounds the chain of symlinks followed to resolve one.
+const maxSymlinkHops = 40
+
+// followSymlink returns the entry a symlink 'c' (named 'name' in this
+// directory) resolves to, following the chain of symlinks, 'c' itself if
+// it isn't a symlink or it's dangling (its target doesn't exist). Targets
+// are resolved with 'ctx' as paths from the root (the relative ones from
+// the directory of the symlink). Returns `ErrSymlinkLoop` if the chain is
+// too long or it resolves to one of `ancestors`.
+//
+// The ancestors are compared by identity, not by CID: they stay cached in
+// their parents while their subtree is visited, so resolving a path to one
+// of them returns the same `Directory`. Comparing CIDs would report a loop
+// for any directory with the same content as an ancestor (e.g., two empty
+// ones), which is visited only once.
+func (d *Directory) followSymlink(ctx context.Context, name string, c FSNode, ancestors []*Directory) (FSNode, error) {
+	link := path.Join(d.Path(), name)
+	pth, cur := link, c
+	for hops := 0; ; hops++ {
+		fi, ok := cur.(*File)
+		if !ok || !fi.isSymlink() {
+			break
+		}
+		if d.root == nil {
+			return c, nil
+		}
+		if hops == maxSymlinkHops {
+			return nil, fmt.Errorf("%w: %s", ErrSymlinkLoop, link)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		target, err := fi.symlinkTarget()
+		if err != nil {
+			return nil, err
+		}
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(pth), target)
+		}
+		next, err := ResolvePath(ctx, d.root, path.Clean(target), ResolveOptions{})
+		if err == os.ErrNotExist {
+			return c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pth, cur = path.Clean(target), next
+	}
+
+	if dir, ok := cur.(*Directory); ok {
+		for _, a := range ancestors {
+			if a == dir {
+				return nil, fmt.Errorf("%w: %s", ErrSymlinkLoop, link)
+			}
+		}
+	}
+	return cur, nil
+}
+
+// WalkOptions configures `Walk`.
+type WalkOptions struct {
+	// Keep the visited entries cached in their directories (warming the
+	// caches for later edits). Otherwise the entries the walk loads are
+	// uncached again once visited (after syncing any change made to them
+	// into their directory), bounding the memory used by the walk, while
+	// the ones already cached are left as they were.
+	KeepCached bool
+
+	// Visit the entries symlinks resolve to (under the path of the
+	// symlink), descending into the directories they point to, instead of
+	// the symlinks themselves (as `find -L`). Dangling symlinks are
+	// visited as they are. A symlink to this directory or to one of the
+	// directories above it in the walk stops it with `ErrSymlinkLoop`.
+	// The entries reached through symlinks stay cached.
+	FollowSymlinks bool
+}
+
+// Walk calls 'f' for each entry of the subtree of this directory, with its
+// path relative to it, visiting the entries of a directory right after it
+// (in the order of its links). If 'f' returns `fs.SkipDir` for a directory
+// its entries aren't visited, any other error stops the walk.
+func (d *Directory) Walk(ctx context.Context, opts WalkOptions, f func(pth string, n FSNode) error) error {
+	return d.walk(ctx, "", opts, nil, f)
+}
+
+// walk visits the entries of this directory under the path 'prefix',
+// 'ancestors' being the directories above it in the walk.
+func (d *Directory) walk(ctx context.Context, prefix string, opts WalkOptions, ancestors []*Directory, f func(string, FSNode) error) error {
+	ancestors = append(ancestors, d)
+
+	var names []string
+	d.lock.Lock()
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		names = append(names, l.Name)
+		return nil
+	})
+	d.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		d.lock.Lock()
+		_, cached := d.entriesCache[name]
+		d.lock.Unlock()
+
+		c, err := d.ChildContext(ctx, name)
+		if err != nil {
+			return err
+		}
+		target := c
+		if opts.FollowSymlinks {
+			target, err = d.followSymlink(ctx, name, c, ancestors)
+			if err != nil {
+				return err
+			}
+		}
+		err = d.walkEntry(ctx, path.Join(prefix, name), target, opts, ancestors, f)
+		if !cached && !opts.KeepCached {
+			if uerr := d.uncacheSynced(name, c); err == nil {
+				err = uerr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkEntry visits the entry 'c' (and its subtree) as part of `Walk`.
+func (d *Directory) walkEntry(ctx context.Context, pth string, c FSNode, opts WalkOptions, ancestors []*Directory, f func(string, FSNode) error) error {
+	err := f(pth, c)
+	dir, ok := c.(*Directory)
+	if !ok {
+		return err
+	}
+	if err == fs.SkipDir {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return dir.walk(ctx, pth, opts, ancestors, f)
+}
+
+// uncacheSynced drops the entry 'c' cached as 'name', first syncing its
+// node into the directory so no change made to it is lost (the directory
+// is then dirty if the entry had changes not propagated yet).
+func (d *Directory) uncacheSynced(name string, c FSNode) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.entriesCache[name] != c {
+		return nil
+	}
+	fi, isFile := c.(*File)
+	changed := isFile && fi.isUnsynced()
+	nd, err := c.GetNode()
+	if err != nil {
+		return err
+	}
+	if dir, ok := c.(*Directory); ok {
+		dir.lock.Lock()
+		changed = !dir.flushedCid.Equals(nd.Cid())
+		dir.lock.Unlock()
+	}
+	err = d.addUnixFSChild(d.ctx, child{name, nd})
+	if err != nil {
+		return err
+	}
+	if changed {
+		d.markDirty()
+	}
+	switch c := c.(type) {
+	case *Directory:
+		c.setFlushed(nd)
+	case *File:
+		c.markSynced(nd)
+	}
+
+	delete(d.entriesCache, name)
+	d.logEviction(name)
+	d.keepEvicted(c)
+	return nil
+}
+
+func (d *Directory) ForEachEntry(ctx context.Context, f func(NodeListing) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.forEachEntry(ctx, ListOptions{}, f)
+}
+
+// ForEachEntryWithOptions calls `f` as `ForEachEntry` applying the per-entry
+// options of `opts` (`TypeFilter`, `ExcludeHidden`, `IncludeDirSizes`,
+// `Prefetch` and `CheckLocal`), the ones that depend on the rest of the
+// entries are ignored (see `ListWithOptions`).
+func (d *Directory) ForEachEntryWithOptions(ctx context.Context, opts ListOptions, f func(NodeListing) error) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.forEachEntry(ctx, opts, f)
+}
+
+// forEachEntry implements `ForEachEntry` applying the per-entry options
+// of `opts` (the ones that don't depend on the rest of the entries). It
+// must be called with the lock taken.
+func (d *Directory) forEachEntry(ctx context.Context, opts ListOptions, f func(NodeListing) error) error {
+	if opts.Prefetch > 0 {
+		return d.forEachEntryPrefetch(ctx, opts, f)
+	}
+
+	return d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if !opts.matchesName(l.Name) {
+			return nil
+		}
+		var local bool
+		if opts.CheckLocal {
+			var err error
+			local, err = d.isLocal(ctx, l.Name, l.Cid)
+			if err != nil {
+				return err
+			}
+		}
+		c, err := d.childUnsync(ctx, l.Name)
+		if err != nil {
+			return err
+		}
+		return d.listEntry(l.Name, c, local, opts, f)
+	})
+}
+
+// listEntry calls `f` with the listing of the entry 'c' if it's selected
+// by `opts`, 'local' is reported in `NodeListing.Local`. It must be called
+// with the lock taken.
+func (d *Directory) listEntry(name string, c FSNode, local bool, opts ListOptions, f func(NodeListing) error) error {
+	if !opts.matchesType(c.Type()) {
+		return nil
+	}
+
+	child, err := nodeListing(name, c, opts.IncludeDirSizes)
+	if err != nil {
+		return err
+	}
+	if t := d.entryModTimes[name]; t.After(child.ModTime) {
+		child.ModTime = t
+	}
+	child.Local = local
+
+	return f(child)
+}
+
+// forEachEntryPrefetch implements `forEachEntry` fetching the nodes of the
+// entries not yet cached `opts.Prefetch` entries ahead of the listing.
+func (d *Directory) forEachEntryPrefetch(ctx context.Context, opts ListOptions, f func(NodeListing) error) error {
+	var links []*ipld.Link
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if !opts.matchesName(l.Name) {
+			return nil
+		}
+		// The HAMT implementation reuses the link.
+		links = append(links, &ipld.Link{Name: l.Name, Size: l.Size, Cid: l.Cid})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var local []bool
+	if opts.CheckLocal {
+		local = make([]bool, len(links))
+		for i, l := range links {
+			local[i], err = d.isLocal(ctx, l.Name, l.Cid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	fetched := make([]chan *ipld.NodeOption, len(links))
+	for i, l := range links {
+		if _, ok := d.entriesCache[l.Name]; !ok {
+			fetched[i] = make(chan *ipld.NodeOption, 1)
+		}
+	}
+
+	window := make(chan struct{}, opts.Prefetch)
+	go func() {
+		for i, l := range links {
+			if fetched[i] == nil {
+				continue
+			}
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(c cid.Cid, out chan<- *ipld.NodeOption) {
+				nd, err := d.dagService.Get(ctx, c)
+				out <- &ipld.NodeOption{Node: nd, Err: err}
+			}(l.Cid, fetched[i])
+		}
+	}()
+
+	for i, l := range links {
+		c, ok := d.entriesCache[l.Name]
+		if !ok {
+			var res *ipld.NodeOption
+			select {
+			case res = <-fetched[i]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			<-window
+			if res.Err != nil {
+				return res.Err
+			}
+
+			c, err = d.cacheNode(ctx, l.Name, res.Node)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = d.listEntry(l.Name, c, local != nil && local[i], opts, f)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeListing returns the listing of the entry 'c' named 'name'. The size
+// of directories is only set (to the cumulative size of their DAG) if
+// 'includeDirSize' is set.
+func nodeListing(name string, c FSNode, includeDirSize bool) (NodeListing, error) {
+	nd, err := c.GetNode()
+	if err != nil {
+		return NodeListing{}, err
+	}
+
+	out := NodeListing{
+		Name: name,
+		Type: int(c.Type()),
+		Hash: nd.Cid().String(),
+	}
+
+	switch c := c.(type) {
+	case *File:
+		out.Size, err = c.Size()
+		if err != nil {
+			return NodeListing{}, err
+		}
+		out.ModTime = c.modifiedAt()
+	case *Directory:
+		out.Sharded = c.isSharded()
+		c.lock.Lock()
+		out.ModTime = c.modTime
+		c.lock.Unlock()
+		if includeDirSize {
+			size, err := nd.Size()
+			if err != nil {
+				return NodeListing{}, err
+			}
+			out.Size = int64(size)
+		}
+	}
+	return out, nil
+}
+
+// ListGrouped returns the listings of the directories and of the files
+// (everything else) under this directory, in a single pass over its entries.
+func (d *Directory) ListGrouped(ctx context.Context) (dirs []NodeListing, files []NodeListing, err error) {
+	err = d.ForEachEntry(ctx, func(nl NodeListing) error {
+		if nl.Type == int(TDir) {
+			dirs = append(dirs, nl)
+		} else {
+			files = append(files, nl)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dirs, files, nil
+}
+
+// ListModifiedSince returns the listings of the entries of the directory
+// modified after 'since'. Modification times are only tracked in memory
+// (see `NodeListing.ModTime`), so changes made before the entries were
+// loaded are not reported.
+func (d *Directory) ListModifiedSince(ctx context.Context, since time.Time) ([]NodeListing, error) {
+	var out []NodeListing
+	err := d.ForEachEntry(ctx, func(nl NodeListing) error {
+		if nl.ModTime.After(since) {
+			out = append(out, nl)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// BuildListingManifest adds to the DAG service a dag-cbor node mapping the
+// name of every entry of the directory to its CID (hashed with the hash
+// function of the directory's CID builder) and returns its CID. The map is
+// encoded canonically, so the same entries always give the same manifest,
+// independently of the layout of the directory (e.g., its HAMT shards).
+func (d *Directory) BuildListingManifest(ctx context.Context) (cid.Cid, error) {
+	d.lock.Lock()
+	entries := make(map[string]cid.Cid)
+	err := d.sync(ctx)
+	if err == nil {
+		err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+			entries[l.Name] = l.Cid
+			return nil
+		})
+	}
+	d.lock.Unlock()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	c, err := d.GetCidBuilder().Sum(nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+	nd, err := cbor.WrapObject(entries, c.Prefix().MhType, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	err = d.dagService.Add(ctx, nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// ForEachEntryShardStream calls `f` with the link of every entry of the
+// directory without loading them. For sharded directories the HAMT is
+// traversed directly in the DAG (in shard order) loading a single shard
+// node at a time (plus its ancestors), bounding memory when enumerating
+// huge directories. The enumeration is done on a snapshot of the directory
+// node taken when the method is called (so the lock isn't held during it)
+// and no more shards are fetched once 'ctx' is cancelled.
+func (d *Directory) ForEachEntryShardStream(ctx context.Context, f func(*ipld.Link) error) error {
+	nd, err := d.GetNode()
+	if err != nil {
+		return err
+	}
+
+	fsn, err := ft.ExtractFSNode(nd)
+	if err != nil {
+		return err
+	}
+
+	if fsn.Type() != ft.THAMTShard {
+		for _, l := range nd.Links() {
+			if err := f(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	padLen := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	return d.streamShard(ctx, nd, padLen, f)
+}
+
+// streamShard implements the HAMT traversal of `ForEachEntryShardStream`.
+// All the shards of a HAMT have the same fanout, so links whose name is
+// only the (`padLen` long) index prefix point to child shards and the rest
+// to entries.
+func (d *Directory) streamShard(ctx context.Context, shard ipld.Node, padLen int, f func(*ipld.Link) error) error {
+	for _, l := range shard.Links() {
+		if len(l.Name) > padLen {
+			entry := *l
+			entry.Name = l.Name[padLen:]
+			if err := f(&entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		child, err := d.dagService.Get(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+		if err := d.streamShard(ctx, child, padLen, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProofPath returns the CIDs of the nodes traversed resolving 'pth' from the
+// current node of this directory (which is the first one): every directory
+// node, including the internal shards of sharded directories, and the node
+// of the final entry. It's the set of nodes a verifier needs to prove the
+// inclusion of the entry under the directory CID. Unflushed changes are
+// reflected without storing their nodes (see `Flush`).
+func (d *Directory) ProofPath(ctx context.Context, pth string) ([]cid.Cid, error) {
+	// The unflushed changes are resolved over an in-memory overlay,
+	// without storing them.
+	dserv := newOverlayDagServ(d.dagService)
+	nd, err := d.computeNode(ctx, dserv)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []cid.Cid{nd.Cid()}
+	for _, name := range strings.Split(pth, "/") {
+		if name == "" {
+			continue
+		}
+
+		pbnd, ok := nd.(*dag.ProtoNode)
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve %s: not a directory", name)
+		}
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil {
+			return nil, err
+		}
+
+		var lnk *ipld.Link
+		switch fsn.Type() {
+		case ft.TDirectory:
+			lnk, err = pbnd.GetNodeLink(name)
+			if err == dag.ErrLinkNotFound {
+				return nil, os.ErrNotExist
+			}
+		case ft.THAMTShard:
+			var shards []cid.Cid
+			lnk, shards, err = shardLookup(ctx, dserv, pbnd, name)
+			out = append(out, shards...)
+		default:
+			return nil, fmt.Errorf("cannot resolve %s: not a directory", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		nd, err = lnk.GetNode(ctx, dserv)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, nd.Cid())
+	}
+	return out, nil
+}
+
+// shardLookup finds the link to the entry 'name' of the HAMT rooted at
+// 'shard', also returning the CIDs of the internal shards traversed (the
+// ones the HAMT loads from 'dserv' to find it).
+func shardLookup(ctx context.Context, dserv ipld.DAGService, shard *dag.ProtoNode, name string) (*ipld.Link, []cid.Cid, error) {
+	rds := &recordingDagServ{DAGService: dserv}
+	h, err := hamt.NewHamtFromDag(rds, shard)
+	if err != nil {
+		return nil, nil, err
+	}
+	lnk, err := h.Find(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lnk, rds.got, nil
+}
+
+// recordingDagServ is a DAG service recording the CIDs of the nodes got
+// through it, in order.
+type recordingDagServ struct {
+	ipld.DAGService
+	got []cid.Cid
+}
+
+func (rds *recordingDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	nd, err := rds.DAGService.Get(ctx, c)
+	if err == nil {
+		rds.got = append(rds.got, c)
+	}
+	return nd, err
+}
+
+// ListSort is the order of the entries returned by `ListWithOptions`.
+type ListSort int
+
+const (
+	// SortNone lists the entries in the order they are stored in the
+	// directory (which for sharded directories is the HAMT order).
+	SortNone ListSort = iota
+	// SortByName lists the entries sorted by name.
+	SortByName
+	// SortByModTime lists the entries sorted by `NodeListing.ModTime`,
+	// oldest first (entries with the same time keep the order they're
+	// stored in). See `ListOptions.UnknownModTimeLast`.
+	SortByModTime
+)
+
+// ListOptions is used by ListWithOptions
+type ListOptions struct {
+	Sort ListSort
+
+	// With `SortByModTime`, list the entries with an unknown modification
+	// time (the zero time, e.g., not modified since loaded from the DAG)
+	// after the rest instead of before them.
+	UnknownModTimeLast bool
+
+	// Only list entries of these types (all of them if empty).
+	TypeFilter []NodeType
+
+	// Skip the first `Offset` entries and list at most `Limit` of them
+	// (zero means no limit), both applied after filtering and sorting.
+	Offset int
+	Limit  int
+
+	// Report the cumulative size of directories in `NodeListing.Size`.
+	IncludeDirSizes bool
+
+	// Fetch the nodes of up to `Prefetch` entries ahead of the one being
+	// listed concurrently from the DAG service, overlapping their fetch
+	// latency with the processing of the listing. Zero disables it.
+	Prefetch int
+
+	// Prepend the "." entry of the directory itself and the ".." entry of
+	// its parent, omitted for the root directory, as `ls -a` does. They
+	// aren't sorted with the rest of the entries but they are the first
+	// ones of the `Offset`/`Limit` window, `TypeFilter` applies.
+	IncludeDotEntries bool
+
+	// Skip the hidden entries, the ones whose name begins with ".", as
+	// part of the filtering (so before sorting and the window). The "."
+	// and ".." entries of `IncludeDotEntries` are still listed.
+	ExcludeHidden bool
+
+	// Report in `NodeListing.Local` whether the node of every entry (not
+	// the rest of its DAG) is available locally, checked before fetching
+	// it if the DAG service implements `LocalChecker` (otherwise no entry
+	// is reported as local). Entries already loaded in memory are local.
+	// With `Prefetch` the check is done before starting the prefetch.
+	CheckLocal bool
+}
+
+// LocalChecker is implemented by DAG services that can tell whether a
+// node is stored locally without fetching it (see `ListOptions.CheckLocal`).
+type LocalChecker interface {
+	HasLocal(ctx context.Context, c cid.Cid) (bool, error)
+}
+
+// isLocal reports whether the node `c` of the entry 'name' is available
+// without fetching it (see `ListOptions.CheckLocal`). It must be called
+// with the lock taken.
+func (d *Directory) isLocal(ctx context.Context, name string, c cid.Cid) (bool, error) {
+	if _, ok := d.entriesCache[name]; ok {
+		return true, nil
+	}
+	return d.hasLocal(ctx, c)
+}
+
+// hasLocal reports whether the node 'c' is stored locally, false if the DAG
+// service can't tell (it doesn't implement `LocalChecker`).
+func (d *Directory) hasLocal(ctx context.Context, c cid.Cid) (bool, error) {
+	dserv := d.dagService
+	if tds, ok := dserv.(*throttledDagServ); ok {
+		dserv = tds.DAGService
+	}
+	lc, ok := dserv.(LocalChecker)
+	if !ok {
+		return false, nil
+	}
+	return lc.HasLocal(ctx, c)
+}
+
+// matchesName reports whether the entry 'name' is selected by `opts`.
+func (opts ListOptions) matchesName(name string) bool {
+	return !opts.ExcludeHidden || !strings.HasPrefix(name, ".")
+}
+
+func (opts ListOptions) matchesType(t NodeType) bool {
+	if len(opts.TypeFilter) == 0 {
+		return true
+	}
+	for _, typ := range opts.TypeFilter {
+		if typ == t {
+			return true
+		}
+	}
+	return false
+}
+
+// errStopListing stops an iteration over entries early, e.g., in
+// `ListWithOptions` once all the requested ones have been collected.
+var errStopListing = errors.New("listing complete")
+
+// ListWithOptions lists the entries of the directory as configured by
+// `opts`. Without sorting the iteration stops as soon as the requested
+// window of entries has been collected, when sorting all the (filtered)
+// entries need to be collected first.
+func (d *Directory) ListWithOptions(ctx context.Context, opts ListOptions) ([]NodeListing, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("invalid listing window (offset %d, limit %d)", opts.Offset, opts.Limit)
+	}
+
+	// Listed before taking the lock, the one of the parent can't be
+	// taken while holding it.
+	var dots []NodeListing
+	if opts.IncludeDotEntries && opts.matchesType(TDir) {
+		var err error
+		dots, err = d.dotEntries(opts.IncludeDirSizes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The dot entries open the window, the rest of it is left to the
+	// other entries.
+	if len(dots) > 0 {
+		skipped := len(dots)
+		if opts.Offset < skipped {
+			skipped = opts.Offset
+		}
+		dots = dots[skipped:]
+		if opts.Limit > 0 && len(dots) >= opts.Limit {
+			return dots[:opts.Limit], nil
+		}
+		opts.Offset -= skipped
+		if opts.Limit > 0 {
+			opts.Limit -= len(dots)
+		}
+	}
+
+	out, err := d.listWithOptions(ctx, opts)
+	if err != nil || len(dots) == 0 {
+		return out, err
+	}
+	return append(dots, out...), nil
+}
+
+// dotEntries returns the listings of the "." and ".." entries of the
+// directory (see `ListOptions.IncludeDotEntries`).
+func (d *Directory) dotEntries(includeDirSize bool) ([]NodeListing, error) {
+	self, err := nodeListing(".", d, includeDirSize)
+	if err != nil {
+		return nil, err
+	}
+	out := []NodeListing{self}
+
+	if p, ok := d.parent.(*Directory); ok {
+		parent, err := nodeListing("..", p, includeDirSize)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, parent)
+	}
+	return out, nil
+}
+
+// listWithOptions implements `ListWithOptions` for the entries of the
+// directory.
+func (d *Directory) listWithOptions(ctx context.Context, opts ListOptions) ([]NodeListing, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var out []NodeListing
+	skipped := 0
+	err := d.forEachEntry(ctx, opts, func(nl NodeListing) error {
+		if opts.Sort != SortNone {
+			out = append(out, nl)
+			return nil
+		}
+
+		if skipped < opts.Offset {
+			skipped++
+			return nil
+		}
+		out = append(out, nl)
+		if opts.Limit > 0 && len(out) == opts.Limit {
+			return errStopListing
+		}
+		return nil
+	})
+	if err != nil && err != errStopListing {
+		return nil, err
+	}
+
+	if opts.Sort == SortNone {
+		return out, nil
+	}
+
+	switch opts.Sort {
+	case SortByName:
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	case SortByModTime:
+		sort.SliceStable(out, func(i, j int) bool {
+			ti, tj := out[i].ModTime, out[j].ModTime
+			if opts.UnknownModTimeLast && ti.IsZero() != tj.IsZero() {
+				return tj.IsZero()
+			}
+			return ti.Before(tj)
+		})
+	default:
+		return nil, fmt.Errorf("unrecognized listing sort: %d", opts.Sort)
+	}
+
+	if opts.Offset >= len(out) {
+		return nil, nil
+	}
+	out = out[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(out) {
+		out = out[:opts.Limit]
+	}
+	return out, nil
+}
+
+// ReadDirEntries returns the entries of the directory as `os.DirEntry`s,
+// their `Info` is computed (from the node of the entry) when called.
+func (d *Directory) ReadDirEntries(ctx context.Context) ([]os.DirEntry, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var out []os.DirEntry
+	err := d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		c, err := d.childUnsync(ctx, l.Name)
+		if err != nil {
+			return err
+		}
+		out = append(out, &dirEntry{name: l.Name, fsn: c})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// dirEntry implements `os.DirEntry` for an entry of a `Directory`.
+type dirEntry struct {
+	name string
+	fsn  FSNode
+}
+
+func (de *dirEntry) Name() string {
+	return de.name
+}
+
+func (de *dirEntry) IsDir() bool {
+	return IsDir(de.fsn)
+}
+
+func (de *dirEntry) Type() fs.FileMode {
+	if IsDir(de.fsn) {
+		return fs.ModeDir
+	}
+	if fi, ok := de.fsn.(*File); ok && fi.isSymlink() {
+		return fs.ModeSymlink
+	}
+	return 0
+}
+
+// Info returns the size (of the file content, or the cumulative size of
+// the DAG for directories), mode and modification time (see
+// `NodeListing.ModTime`) of the entry.
+func (de *dirEntry) Info() (fs.FileInfo, error) {
+	info := &fileInfo{name: de.name, mode: de.Type()}
+
+	switch c := de.fsn.(type) {
+	case *File:
+		st, err := c.Stat()
+		if err != nil {
+			return nil, err
+		}
+		info.size = st.Size
+		info.mode = st.Mode
+		info.modTime = st.ModTime
+	case *Directory:
+		nd, err := c.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		size, err := nd.Size()
+		if err != nil {
+			return nil, err
+		}
+		info.size = int64(size)
+		info.mode |= 0755
+
+		c.lock.Lock()
+		info.modTime = c.modTime
+		c.lock.Unlock()
+	}
+	return info, nil
+}
+
+// fileInfo implements `fs.FileInfo` for a `dirEntry`.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// CopyFileTo streams the content of the file named 'name' into 'w' (without
+// buffering it in memory) returning the number of bytes written. The copy
+// is aborted if 'ctx' is cancelled.
+func (d *Directory) CopyFileTo(ctx context.Context, name string, w io.Writer) (int64, error) {
+	fsn, err := d.ChildContext(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, ok := fsn.(*File)
+	if !ok {
+		return 0, ErrIsDirectory
+	}
+
+	nd, err := fi.GetNode()
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, d.dagService)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, &ctxReader{ctx: ctx, r: r})
+}
+
+// FileChecksum streams the content of the file named 'name' through 'h'
+// (see `CopyFileTo`) and returns the resulting digest.
+func (d *Directory) FileChecksum(ctx context.Context, name string, h hash.Hash) ([]byte, error) {
+	_, err := d.CopyFileTo(ctx, name, h)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// WriteAt writes 'p' at the offset 'off' of the file named 'name' through a
+// new write descriptor, filling with zeros the gap if 'off' is past the end
+// of the file, and closes it syncing the change up to the root. Concurrent
+// writes to the same file (through this method or other write descriptors)
+// are serialized by the lock of the file, so the last one to write an
+// overlapping range wins.
+func (d *Directory) WriteAt(ctx context.Context, name string, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	fsn, err := d.ChildContext(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return 0, ErrIsDirectory
+	}
+
+	fd, err := fi.OpenContext(ctx, Flags{Write: true, Sync: true})
+	if err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		fd.Close()
+		return 0, err
+	}
+
+	err = fd.(*fileDescriptor).prepareAppend(off + int64(len(p)))
+	if err != nil {
+		fd.Close()
+		return 0, err
+	}
+
+	n, err := fd.WriteAt(p, off)
+	if err != nil {
+		fd.Close()
+		return n, err
+	}
+	return n, fd.Close()
+}
+
+// ctxReader stops reading from the underlying reader once its
+// context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr *ctxReader) Read(b []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(b)
+}
+
+// Mkdir creates the directory 'name' under this one (see `MkdirContext`),
+// using the context the directory was created with.
+func (d *Directory) Mkdir(name string) (*Directory, error) {
+	return d.MkdirContext(d.ctx, name)
+}
+
+// MkdirContext creates the directory 'name' under this one, returning it
+// along with `os.ErrExist` if it already exists. The new directory starts
+// with the entries of the template of its nearest ancestor that has one
+// (see `SetTemplate`).
+func (d *Directory) MkdirContext(ctx context.Context, name string) (*Directory, error) {
+	return d.mkdir(ctx, name, nil)
+}
+
+// mkdir implements `MkdirContext` creating the new directory with the CID
+// builder 'b' (the one of this directory if nil).
+func (d *Directory) mkdir(ctx context.Context, name string, b cid.Builder) (*Directory, error) {
+	defer d.checkDirtyBudget()
+
+	if err := d.checkName(name); err != nil {
+		return nil, err
+	}
+
+	template := d.templateFor()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.mkdirUnsync(ctx, name, b, template)
+}
+
+// mkdirUnsync implements `mkdir` applying 'template' (see `templateFor`) to
+// the new directory, it must be called with the lock taken.
+func (d *Directory) mkdirUnsync(ctx context.Context, name string, b cid.Builder, template map[string]ipld.Node) (*Directory, error) {
+	fsn, err := d.childUnsync(ctx, name)
+	if err == nil {
+		switch fsn := fsn.(type) {
+		case *Directory:
+			return fsn, os.ErrExist
+		case *File:
+			return nil, os.ErrExist
+		default:
+			return nil, fmt.Errorf("unrecognized type: %#v", fsn)
+		}
+	}
+
+	err = d.checkChildDepth()
+	if err != nil {
+		return nil, err
+	}
+
+	if b == nil {
+		b = d.GetCidBuilder()
+	}
+	ndir, err := d.emptyDirNode(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new directory outlives the call, it keeps the context of this
+	// one (the one of the call is used for the operations below).
+	dirobj, err := NewDirectory(d.ctx, name, ndir, d, d.dagService)
+	if err != nil {
+		return nil, err
+	}
+	if template != nil {
+		err = dirobj.applyTemplate(ctx, template)
+		if err != nil {
+			return nil, err
+		}
+		ndir, err = dirobj.unixfsDir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = d.addEntryNode(ctx, ndir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.addUnixFSChild(ctx, child{name, ndir})
+	if err != nil {
+		return nil, err
+	}
+
+	dirobj.modTime = time.Now()
+	d.entriesCache[name] = dirobj
+	d.modTime = time.Now()
+	d.markDirty()
+	m := Mutation{Op: MutationMkdir, Path: path.Join(d.Path(), name)}
+	if template != nil {
+		// Replayed as the addition of the populated directory.
+		m.Cid = ndir.Cid()
+	}
+	d.logMutation(m)
+	return dirobj, nil
+}
+
+// Unlink removes the entry 'name' from this directory (see `UnlinkContext`),
+// using the context the directory was created with.
+func (d *Directory) Unlink(name string) error {
+	return d.UnlinkContext(d.ctx, name)
+}
+
+// UnlinkContext removes the entry 'name' from this directory.
+func (d *Directory) UnlinkContext(ctx context.Context, name string) error {
+	defer d.checkDirtyBudget()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.unlinkUnsync(ctx, name)
+}
+
+// unlinkUnsync implements `UnlinkContext`, it must be called with the lock
+// taken.
+func (d *Directory) unlinkUnsync(ctx context.Context, name string) error {
+	name, err := d.storedName(ctx, name)
+	if err != nil {
+		return err
+	}
+	cached := d.entriesCache[name]
+	delete(d.entriesCache, name)
+	delete(d.entryModTimes, name)
+
+	err = d.unixfsDir.RemoveChild(ctx, name)
+	if err != nil {
+		return err
+	}
+	d.untrackLink(name)
+	detachEntry(cached)
+
+	d.modTime = time.Now()
+	d.markDirty()
+	d.logMutation(Mutation{Op: MutationUnlink, Path: path.Join(d.Path(), name)})
+	return nil
+}
+
+// Swap exchanges the files or directories behind the existing entries
+// 'nameA' and 'nameB' in a single step (their cached instances are renamed
+// accordingly). If either doesn't exist nothing is modified.
+func (d *Directory) Swap(nameA, nameB string) error {
+	return d.SwapContext(d.ctx, nameA, nameB)
+}
+
+// SwapContext exchanges the entries 'nameA' and 'nameB' as `Swap` using
+// 'ctx' for the operations it entails.
+func (d *Directory) SwapContext(ctx context.Context, nameA, nameB string) error {
+	defer d.checkDirtyBudget()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The links are modified directly (see `trackLink`).
+	d.linkSizes = nil
+
+	// Both entries are replaced under the spelling they are stored with.
+	nameA, err := d.storedName(ctx, nameA)
+	if err != nil {
+		return err
+	}
+	nameB, err = d.storedName(ctx, nameB)
+	if err != nil {
+		return err
+	}
+
+	a, err := d.childUnsync(ctx, nameA)
+	if err != nil {
+		return err
+	}
+	b, err := d.childUnsync(ctx, nameB)
+	if err != nil {
+		return err
+	}
+	if nameA == nameB {
+		return nil
+	}
+
+	nda, err := a.GetNode()
+	if err != nil {
+		return err
+	}
+	ndb, err := b.GetNode()
+	if err != nil {
+		return err
+	}
+	nda, err = d.encodeNode(ctx, nda)
+	if err != nil {
+		return err
+	}
+	ndb, err = d.encodeNode(ctx, ndb)
+	if err != nil {
+		return err
+	}
+
+	// Adding over an existing entry replaces it.
+	err = d.unixfsDir.AddChild(ctx, nameA, ndb)
+	if err != nil {
+		return err
+	}
+	err = d.unixfsDir.AddChild(ctx, nameB, nda)
+	if err != nil {
+		if rerr := d.unixfsDir.AddChild(ctx, nameA, nda); rerr != nil {
+			log.Errorf("cannot restore %s after a failed swap: %s", path.Join(d.Path(), nameA), rerr)
+		}
+		return err
+	}
+
+	setEntryName(a, nameB)
+	setEntryName(b, nameA)
+	d.entriesCache[nameA] = b
+	d.entriesCache[nameB] = a
+
+	d.modTime = time.Now()
+	d.entryModTimes[nameA] = d.modTime
+	d.entryModTimes[nameB] = d.modTime
+	d.markDirty()
+	d.logMutation(Mutation{
+		Op:   MutationSwap,
+		Path: path.Join(d.Path(), nameA),
+		Dest: path.Join(d.Path(), nameB),
+	})
+	return nil
+}
+
+// setEntryName changes the name of the cached entry 'c' of a directory.
+func setEntryName(c FSNode, name string) {
+	switch c := c.(type) {
+	case *Directory:
+		c.lock.Lock()
+		c.name = name
+		c.lock.Unlock()
+	case *File:
+		c.nodeLock.Lock()
+		c.name = name
+		c.nodeLock.Unlock()
+	}
+}
+
+// renameCase changes the name of the entry 'name' to 'newName', equal to
+// it ignoring case (see `Root.CaseInsensitive`), in a single step under the
+// lock of the directory, keeping its cached instance.
+func (d *Directory) renameCase(ctx context.Context, name, newName string) error {
+	defer d.checkDirtyBudget()
+
+	if err := d.checkName(newName); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, err := d.childUnsync(ctx, name)
+	if err != nil {
+		return err
+	}
+	oldName := entryName(c)
+	if oldName == newName {
+		return nil
+	}
+	nd, err := c.GetNode()
+	if err != nil {
+		return err
+	}
+
+	err = d.unixfsDir.RemoveChild(ctx, oldName)
+	if err != nil {
+		return err
+	}
+	d.untrackLink(oldName)
+	err = d.addUnixFSChild(ctx, child{newName, nd})
+	if err != nil {
+		if rerr := d.addUnixFSChild(ctx, child{oldName, nd}); rerr != nil {
+			log.Errorf("cannot restore %s after a failed rename: %s", path.Join(d.Path(), oldName), rerr)
+		}
+		return err
+	}
+
+	delete(d.entriesCache, oldName)
+	delete(d.entryModTimes, oldName)
+	setEntryName(c, newName)
+	d.entriesCache[newName] = c
+	d.modTime = time.Now()
+	d.entryModTimes[newName] = d.modTime
+	d.markDirty()
+	d.logMutation(Mutation{Op: MutationUnlink, Path: path.Join(d.Path(), oldName)})
+	d.logMutation(Mutation{Op: MutationAdd, Path: path.Join(d.Path(), newName), Cid: nd.Cid()})
+	return nil
+}
+
+// RenameEach renames every entry of the directory (see `RenameEachContext`),
+// using the context the directory was created with.
+func (d *Directory) RenameEach(f func(oldName string) (newName string, keep bool)) error {
+	return d.RenameEachContext(d.ctx, f)
+}
+
+// RenameEachContext renames every entry of the directory to the name
+// returned by 'f' for it, leaving untouched the entries for which 'keep' is
+// false or the name is the same. The resulting names are checked for
+// collisions (between renamed entries or with the ones left in place) before
+// modifying anything, in which case an error is returned and no entry is
+// renamed. 'f' is called without the lock of the directory taken (so it can
+// inspect it), if the entries change in the meantime an error is returned
+// and none is renamed. 'ctx' is used for the operations it entails.
+func (d *Directory) RenameEachContext(ctx context.Context, f func(oldName string) (newName string, keep bool)) error {
+	defer d.checkDirtyBudget()
+
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	renames := make(map[string]string)
+	final := make(map[string]string, len(names))
+	for _, name := range names {
+		newName, keep := f(name)
+		if !keep || newName == name {
+			newName = name
+		} else {
+			if newName == "" {
+				return fmt.Errorf("cannot rename %s: invalid name %q", name, newName)
+			}
+			if err := d.checkName(newName); err != nil {
+				return err
+			}
+			renames[name] = newName
+		}
+
+		key := newName
+		if d.caseInsensitive() {
+			key = foldCase(newName)
+		}
+		if other, ok := final[key]; ok {
+			return fmt.Errorf("cannot rename: %s and %s both map to %s", other, name, newName)
+		}
+		final[key] = name
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	// The names were mapped without the lock, the collisions were checked
+	// against the entries listed then.
+	current := make(map[string]bool, len(names))
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		current[l.Name] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(current) != len(names) {
+		return fmt.Errorf("cannot rename: the entries of %s changed", d.Path())
+	}
+	for _, name := range names {
+		if !current[name] {
+			return fmt.Errorf("cannot rename: the entries of %s changed", d.Path())
+		}
+	}
+
+	// The links are modified directly (see `trackLink`).
+	d.linkSizes = nil
+
+	// All the renamed entries are removed before adding them back with
+	// their new names, so chains (or cycles) of renames don't clash.
+	children := make(map[string]FSNode, len(renames))
+	nodes := make(map[string]ipld.Node, len(renames))
+	linked := make(map[string]ipld.Node, len(renames))
+	for name := range renames {
+		c, err := d.childUnsync(ctx, name)
+		if err != nil {
+			return err
+		}
+		nd, err := c.GetNode()
+		if err != nil {
+			return err
+		}
+		children[name] = c
+		nodes[name] = nd
+		linked[name], err = d.encodeNode(ctx, nd)
+		if err != nil {
+			return err
+		}
+	}
+
+	restore := func() {
+		for name, nd := range linked {
+			if rerr := d.unixfsDir.AddChild(ctx, name, nd); rerr != nil {
+				log.Errorf("cannot restore %s after a failed rename: %s", path.Join(d.Path(), name), rerr)
+			}
+		}
+	}
+	for name := range renames {
+		if err := d.unixfsDir.RemoveChild(ctx, name); err != nil {
+			restore()
+			return err
+		}
+	}
+	for name, newName := range renames {
+		if err := d.unixfsDir.AddChild(ctx, newName, linked[name]); err != nil {
+			for _, newName := range renames {
+				d.unixfsDir.RemoveChild(ctx, newName)
+			}
+			restore()
+			return err
+		}
+	}
+
+	d.modTime = time.Now()
+	for name := range renames {
+		delete(d.entriesCache, name)
+		delete(d.entryModTimes, name)
+		d.logMutation(Mutation{Op: MutationUnlink, Path: path.Join(d.Path(), name)})
+	}
+	for name, newName := range renames {
+		setEntryName(children[name], newName)
+		d.entriesCache[newName] = children[name]
+		d.entryModTimes[newName] = d.modTime
+		d.logMutation(Mutation{
+			Op:   MutationAdd,
+			Path: path.Join(d.Path(), newName),
+			Cid:  nodes[name].Cid(),
+		})
+	}
+	d.markDirty()
+	return nil
+}
+
+// UnlinkDir removes the entry 'name' as `Unlink` but, unless 'recursive'
+// is set, refuses to remove a directory that isn't empty returning
+// `ErrDirNotEmpty` (mirroring `rmdir` vs `rm -r`). Files are always removed.
+func (d *Directory) UnlinkDir(name string, recursive bool) error {
+	return d.UnlinkDirContext(d.ctx, name, recursive)
+}
+
+// UnlinkDirContext removes the entry 'name' as `UnlinkDir` using 'ctx' for
+// the operations it entails.
+func (d *Directory) UnlinkDirContext(ctx context.Context, name string, recursive bool) error {
+	defer d.checkDirtyBudget()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !recursive {
+		c, err := d.childUnsync(ctx, name)
+		if err != nil {
+			return err
+		}
+
+		// Checked and unlinked with the lock of the directory taken,
+		// so no entry can be added to it in between.
+		if dir, ok := c.(*Directory); ok {
+			dir.lock.Lock()
+			defer dir.lock.Unlock()
+			empty, err := dir.isEmptyUnsync(ctx)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return ErrDirNotEmpty
+			}
+		}
+	}
+
+	return d.unlinkUnsync(ctx, name)
+}
+
+// IsEmpty reports whether the directory has no entries, stopping at the
+// first link found (without loading any entry).
+func (d *Directory) IsEmpty(ctx context.Context) (bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.isEmptyUnsync(ctx)
+}
+
+// isEmptyUnsync implements `IsEmpty`, it must be called with the lock taken.
+func (d *Directory) isEmptyUnsync(ctx context.Context) (bool, error) {
+	empty := true
+	err := d.unixfsDir.ForEachLink(ctx, func(*ipld.Link) error {
+		empty = false
+		return errStopListing
+	})
+	if err != nil && err != errStopListing {
+		return false, err
+	}
+	return empty, nil
+}
+
+// PruneEmptyDirs removes the directories under this one without entries,
+// bottom-up (so a directory left empty by pruning its only entries is
+// removed as well), returning how many were removed. This directory isn't
+// removed even if it ends up empty. See `FindEmptyDirs` to only list them.
+func (d *Directory) PruneEmptyDirs(ctx context.Context) (int, error) {
+	entries, err := d.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if e.Type != int(TDir) {
+			continue
+		}
+		c, err := d.ChildContext(ctx, e.Name)
+		if err != nil {
+			return removed, err
+		}
+		dir, ok := c.(*Directory)
+		if !ok {
+			continue
+		}
+
+		n, err := dir.PruneEmptyDirs(ctx)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+		pruned, err := d.unlinkIfEmpty(ctx, e.Name, dir)
+		if err != nil {
+			return removed, err
+		}
+		if pruned {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// unlinkIfEmpty unlinks the entry 'name' if it's still the directory 'dir'
+// and it's empty, checking and unlinking it with the locks of both taken.
+func (d *Directory) unlinkIfEmpty(ctx context.Context, name string, dir *Directory) (bool, error) {
+	defer d.checkDirtyBudget()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, err := d.childUnsync(ctx, name)
+	if err == os.ErrNotExist {
+		return false, nil
+	}
+	if err != nil || c != FSNode(dir) {
+		return false, err
+	}
+
+	dir.lock.Lock()
+	defer dir.lock.Unlock()
+	empty, err := dir.isEmptyUnsync(ctx)
+	if err != nil || !empty {
+		return false, err
+	}
+	if err := d.unlinkUnsync(ctx, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Flush stores the directory node in the DAG service and updates its
+// entry in the parent (propagating the update up to the root). If the
+// parent can't be updated the returned error wraps `ErrNotPropagated`,
+// the directory is left dirty and the flush can be safely retried.
+// Flushing a directory (or one below it) that was unlinked from its
+// parent returns `ErrDetached`.
+func (d *Directory) Flush() error {
+	if d.root != nil {
+		d.root.flushLock.Lock()
+		defer d.root.flushLock.Unlock()
+	}
+	return d.flush()
+}
+
+// flush implements `Flush`, it must be called with the `flushLock` of the
+// root taken.
+func (d *Directory) flush() error {
+	// Checked again by the parent when updating the entry.
+	if d.isDetached() {
+		return ErrDetached
+	}
+
+	nd, err := d.GetNode()
+	if err != nil {
+		return err
+	}
+
+	err = d.propagate(nd)
+	if err == ErrDetached {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrNotPropagated, err)
+	}
+
+	d.setFlushed(nd)
+	return nil
+}
+
+// FlushSelf stores the node of the directory (with its cached entries
+// synced) in the DAG service, as `Flush`, but without propagating it to
+// its parent, returning its CID. The directory stays dirty until a later
+// `Flush` (or the flush of an ancestor) updates its entry in the parent.
+func (d *Directory) FlushSelf() (cid.Cid, error) {
+	nd, err := d.GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// reload discards the in-memory state of the directory (including its
+// cached entries, which are detached) loading it again from its last
+// flushed node.
+func (d *Directory) reload(ctx context.Context) error {
+	nd, err := d.persistedNode(ctx)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	db, err := uio.NewDirectoryFromNode(d.unixfsDagServ(), nd)
+	if err != nil {
+		return err
+	}
+
+	d.unixfsDir = db
+	d.shardWidth = hamtFanout(nd)
+	for _, entry := range d.entriesCache {
+		detachEntry(entry)
+	}
+	d.entriesCache = make(map[string]FSNode)
+	d.entryModTimes = make(map[string]time.Time)
+	d.linkSizes = nil
+	d.markClean()
+	return nil
+}
+
+// hasChanges reports whether the directory may have changes not yet
+// flushed, i.e., if it or any of its cached directories is dirty or it
+// has cached files modified but not yet synced into it.
+func (d *Directory) hasChanges() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.dirty {
+		return true
+	}
+	for _, entry := range d.entriesCache {
+		switch entry := entry.(type) {
+		case *Directory:
+			if entry.hasChanges() {
+				return true
+			}
+		case *File:
+			if entry.isUnsynced() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// replaceNode replaces the contents of the directory with the ones of
+// the directory node 'nd', discarding (and detaching) its cached entries.
+func (d *Directory) replaceNode(nd ipld.Node) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	db, err := uio.NewDirectoryFromNode(d.unixfsDagServ(), nd)
+	if err != nil {
+		return err
+	}
+
+	d.unixfsDir = db
+	d.shardWidth = hamtFanout(nd)
+	for _, entry := range d.entriesCache {
+		detachEntry(entry)
+	}
+	d.entriesCache = make(map[string]FSNode)
+	d.entryModTimes = make(map[string]time.Time)
+	d.linkSizes = nil
+	d.modTime = time.Now()
+	d.markDirty()
+	return nil
+}
+
+// DirTx is a scoped edit of a `Directory`, all the changes made to the
+// directory (and its descendants) are either flushed together through
+// `Commit` or discarded through `Rollback`.
+type DirTx struct {
+	dir *Directory
+	ctx context.Context
+
+	// Serializes `Commit` and `Rollback`, protecting `done`.
+	lock sync.Mutex
+	done bool
+}
+
+// Begin starts a scoped edit of this directory, any pending change is
+// flushed first so `Rollback` only discards the changes made after it.
+func (d *Directory) Begin(ctx context.Context) (*DirTx, error) {
+	if err := d.Flush(); err != nil {
+		return nil, err
+	}
+	return &DirTx{dir: d, ctx: ctx}, nil
+}
+
+// begin implements `Begin`, it must be called with the `flushLock` of
+// the root taken.
+func (d *Directory) begin(ctx context.Context) (*DirTx, error) {
+	if err := d.flush(); err != nil {
+		return nil, err
+	}
+	return &DirTx{dir: d, ctx: ctx}, nil
+}
+
+// Commit flushes all the changes made to the directory since `Begin`.
+func (tx *DirTx) Commit() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := tx.dir.Flush(); err != nil {
+		return err
+	}
+	tx.done = true
+	return nil
+}
+
+// Rollback discards the in-memory state of the directory, reloading it from
+// its last flushed CID. Changes already propagated upwards (e.g., by closing
+// a file descriptor opened with `Sync`) are not undone.
+// CAUTION: References to children of the directory obtained before calling
+// `Rollback` will be stale (see `Root.FlushMemFree`).
+func (tx *DirTx) Rollback() error {
+	tx.lock.Lock()
+	defer tx.lock.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	return tx.dir.reload(tx.ctx)
+}
+
+// DedupMode selects what `AddChildWithOpts` does when the added node is
+// already linked under the directory with another name.
+type DedupMode int
+
+const (
+	// DedupAllow adds the node without checking for duplicates.
+	DedupAllow DedupMode = iota
+	// DedupWarn adds the node calling `AddChildOpts.OnDuplicate` after.
+	DedupWarn
+	// DedupError refuses to add the node returning `ErrDuplicateContent`.
+	DedupError
+)
+
+// AddChildOpts is used by AddChildWithOpts
+type AddChildOpts struct {
+	Dedup DedupMode
+	// OnDuplicate is called (with `DedupWarn`) with the name of the
+	// new entry and the one of the existing entry with the same CID,
+	// once the node is added and without the lock of the directory
+	// taken (so it can call back into it).
+	OnDuplicate func(name, existing string)
+
+	// RejectAncestors refuses to add (returning `ErrCycleDetected`) the last
+	// flushed node of this directory or of any of its ancestors, which would
+	// nest a copy of the tree inside itself.
+	RejectAncestors bool
+
+	// ReplaceOtherType replaces an existing entry with the same name
+	// if it's of a different type than the node (a file with a directory
+	// or vice versa), instead of returning `ErrDirExists`. The cached
+	// subtree of a replaced directory is dropped.
+	ReplaceOtherType bool
+}
+
+// AddChild adds the node 'nd' under this directory giving it the name 'name'.
+// If 'nd' is a directory and the root has a `MaxDepth`, its subtree is walked
+// to check the depth of its descendants too.
+func (d *Directory) AddChild(name string, nd ipld.Node) error {
+	return d.AddChildWithOpts(name, nd, AddChildOpts{})
+}
+
+// AddChildWithOpts adds the node 'nd' as `AddChild` but first checking
+// if its CID is already linked under this directory, as selected by
+// `opts.Dedup`, and optionally replacing an entry of another type.
+// CAUTION: References to a replaced entry obtained before calling this
+// method will be stale (see `Root.FlushMemFree`).
+func (d *Directory) AddChildWithOpts(name string, nd ipld.Node, opts AddChildOpts) error {
+	return d.AddChildContext(d.ctx, name, nd, opts)
+}
+
+// AddChildContext adds the node 'nd' as `AddChildWithOpts` using 'ctx'
+// (instead of the context the directory was created with) for the
+// operations it entails.
+func (d *Directory) AddChildContext(ctx context.Context, name string, nd ipld.Node, opts AddChildOpts) error {
+	defer d.checkDirtyBudget()
+
+	if err := d.checkName(name); err != nil {
+		return err
+	}
+
+	// Checked before taking the lock, the ones of the ancestors
+	// can't be taken while holding it.
+	if opts.RejectAncestors && d.isAncestorNode(nd.Cid()) {
+		return ErrCycleDetected
+	}
+
+	d.lock.Lock()
+	existing, err := d.addChildUnsync(ctx, name, nd, opts)
+	d.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if existing != "" && opts.OnDuplicate != nil {
+		opts.OnDuplicate(name, existing)
+	}
+	return nil
+}
+
+// addChildUnsync implements `AddChildContext`, returning the name of the
+// entry with the same CID found with `DedupWarn` (if any). It must be called
+// with the lock taken.
+func (d *Directory) addChildUnsync(ctx context.Context, name string, nd ipld.Node, opts AddChildOpts) (string, error) {
+	ndType := TFile
+	if isDirNode(nd) {
+		ndType = TDir
+	}
+
+	replaced, err := d.childUnsync(ctx, name)
+	if err == nil {
+		if !opts.ReplaceOtherType || replaced.Type() == ndType {
+			return "", ErrDirExists
+		}
+	} else {
+		replaced = nil
+	}
+
+	err = checkChildNode(nd)
+	if err != nil {
+		return "", err
+	}
+
+	var existing string
+	if opts.Dedup != DedupAllow {
+		existing, err = d.findCidUnsync(ctx, nd.Cid())
+		if err != nil {
+			return "", err
+		}
+		if existing != "" && opts.Dedup == DedupError {
+			return "", fmt.Errorf("%w: %s", ErrDuplicateContent, existing)
+		}
+	}
+
+	err = d.checkChildNodeDepth(ctx, nd)
+	if err != nil {
+		return "", err
+	}
+
+	err = d.addEntryNode(ctx, nd)
+	if err != nil {
+		return "", err
+	}
+
+	if replaced != nil {
+		// The replaced entry may differ in case (see `Root.CaseInsensitive`).
+		if rname := entryName(replaced); rname != name {
+			err = d.unixfsDir.RemoveChild(ctx, rname)
+			if err != nil {
+				return "", err
+			}
+			d.untrackLink(rname)
+			delete(d.entriesCache, rname)
+			delete(d.entryModTimes, rname)
+		}
+		delete(d.entriesCache, name)
+		if dir, ok := replaced.(*Directory); ok {
+			dir.dropCache()
+		}
+		detachEntry(replaced)
+	}
+
+	// Adding over the replaced entry (if any) replaces its link.
+	err = d.addUnixFSChild(ctx, child{name, nd})
+	if err != nil {
+		return "", err
+	}
+
+	d.modTime = time.Now()
+	d.entryModTimes[name] = d.modTime
+	d.markDirty()
+	d.logMutation(Mutation{
+		Op:      MutationAdd,
+		Path:    path.Join(d.Path(), name),
+		Cid:     nd.Cid(),
+		Replace: replaced != nil,
+	})
+	return existing, nil
+}
+
+// replaceChild replaces the existing entry 'name', of any type, with the
+// node 'nd' in a single step under the lock of the directory, dropping the
+// cached subtree of the replaced entry (existing handles to it are
+// detached), and returns the CID the replaced entry was linked with (see
+// `ReplaceSubtree`).
+func (d *Directory) replaceChild(ctx context.Context, name string, nd ipld.Node) (cid.Cid, error) {
+	defer d.checkDirtyBudget()
+
+	err := checkChildNode(nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	replaced, err := d.childUnsync(ctx, name)
+	if err != nil {
+		return cid.Undef, err
+	}
+	// The linked node, the unsynced changes of the entry are dropped.
+	rnd, err := d.childFromDag(ctx, entryName(replaced))
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	err = d.checkChildNodeDepth(ctx, nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	err = d.addEntryNode(ctx, nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	// The replaced entry may differ in case (see `Root.CaseInsensitive`).
+	if rname := entryName(replaced); rname != name {
+		err = d.unixfsDir.RemoveChild(ctx, rname)
+		if err != nil {
+			return cid.Undef, err
+		}
+		d.untrackLink(rname)
+		delete(d.entriesCache, rname)
+		delete(d.entryModTimes, rname)
+	}
+	delete(d.entriesCache, name)
+	if dir, ok := replaced.(*Directory); ok {
+		dir.dropCache()
+	}
+	detachEntry(replaced)
+
+	// Adding over the replaced entry replaces its link.
+	err = d.addUnixFSChild(ctx, child{name, nd})
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	d.modTime = time.Now()
+	d.entryModTimes[name] = d.modTime
+	d.markDirty()
+	d.logMutation(Mutation{Op: MutationReplace, Path: path.Join(d.Path(), name), Cid: nd.Cid()})
+	return rnd.Cid(), nil
+}
+
+// AddFileFromReader imports the contents of 'r' as a new UnixFS file added
+// under this directory as 'name' (see `AddChildContext`), returning its
+// CID. The contents are split in blocks of the default size into a balanced
+// DAG built with the CID builder of the directory (with raw leaves if its
+// CID version isn't zero, as `NewFile`), its nodes are added to the DAG
+// service as they are created (only a bounded part of the contents is held
+// in memory), empty contents are added as configured by `Root.EmptyFiles`.
+// If 'name' already exists `ErrDirExists` is returned before reading
+// anything. The directory stays locked until the file is added, so no other
+// entry can take its name meanwhile.
+func (d *Directory) AddFileFromReader(ctx context.Context, name string, r io.Reader) (cid.Cid, error) {
+	defer d.checkDirtyBudget()
+
+	if err := d.checkName(name); err != nil {
+		return cid.Undef, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, err := d.childUnsync(ctx, name); err == nil {
+		return cid.Undef, ErrDirExists
+	} else if err != os.ErrNotExist {
+		return cid.Undef, err
+	}
+
+	b := d.GetCidBuilder()
+	bc, err := b.Sum(nil)
+	if err != nil {
+		return cid.Undef, err
+	}
+	spl := chunker.NewSizeSplitter(&ctxReader{ctx, r}, chunker.DefaultBlockSize)
+	nd, err := importFile(d.dagService, d.root, b, bc.Version() > 0, spl)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	_, err = d.addChildUnsync(ctx, name, nd, AddChildOpts{})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// UpdateFileContent replaces the content of the file 'name' with the one
+// read from 'r', keeping its entry: the `File` (and references to it) is
+// updated in place, with the layout it was written with (CID builder, raw
+// leaves and block size), so whatever it holds besides the content is
+// preserved, and its modification time is updated as a write through a
+// `FileDescriptor` would. It waits for the open descriptors of the file
+// to be closed. Returns the CID of the new content. See
+// `Root.SkipUnchangedWrites` to skip rewriting the same content.
+func (d *Directory) UpdateFileContent(ctx context.Context, name string, r io.Reader) (cid.Cid, error) {
+	c, err := d.ChildContext(ctx, name)
+	if err != nil {
+		return cid.Undef, err
+	}
+	fi, ok := c.(*File)
+	if !ok {
+		return cid.Undef, ErrIsDirectory
+	}
+
+	fi.desclock.Lock()
+	defer fi.desclock.Unlock()
+
+	fi.nodeLock.RLock()
+	oldNode := fi.node
+	fi.nodeLock.RUnlock()
+	old := oldNode.Cid()
+
+	dserv := d.dagService
+	if d.skipUnchangedWrites() {
+		dserv = newUnchangedDagServ(ctx, d.dagService, oldNode)
+	}
+
+	spl := chunker.NewSizeSplitter(&ctxReader{ctx, r}, int64(fi.BlockSizeContext(ctx)))
+	nd, err := importFile(dserv, d.root, old.Prefix().WithCodec(cid.DagProtobuf), fi.RawLeaves, spl)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if d.skipUnchangedWrites() && nd.Cid().Equals(old) {
+		return old, nil
+	}
+
+	fi.nodeLock.Lock()
+	fi.setNode(nd)
+	fi.modTime = time.Now()
+	name = fi.name
+	fi.nodeLock.Unlock()
+
+	err = d.updateChildEntry(child{name, nd})
+	if err != nil {
+		return cid.Undef, err
+	}
+	d.logWrite(name, fi, nd)
+	return nd.Cid(), nil
+}
+
+// skipUnchangedWrites reports whether the `Root.SkipUnchangedWrites` of
+// the root of this directory (if any) is set.
+func (d *Directory) skipUnchangedWrites() bool {
+	return d.root != nil && d.root.SkipUnchangedWrites
+}
+
+// importFile imports the content split by 'spl' as a balanced UnixFS DAG
+// built with 'b' (and raw leaves if 'rawLeaves' is set), adding its nodes
+// to 'dserv', empty content is stored as configured by `Root.EmptyFiles`
+// of 'rt' (which may be nil).
+func importFile(dserv ipld.DAGService, rt *Root, b cid.Builder, rawLeaves bool, spl chunker.Splitter) (ipld.Node, error) {
+	var held *heldDagServ
+	if rt.transformsNodes() {
+		// Only the encoded form of the root of the file is stored.
+		held = &heldDagServ{DAGService: dserv}
+		dserv = held
+	}
+
+	params := helpers.DagBuilderParams{
+		Dagserv:    dserv,
+		Maxlinks:   helpers.DefaultLinksPerBlock,
+		CidBuilder: b,
+		RawLeaves:  rawLeaves,
+	}
+	db, err := params.New(spl)
+	if err != nil {
+		return nil, err
+	}
+	nd, err := balanced.Layout(db)
+	if err != nil {
+		return nil, err
+	}
+	if isEmptyFile(nd) {
+		nd, err = emptyFileNode(emptyFileFormat(rt), b)
+		if err != nil {
+			return nil, err
+		}
+		err = dserv.Add(context.TODO(), nd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if held != nil {
+		err = held.release(context.TODO(), nd.Cid())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nd, nil
+}
+
+// AddChildUnchecked adds the node 'nd' as `AddChild` but without checking
+// if an entry named 'name' already exists, which may entail a DAG lookup per
+// call, for bulk loads where the caller guarantees the names are unique. An
+// existing entry would be silently replaced (and references to it obtained
+// before would be stale).
+func (d *Directory) AddChildUnchecked(name string, nd ipld.Node) error {
+	defer d.checkDirtyBudget()
+
+	if name == "" {
+		return fmt.Errorf("cannot add child with empty name")
+	}
+	if err := d.checkName(name); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := checkChildNode(nd)
+	if err != nil {
+		return err
+	}
+	err = d.checkChildNodeDepth(d.ctx, nd)
+	if err != nil {
+		return err
+	}
+
+	err = d.addEntryNode(d.ctx, nd)
+	if err != nil {
+		return err
+	}
+
+	detachEntry(d.entriesCache[name])
+	delete(d.entriesCache, name)
+	err = d.addUnixFSChild(d.ctx, child{name, nd})
+	if err != nil {
+		return err
+	}
+
+	d.modTime = time.Now()
+	d.entryModTimes[name] = d.modTime
+	d.markDirty()
+	d.logMutation(Mutation{Op: MutationAdd, Path: path.Join(d.Path(), name), Cid: nd.Cid()})
+	return nil
+}
+
+// isAncestorNode reports whether 'c' is the last flushed node of this
+// directory or of one of its ancestors.
+func (d *Directory) isAncestorNode(c cid.Cid) bool {
+	for cur, ok := d, true; ok; cur, ok = cur.parent.(*Directory) {
+		cur.lock.Lock()
+		flushed := cur.flushedCid
+		cur.lock.Unlock()
+		if flushed.Equals(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// isWithin reports whether this directory is 'a' or one of its descendants.
+func (d *Directory) isWithin(a *Directory) bool {
+	for cur := d; cur != nil; {
+		if cur == a {
+			return true
+		}
+		cur, _ = cur.parent.(*Directory)
+	}
+	return false
+}
+
+// findCidUnsync returns the name of an entry of the directory linking
+// to 'c' (syncing the cached entries first), or the empty string if
+// there is none. It must be called with the lock taken.
+func (d *Directory) findCidUnsync(ctx context.Context, c cid.Cid) (string, error) {
+	err := d.sync(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var found string
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if l.Cid.Equals(c) {
+			found = l.Name
+			return errStopListing
+		}
+		return nil
+	})
+	if err != nil && err != errStopListing {
+		return "", err
+	}
+	return found, nil
+}
+
+// AddChildCid fetches the node 'c' from the DAG service and adds it under
+// this directory giving it the name 'name' (see `AddChild`).
+func (d *Directory) AddChildCid(ctx context.Context, name string, c cid.Cid) error {
+	nd, err := d.dagService.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	return d.AddChildContext(ctx, name, nd, AddChildOpts{})
+}
+
+// addUnixFSChild adds a child to the inner UnixFS directory
+// and transitions to a HAMT implementation if needed.
+func (d *Directory) addUnixFSChild(ctx context.Context, c child) error {
+	// If the directory HAMT implementation is being used and this
+	// directory is actually a basic implementation switch it to HAMT.
+	if basicDir, ok := d.unixfsDir.(*uio.BasicDirectory); ok && d.useSharding() {
+		if err := d.shard(ctx, basicDir); err != nil {
 			return err
 		}
+	}
 
-		nd, err := c.GetNode()
-		if err != nil {
-			return err
-		}
+	nd, err := d.encodeNode(ctx, c.Node)
+	if err != nil {
+		return err
+	}
 
-		child := NodeListing{
-			Name: l.Name,
-			Type: int(c.Type()),
-			Hash: nd.Cid().String(),
-		}
+	err = d.unixfsDir.AddChild(ctx, c.Name, nd)
+	if err != nil {
+		return err
+	}
 
-		if c, ok := c.(*File); ok {
-			size, err := c.Size()
-			if err != nil {
-				return err
-			}
-			child.Size = size
+	if basicDir, ok := d.unixfsDir.(*uio.BasicDirectory); ok && d.overShardingThreshold(basicDir) {
+		if err := d.shard(ctx, basicDir); err != nil {
+			return err
 		}
+	}
 
-		return f(child)
-	})
+	return d.trackLink(c.Name, nd)
 }
 
-func (d *Directory) Mkdir(name string) (*Directory, error) {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+// shard switches the UnixFS directory of this one, the basic directory
+// 'basicDir', to a HAMT, accounting for the nodes it adds (see
+// `FlushResult.ShardingNodes`). It must be called with the lock taken.
+func (d *Directory) shard(ctx context.Context, basicDir *uio.BasicDirectory) error {
+	counter := &addCounter{parent: addCounterFrom(ctx)}
+	if counter.parent == nil {
+		counter.parent = d.flushAdds
+	}
+	flushAdds := d.flushAdds
+	d.flushAdds = counter
+	hamtDir, err := d.switchToSharding(withAddCounter(ctx, counter), basicDir, d.unixfsDagServ())
+	d.flushAdds = flushAdds
+	if err != nil {
+		return err
+	}
+	d.unixfsDir = hamtDir
+	d.shardWidth = d.configuredShardWidth()
+	if d.root != nil {
+		d.root.countShardSwitch(counter)
+	}
 
-	fsn, err := d.childUnsync(name)
-	if err == nil {
-		switch fsn := fsn.(type) {
-		case *Directory:
-			return fsn, os.ErrExist
-		case *File:
-			return nil, os.ErrExist
-		default:
-			return nil, fmt.Errorf("unrecognized type: %#v", fsn)
+	if d.root != nil && d.root.EventLogger != nil {
+		links, err := basicDir.Links(ctx)
+		if err != nil {
+			return err
 		}
+		d.root.EventLogger.ShardingSwitched(d.Path(), len(links))
 	}
+	return nil
+}
 
-	ndir := ft.EmptyDirNode()
-	ndir.SetCidBuilder(d.GetCidBuilder())
-
-	err = d.dagService.Add(d.ctx, ndir)
-	if err != nil {
-		return nil, err
+// encodeNode returns the node linked in place of the node 'nd' of an entry:
+// itself, or its encoded form with a `Root.NodeTransformer`, which is added
+// to the DAG service.
+func (d *Directory) encodeNode(ctx context.Context, nd ipld.Node) (ipld.Node, error) {
+	if !d.root.transformsNodes() {
+		return nd, nil
 	}
-
-	err = d.addUnixFSChild(child{name, ndir})
+	enc, err := d.root.NodeTransformer.Encode(ctx, nd)
 	if err != nil {
 		return nil, err
 	}
-
-	dirobj, err := NewDirectory(d.ctx, name, ndir, d, d.dagService)
+	err = d.dagService.Add(ctx, enc)
 	if err != nil {
 		return nil, err
 	}
+	return enc, nil
+}
 
-	d.entriesCache[name] = dirobj
-	return dirobj, nil
+// addEntryNode adds the node 'nd' of an entry to the DAG service, unless
+// the root has a `NodeTransformer`: only its encoded form is stored then,
+// when it's linked (see `encodeNode`).
+func (d *Directory) addEntryNode(ctx context.Context, nd ipld.Node) error {
+	if d.root.transformsNodes() {
+		return nil
+	}
+	return d.dagService.Add(ctx, nd)
 }
 
-func (d *Directory) Unlink(name string) error {
+// CachedCumulativeSize returns the cumulative size of the directory (the
+// size of its node plus the cumulative sizes of its entries) and whether it
+// was already known. It's kept up to date as the links of the directory
+// are added, replaced (e.g., flushing an entry) or removed, so changes in
+// the cached entries count once they're propagated to this directory.
+// When it isn't known (or the directory is sharded, its shards aren't
+// tracked) it's computed from the node of the directory, syncing its
+// cached entries as `GetNode`. Zero is returned if that fails.
+func (d *Directory) CachedCumulativeSize() (int64, bool) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	delete(d.entriesCache, name)
+	if d.linkSizes != nil {
+		return int64(d.cumSize), true
+	}
+
+	err := d.sync(d.ctx)
+	if err != nil {
+		log.Errorf("cannot compute the cumulative size of %s: %s", d.Path(), err)
+		return 0, false
+	}
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		log.Errorf("cannot compute the cumulative size of %s: %s", d.Path(), err)
+		return 0, false
+	}
+	size, err := nd.Size()
+	if err != nil {
+		log.Errorf("cannot compute the cumulative size of %s: %s", d.Path(), err)
+		return 0, false
+	}
 
-	return d.unixfsDir.RemoveChild(d.ctx, name)
+	if _, ok := d.unixfsDir.(*uio.BasicDirectory); ok {
+		d.cumSize = size
+		d.linkSizes = make(map[string]uint64)
+		for _, l := range nd.Links() {
+			d.linkSizes[l.Name] = l.Size + pbLinkSize(l.Name, l.Cid, l.Size)
+		}
+	}
+	return int64(size), false
 }
 
-func (d *Directory) Flush() error {
-	nd, err := d.GetNode()
+// trackLink accounts the link to 'nd' just added as 'name' (replacing
+// any previous one) in the cumulative size of the directory, if known.
+// Only basic directories are tracked, adding a link to one grows its
+// node by exactly the encoding of the link.
+func (d *Directory) trackLink(name string, nd ipld.Node) error {
+	if d.linkSizes == nil {
+		return nil
+	}
+	if _, ok := d.unixfsDir.(*uio.BasicDirectory); !ok {
+		d.linkSizes = nil
+		return nil
+	}
+
+	size, err := nd.Size()
 	if err != nil {
 		return err
 	}
+	d.untrackLink(name)
+	d.linkSizes[name] = size + pbLinkSize(name, nd.Cid(), size)
+	d.cumSize += d.linkSizes[name]
+	return nil
+}
+
+// untrackLink removes the link 'name' just removed from the cumulative
+// size of the directory, if known.
+func (d *Directory) untrackLink(name string) {
+	if d.linkSizes == nil {
+		return
+	}
+	d.cumSize -= d.linkSizes[name]
+	delete(d.linkSizes, name)
+}
 
-	return d.parent.updateChildEntry(child{d.name, nd})
+// pbLinkSize returns the size of the dag-pb encoding of a link (within
+// its node) to 'c' named 'name' with cumulative size 'size'.
+func pbLinkSize(name string, c cid.Cid, size uint64) uint64 {
+	uvarintLen := func(x uint64) uint64 {
+		return uint64(len(binary.AppendUvarint(nil, x)))
+	}
+	// Each field is prefixed by a one byte tag.
+	hash := uint64(len(c.Bytes()))
+	link := 1 + uvarintLen(hash) + hash +
+		1 + uvarintLen(uint64(len(name))) + uint64(len(name)) +
+		1 + uvarintLen(size)
+	return 1 + uvarintLen(link) + link
 }
 
-// AddChild adds the node 'nd' under this directory giving it the name 'name'
-func (d *Directory) AddChild(name string, nd ipld.Node) error {
+// CompactHAMT rebuilds the HAMT of a sharded directory from its current
+// entries, leaving it in the canonical form it would have had if they had
+// just been inserted (without the sparse shards left behind by removals).
+// The entries themselves are preserved. Returns `ErrNotSharded` for basic
+// directories.
+func (d *Directory) CompactHAMT(ctx context.Context) error {
+	defer d.checkDirtyBudget()
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	_, err := d.childUnsync(name)
-	if err == nil {
-		return ErrDirExists
+	if _, ok := d.unixfsDir.(*uio.HAMTDirectory); !ok {
+		return ErrNotSharded
 	}
 
-	err = d.dagService.Add(d.ctx, nd)
+	err := d.sync(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = d.addUnixFSChild(child{name, nd})
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return err
+	}
+	fsn, err := ft.ExtractFSNode(nd)
 	if err != nil {
 		return err
 	}
 
-	d.modTime = time.Now()
+	// Don't use `Links`, the HAMT implementation enumerates them from
+	// the last persisted shard node, not the in-memory one.
+	var links []*ipld.Link
+	err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links = append(links, l)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	hamtDir, err := newHAMTDirectory(ctx, d.unixfsDagServ(), links, int(fsn.Fanout()), d.unixfsDir.GetCidBuilder())
+	if err != nil {
+		return err
+	}
+
+	d.unixfsDir = hamtDir
+	d.shardWidth = int(fsn.Fanout())
+	d.linkSizes = nil
+	d.markDirty()
 	return nil
 }
 
-// addUnixFSChild adds a child to the inner UnixFS directory
-// and transitions to a HAMT implementation if needed.
-func (d *Directory) addUnixFSChild(c child) error {
-	if uio.UseHAMTSharding {
-		// If the directory HAMT implementation is being used and this
-		// directory is actually a basic implementation switch it to HAMT.
-		if basicDir, ok := d.unixfsDir.(*uio.BasicDirectory); ok {
-			hamtDir, err := basicDir.SwitchToSharding(d.ctx)
-			if err != nil {
-				return err
-			}
-			d.unixfsDir = hamtDir
+// newHAMTDirectory builds a UnixFS HAMT directory of the given fanout
+// containing the entries pointed to by `links`.
+func newHAMTDirectory(ctx context.Context, dserv ipld.DAGService, links []*ipld.Link, fanout int, builder cid.Builder) (uio.Directory, error) {
+	shard, err := hamt.NewShard(dserv, fanout)
+	if err != nil {
+		return nil, err
+	}
+	shard.SetCidBuilder(builder)
+
+	for _, lnk := range links {
+		nd, err := lnk.GetNode(ctx, dserv)
+		if err != nil {
+			return nil, err
+		}
+
+		err = shard.Set(ctx, lnk.Name, nd)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	err := d.unixfsDir.AddChild(d.ctx, c.Name, c.Node)
+	nd, err := shard.Node()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return uio.NewDirectoryFromNode(dserv, nd)
+}
+
+// useSharding reports whether basic directories are switched to sharding
+// when adding entries, as set globally by `uio.UseHAMTSharding` or for the
+// root by `Root.AlwaysShard`.
+func (d *Directory) useSharding() bool {
+	return uio.UseHAMTSharding || (d.root != nil && d.root.AlwaysShard)
+}
+
+// checkName returns `ErrInvalidName` for a 'name' that has a "/" (no path
+// could reach the entry) or, if the root requires valid names (see
+// `Root.RequireValidUTF8Names`), that isn't valid UTF-8 or has control
+// characters.
+func (d *Directory) checkName(name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	if d.root == nil || !d.root.RequireValidUTF8Names {
+		return nil
+	}
+	if !utf8.ValidString(name) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
 	return nil
 }
 
-func (d *Directory) sync() error {
+// overShardingThreshold reports whether 'basicDir' (the UnixFS directory of
+// this one, or a copy) has more entries than the `Root.ShardingThreshold`,
+// i.e., the last one added was a new entry reaching it, so the directory is
+// switched to sharding. The entries are counted by its node as they're
+// added or removed, the links aren't scanned.
+func (d *Directory) overShardingThreshold(basicDir *uio.BasicDirectory) bool {
+	if d.root == nil || d.root.ShardingThreshold <= 0 {
+		return false
+	}
+	nd, err := basicDir.GetNode()
+	return err == nil && len(nd.Links()) > d.root.ShardingThreshold
+}
+
+// emptyDirNode returns the node of a new empty subdirectory, with the CID
+// builder 'b': an empty HAMT (of the configured width) if
+// the root has `AlwaysShard` set, a basic directory otherwise.
+func (d *Directory) emptyDirNode(ctx context.Context, b cid.Builder) (ipld.Node, error) {
+	if d.root == nil || !d.root.AlwaysShard {
+		nd := ft.EmptyDirNode()
+		nd.SetCidBuilder(b)
+		return nd, nil
+	}
+
+	width := d.root.ShardWidth
+	if width == 0 {
+		width = uio.DefaultShardWidth
+	}
+	hamtDir, err := newHAMTDirectory(ctx, d.dagService, nil, width, b)
+	if err != nil {
+		return nil, err
+	}
+	return hamtDir.GetNode()
+}
+
+// configuredShardWidth returns the fanout of the HAMT directories created by
+// `switchToSharding`.
+func (d *Directory) configuredShardWidth() int {
+	if d.root == nil || d.root.ShardWidth == 0 {
+		return uio.DefaultShardWidth
+	}
+	return d.root.ShardWidth
+}
+
+// hamtFanout returns the fanout of 'nd' if it's a UnixFS HAMT shard node,
+// zero otherwise.
+func hamtFanout(nd ipld.Node) int {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return 0
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil || fsn.Type() != ft.THAMTShard {
+		return 0
+	}
+	return int(fsn.Fanout())
+}
+
+// switchToSharding returns a HAMT implementation of `basicDir` with the
+// shard width configured in the root.
+// It must use the same DAG service `dserv` as `basicDir`.
+func (d *Directory) switchToSharding(ctx context.Context, basicDir *uio.BasicDirectory, dserv ipld.DAGService) (uio.Directory, error) {
+	if d.root == nil || d.root.ShardWidth == 0 {
+		return basicDir.SwitchToSharding(ctx)
+	}
+
+	links, err := basicDir.Links(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newHAMTDirectory(ctx, dserv, links, d.root.ShardWidth, basicDir.GetCidBuilder())
+}
+
+// computeNode materializes the node of the directory with the cached entries
+// synced into it (as `GetNode` does) but on a copy of the UnixFS directory
+// over 'dserv', leaving this directory (and the DAG service) untouched. The
+// copy of a sharded directory is rebuilt from its links, serializing its
+// shards would store them in the DAG service.
+func (d *Directory) computeNode(ctx context.Context, dserv ipld.DAGService) (ipld.Node, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var dircopy uio.Directory
+	var err error
+	if _, ok := d.unixfsDir.(*uio.HAMTDirectory); ok {
+		var links []*ipld.Link
+		err = d.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+			links = append(links, l)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		dircopy, err = newHAMTDirectory(ctx, dserv, links, d.shardWidth, d.unixfsDir.GetCidBuilder())
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var nd ipld.Node
+		nd, err = d.unixfsDir.GetNode()
+		if err != nil {
+			return nil, err
+		}
+		dircopy, err = uio.NewDirectoryFromNode(dserv, nd)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, entry := range d.entriesCache {
+		var cnd ipld.Node
+		if dir, ok := entry.(*Directory); ok {
+			cnd, err = dir.computeNode(ctx, dserv)
+		} else {
+			cnd, err = entry.GetNode()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot materialize %s: %s", path.Join(d.Path(), name), err)
+		}
+
+		err = dserv.Add(ctx, cnd)
+		if err != nil {
+			return nil, err
+		}
+
+		if basicDir, ok := dircopy.(*uio.BasicDirectory); ok && d.useSharding() {
+			dircopy, err = d.switchToSharding(ctx, basicDir, dserv)
+			if err != nil {
+				return nil, fmt.Errorf("cannot shard %s: %s", d.Path(), err)
+			}
+		}
+
+		err = dircopy.AddChild(ctx, name, cnd)
+		if err != nil {
+			return nil, fmt.Errorf("cannot materialize %s: %s", path.Join(d.Path(), name), err)
+		}
+
+		if basicDir, ok := dircopy.(*uio.BasicDirectory); ok && d.overShardingThreshold(basicDir) {
+			dircopy, err = d.switchToSharding(ctx, basicDir, dserv)
+			if err != nil {
+				return nil, fmt.Errorf("cannot shard %s: %s", d.Path(), err)
+			}
+		}
+	}
+
+	return dircopy.GetNode()
+}
+
+func (d *Directory) sync(ctx context.Context) error {
 	for name, entry := range d.entriesCache {
-		nd, err := entry.GetNode()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var nd ipld.Node
+		var err error
+		fi, isFile := entry.(*File)
+		changed := isFile && fi.isUnsynced()
+		if dir, ok := entry.(*Directory); ok {
+			nd, err = dir.getNode(ctx)
+			if err == nil {
+				dir.lock.Lock()
+				changed = !dir.flushedCid.Equals(nd.Cid())
+				dir.lock.Unlock()
+			}
+		} else {
+			nd, err = entry.GetNode()
+		}
 		if err != nil {
 			return err
 		}
 
-		err = d.updateChild(child{name, nd})
+		// Not `updateChild`, syncing changes in the content of the
+		// entries doesn't modify the directory (the entries track
+		// their own modification time).
+		err = d.addUnixFSChild(ctx, child{name, nd})
 		if err != nil {
 			return err
 		}
+
+		// The entry is now part of this directory, so it has nothing
+		// left to propagate: the directory has it instead (as in
+		// `uncacheSynced`).
+		if changed {
+			d.markDirty()
+		}
+		switch entry := entry.(type) {
+		case *Directory:
+			entry.setFlushed(nd)
+		case *File:
+			entry.markSynced(nd)
+		}
 	}
 
 	// TODO: Should we clean the cache here?
@@ -427,11 +4027,78 @@ func (d *Directory) Path() string {
 	return out
 }
 
+// Ancestors returns the directories above this one, from its parent up to
+// the root directory (none for the root directory itself). Unlike `Path` it
+// checks the chain: if a directory of it is no longer linked from its
+// parent (see `Flush`) it returns `ErrDetached`, and an error if it doesn't
+// end in a `Root` (e.g., a directory constructed without one).
+func (d *Directory) Ancestors() ([]*Directory, error) {
+	var out []*Directory
+	for cur := d; ; {
+		switch parent := cur.parent.(type) {
+		case *Root:
+			return out, nil
+		case *Directory:
+			if cur.isDetached() {
+				return nil, ErrDetached
+			}
+			out = append(out, parent)
+			cur = parent
+		default:
+			return nil, fmt.Errorf("directory parent neither a directory nor a root: %T", cur.parent)
+		}
+	}
+}
+
+// GetPersistedNode returns the last node of this directory propagated to its
+// parent (see `Flush`), loading it from the DAG service. Unlike `GetNode` it
+// doesn't sync the cached entries, so unflushed changes aren't reflected.
+func (d *Directory) GetPersistedNode() (ipld.Node, error) {
+	return d.persistedNode(d.ctx)
+}
+
+// persistedNode implements `GetPersistedNode`. With a `Root.NodeTransformer`
+// only the encoded form of the node is stored, so it's loaded (and decoded)
+// from the link of the parent. It must be called without the lock taken.
+func (d *Directory) persistedNode(ctx context.Context) (ipld.Node, error) {
+	p, ok := d.parent.(*Directory)
+	if !ok || !d.root.transformsNodes() {
+		d.lock.Lock()
+		c := d.flushedCid
+		d.lock.Unlock()
+		return d.dagService.Get(ctx, c)
+	}
+
+	d.lock.Lock()
+	name := d.name
+	d.lock.Unlock()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if d.detached {
+		return nil, ErrDetached
+	}
+	nd, err := p.childFromDag(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return d.root.NodeTransformer.Decode(ctx, nd)
+}
+
 func (d *Directory) GetNode() (ipld.Node, error) {
+	return d.getNode(d.ctx)
+}
+
+// getNode implements `GetNode` with 'ctx', the nodes added are counted in
+// its `addCounter` (if any, see `Root.flush`).
+func (d *Directory) getNode(ctx context.Context) (ipld.Node, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	err := d.sync()
+	d.flushAdds = addCounterFrom(ctx)
+	defer func() { d.flushAdds = nil }()
+
+	err := d.sync(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -441,10 +4108,71 @@ func (d *Directory) GetNode() (ipld.Node, error) {
 		return nil, err
 	}
 
-	err = d.dagService.Add(d.ctx, nd)
+	err = d.addNode(ctx, nd)
 	if err != nil {
 		return nil, err
 	}
 
 	return nd.Copy(), err
 }
+
+// addNode adds the node 'nd' of this directory to the DAG service unless
+// it's the one added last and the DAG service reports it's still stored
+// locally (it may have been removed since, e.g., garbage collected, see
+// `LocalChecker`). With a `Root.NodeTransformer` only the node of the root
+// directory is added, the parent of any other one stores its encoded form
+// (see `encodeNode`). It must be called with the lock taken.
+func (d *Directory) addNode(ctx context.Context, nd ipld.Node) error {
+	if _, ok := d.parent.(*Directory); ok && d.root.transformsNodes() {
+		return nil
+	}
+	if nd.Cid().Equals(d.addedCid) {
+		stored, err := d.hasLocal(ctx, nd.Cid())
+		if err != nil {
+			return err
+		}
+		if stored {
+			addCounterFrom(ctx).skip()
+			return nil
+		}
+	}
+
+	err := d.dagService.Add(ctx, nd)
+	if err != nil {
+		return err
+	}
+	d.addedCid = nd.Cid()
+	return nil
+}
+
+// unixfsDagServ returns the DAG service of the UnixFS directory of 'd'.
+func (d *Directory) unixfsDagServ() ipld.DAGService {
+	return &dirDagServ{DAGService: d.dagService, dir: d}
+}
+
+// dirDagServ is the DAG service of the UnixFS directory of a `Directory`,
+// counting the nodes the HAMT shards add without a context (see
+// `hamt.Shard.Node`) in the `addCounter` of the flush syncing it, if any.
+// The shards are only modified and serialized with the lock of the
+// directory taken.
+type dirDagServ struct {
+	ipld.DAGService
+	dir *Directory
+}
+
+func (ds *dirDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	return ds.DAGService.Add(ds.context(ctx), nd)
+}
+
+func (ds *dirDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	return ds.DAGService.AddMany(ds.context(ctx), nds)
+}
+
+// context returns 'ctx' with the `addCounter` of the flush syncing the
+// directory if it has none.
+func (ds *dirDagServ) context(ctx context.Context) context.Context {
+	if ds.dir.flushAdds == nil || addCounterFrom(ctx) != nil {
+		return ctx
+	}
+	return withAddCounter(ctx, ds.dir.flushAdds)
+}
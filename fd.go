@@ -3,11 +3,15 @@ package mfs
 import (
 	"fmt"
 	"io"
+	"time"
 
+	dag "github.com/ipfs/go-merkledag"
+	ft "github.com/ipfs/go-unixfs"
 	mod "github.com/ipfs/go-unixfs/mod"
 
 	context "context"
 
+	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
@@ -47,6 +51,19 @@ type fileDescriptor struct {
 	flags Flags
 
 	state state
+
+	// Size of the chunks written through this descriptor, fixed when
+	// it's opened (see `File.BlockSize`).
+	blockSize int
+
+	// DAG service the DAG modifier writes through with a
+	// `Root.NodeTransformer`, holding back the root of the file (nil
+	// otherwise).
+	held *heldDagServ
+
+	// Releases the reader slot taken by read-only descriptors (see
+	// `Root.MaxOpenReaders`).
+	release func()
 }
 
 func (fi *fileDescriptor) checkWrite() error {
@@ -121,6 +138,7 @@ func (fi *fileDescriptor) Close() error {
 	}
 	err := fi.flushUp(fi.flags.Sync)
 	fi.state = stateClosed
+	fi.release()
 	return err
 }
 
@@ -132,6 +150,15 @@ func (fi *fileDescriptor) Flush() error {
 	return fi.flushUp(true)
 }
 
+// dagService returns the DAG service the DAG modifiers of the descriptor
+// write through.
+func (fi *fileDescriptor) dagService() ipld.DAGService {
+	if fi.held != nil {
+		return fi.held
+	}
+	return fi.inode.dagService
+}
+
 // flushUp syncs the file and adds it to the dagservice
 // it *must* be called with the File's lock taken
 // If `fullSync` is set the changes are propagated upwards
@@ -145,7 +172,20 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 		if err != nil {
 			return err
 		}
-		err = fi.inode.dagService.Add(context.TODO(), nd)
+		if isEmptyFile(nd) {
+			// E.g., truncated to zero length, stored as a fresh empty
+			// file (see `Root.EmptyFiles`).
+			nd, err = fi.resetEmpty(nd)
+			if err != nil {
+				return err
+			}
+		}
+		if fi.held != nil {
+			// Only its encoded form is stored.
+			err = fi.held.release(context.TODO(), nd.Cid())
+		} else {
+			err = fi.inode.dagService.Add(context.TODO(), nd)
+		}
 		if err != nil {
 			return err
 		}
@@ -157,7 +197,12 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 		// (regenerating it and adding it to the DAG service).
 		fi.inode.nodeLock.Lock()
 		// Always update the file descriptor's inode with the created/modified node.
-		fi.inode.node = nd
+		fi.inode.setNode(nd)
+		fi.inode.unsynced = true
+		written := fi.state == stateDirty
+		if written {
+			fi.inode.modTime = time.Now()
+		}
 		// Save the members to be used for subsequent calls
 		parent := fi.inode.parent
 		name := fi.inode.name
@@ -168,6 +213,11 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 			if err := parent.updateChildEntry(child{name, nd}); err != nil {
 				return err
 			}
+			fi.inode.markSynced(nd)
+		}
+
+		if dir, ok := parent.(*Directory); ok && written {
+			dir.logWrite(name, fi.inode, nd)
 		}
 
 		fi.state = stateFlushed
@@ -179,6 +229,37 @@ func (fi *fileDescriptor) flushUp(fullSync bool) error {
 	}
 }
 
+// resetEmpty returns the node of an empty file in the configured format
+// (with the CID builder of 'nd', the current empty node), also restarting
+// the DAG modifier from it if it differs. A raw node isn't passed to the
+// modifier, which loses the data appended to it (see `OpenContext`).
+func (fi *fileDescriptor) resetEmpty(nd ipld.Node) (ipld.Node, error) {
+	empty, err := emptyFileNode(emptyFileFormat(fi.inode.root), nd.Cid().Prefix())
+	if err != nil {
+		return nil, err
+	}
+	if empty.Cid().Equals(nd.Cid()) {
+		return nd, nil
+	}
+	if fi.held != nil {
+		// The truncated root is replaced, it's not stored.
+		if err := fi.held.release(context.TODO(), nd.Cid()); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := empty.(*dag.RawNode); ok {
+		return empty, nil
+	}
+
+	dmod, err := mod.NewDagModifier(context.TODO(), empty, fi.dagService(), chunker.SizeSplitterGen(int64(fi.blockSize)))
+	if err != nil {
+		return nil, err
+	}
+	dmod.RawLeaves = fi.inode.RawLeaves
+	fi.mod = dmod
+	return empty, nil
+}
+
 // Seek implements io.Seeker
 func (fi *fileDescriptor) Seek(offset int64, whence int) (int64, error) {
 	if fi.state == stateClosed {
@@ -187,6 +268,49 @@ func (fi *fileDescriptor) Seek(offset int64, whence int) (int64, error) {
 	return fi.mod.Seek(offset, whence)
 }
 
+// prepareAppend makes the descriptor ready to extend the file up to 'end'
+// bytes: a file with its contents in a single leaf node is wrapped in a
+// root node linking to it, the `DagModifier` drops the data of a leaf it
+// appends nodes to.
+func (fi *fileDescriptor) prepareAppend(end int64) error {
+	size, err := fi.mod.Size()
+	if err != nil {
+		return err
+	}
+	nd, err := fi.mod.GetNode()
+	if err != nil {
+		return err
+	}
+	if end <= size || size == 0 || len(nd.Links()) > 0 {
+		return nil
+	}
+
+	fsn := ft.NewFSNode(ft.TFile)
+	fsn.AddBlockSize(uint64(size))
+	data, err := fsn.GetBytes()
+	if err != nil {
+		return err
+	}
+	root := dag.NodeWithData(data)
+	root.SetCidBuilder(nd.Cid().Prefix())
+	err = root.AddNodeLink("", nd)
+	if err != nil {
+		return err
+	}
+	err = fi.dagService().Add(context.TODO(), root)
+	if err != nil {
+		return err
+	}
+
+	dmod, err := mod.NewDagModifier(context.TODO(), root, fi.dagService(), chunker.SizeSplitterGen(int64(fi.blockSize)))
+	if err != nil {
+		return err
+	}
+	dmod.RawLeaves = fi.inode.RawLeaves
+	fi.mod = dmod
+	return nil
+}
+
 // Write At writes the given bytes at the offset 'at'
 func (fi *fileDescriptor) WriteAt(b []byte, at int64) (int, error) {
 	if err := fi.checkWrite(); err != nil {
@@ -3,16 +3,90 @@ package mfs
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
 	mod "github.com/ipfs/go-unixfs/mod"
 
+	cid "github.com/ipfs/go-cid"
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
+// EmptyFileFormat is the representation of an empty file (see
+// `Root.EmptyFiles`).
+type EmptyFileFormat int
+
+const (
+	// EmptyFileAuto uses an empty raw node with CIDv1 builders and an
+	// empty UnixFS (dag-pb) file node otherwise, as `ipfs add` does.
+	EmptyFileAuto EmptyFileFormat = iota
+
+	// EmptyFileProto always uses an empty UnixFS (dag-pb) file node.
+	EmptyFileProto
+
+	// EmptyFileRaw always uses an empty raw node (which needs a CIDv1,
+	// with CIDv0 builders only their hash function is kept).
+	EmptyFileRaw
+)
+
+// emptyFileNode returns the node of an empty file in the format 'f' with
+// the CID builder 'b'.
+func emptyFileNode(f EmptyFileFormat, b cid.Builder) (ipld.Node, error) {
+	if b == nil {
+		b = cid.V0Builder{}
+	}
+
+	raw := f == EmptyFileRaw
+	if f == EmptyFileAuto {
+		c, err := b.Sum(nil)
+		if err != nil {
+			return nil, err
+		}
+		raw = c.Version() > 0
+	}
+
+	if raw {
+		return dag.NewRawNodeWPrefix(nil, b.WithCodec(cid.Raw))
+	}
+	nd := dag.NodeWithData(ft.FilePBData(nil, 0))
+	nd.SetCidBuilder(b.WithCodec(cid.DagProtobuf))
+	return nd, nil
+}
+
+// emptyFileFormat returns the `Root.EmptyFiles` of 'r' (which may be nil).
+func emptyFileFormat(r *Root) EmptyFileFormat {
+	if r == nil {
+		return EmptyFileAuto
+	}
+	return r.EmptyFiles
+}
+
+// isEmptyFile reports whether 'nd' is the node of a file without content
+// (in any of its representations, e.g., a root with empty leaves).
+func isEmptyFile(nd ipld.Node) bool {
+	switch nd := nd.(type) {
+	case *dag.RawNode:
+		return len(nd.RawData()) == 0
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return false
+		}
+		t := fsn.Type()
+		return (t == ft.TFile || t == ft.TRaw) && fsn.FileSize() == 0
+	default:
+		return false
+	}
+}
+
 // File represents a file in the MFS, its logic its mainly targeted
 // to coordinating (potentially many) `FileDescriptor`s pointing to
 // it.
@@ -33,18 +107,58 @@ type File struct {
 	nodeLock sync.RWMutex
 
 	RawLeaves bool
+
+	// Size of the chunks the data written to this file is split into,
+	// zero until it is configured or inferred from the layout of `node`
+	// (protected by `nodeLock`). An inferred size is dropped when `node`
+	// changes (see `setNode`).
+	blockSize         int
+	blockSizeInferred bool
+
+	// Set when `node` changed without being propagated to the parent
+	// (e.g., by closing a descriptor not opened with `Sync`), until the
+	// parent syncs it (protected by `nodeLock`).
+	unsynced bool
+
+	// Last time the content was modified through a `FileDescriptor`,
+	// only tracked in memory: zero for files loaded from the DAG and
+	// not yet modified (protected by `nodeLock`).
+	modTime time.Time
+
+	// Number of open read-only `FileDescriptor`s, holding reader slots
+	// (see `acquireCallReader`).
+	openReaders int32
+
+	// Result of the last `DetectContentType` and the CID of the node
+	// it was detected from (protected by `nodeLock`).
+	contentType    string
+	contentTypeCid cid.Cid
 }
 
 // NewFile returns a NewFile object with the given parameters.  If the
 // Cid version is non-zero RawLeaves will be enabled.
 func NewFile(name string, node ipld.Node, parent parent, dserv ipld.DAGService) (*File, error) {
+	return NewFileWithBlockSize(name, node, parent, dserv, 0)
+}
+
+// NewFileWithBlockSize is like `NewFile` but also sets the block size used
+// to chunk the data written to the file (to match the layout produced by an
+// external importer). A zero `blockSize` infers it from the layout of `node`
+// (see `BlockSize`).
+func NewFileWithBlockSize(name string, node ipld.Node, parent parent, dserv ipld.DAGService, blockSize int) (*File, error) {
+	if blockSize < 0 {
+		return nil, fmt.Errorf("invalid block size: %d", blockSize)
+	}
+
 	fi := &File{
 		inode: inode{
 			name:       name,
 			parent:     parent,
 			dagService: dserv,
+			root:       rootOf(parent),
 		},
-		node: node,
+		node:      node,
+		blockSize: blockSize,
 	}
 	if node.Cid().Prefix().Version > 0 {
 		fi.RawLeaves = true
@@ -52,7 +166,32 @@ func NewFile(name string, node ipld.Node, parent parent, dserv ipld.DAGService)
 	return fi, nil
 }
 
-func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
+func (fi *File) Open(flags Flags) (FileDescriptor, error) {
+	return fi.OpenContext(context.Background(), flags)
+}
+
+// OpenContext opens the file as `Open`, for read-only descriptors waiting
+// for a reader slot if the `Root` limits them (see `Root.MaxOpenReaders`)
+// until 'ctx' is done.
+func (fi *File) OpenContext(ctx context.Context, flags Flags) (_ FileDescriptor, _retErr error) {
+	release := func() {}
+	if flags.Read && !flags.Write {
+		releaseSlot, err := fi.acquireReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt32(&fi.openReaders, 1)
+		release = func() {
+			atomic.AddInt32(&fi.openReaders, -1)
+			releaseSlot()
+		}
+		defer func() {
+			if _retErr != nil {
+				release()
+			}
+		}()
+	}
+
 	if flags.Write {
 		fi.desclock.Lock()
 		defer func() {
@@ -64,7 +203,7 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 		fi.desclock.RLock()
 		defer func() {
 			if _retErr != nil {
-				fi.desclock.Unlock()
+				fi.desclock.RUnlock()
 			}
 		}()
 	} else {
@@ -79,9 +218,9 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 	// to another package, this seems like a job of UnixFS),
 	// `NewDagModifier` uses the IPLD node, we're not
 	// extracting anything just doing a safety check.
-	switch node := node.(type) {
+	switch nd := node.(type) {
 	case *dag.ProtoNode:
-		fsn, err := ft.FSNodeFromBytes(node.Data())
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
 		if err != nil {
 			return nil, err
 		}
@@ -95,25 +234,67 @@ func (fi *File) Open(flags Flags) (_ FileDescriptor, _retErr error) {
 			// OK case
 		}
 	case *dag.RawNode:
-		// Ok as well.
+		// Ok as well. The DAG modifier loses the data appended to an
+		// empty raw node, it's written as an empty UnixFS node instead
+		// (stored again in the configured format if it's left empty).
+		if flags.Write && len(nd.RawData()) == 0 {
+			empty, err := emptyFileNode(EmptyFileProto, nd.Cid().Prefix())
+			if err != nil {
+				return nil, err
+			}
+			if !fi.root.transformsNodes() {
+				err = fi.dagService.Add(ctx, empty)
+				if err != nil {
+					return nil, err
+				}
+			}
+			node = empty
+		}
 	}
 
-	dmod, err := mod.NewDagModifier(context.TODO(), node, fi.dagService, chunker.DefaultSplitter)
-	// TODO: Remove the use of the `chunker` package here, add a new `NewDagModifier` in
-	// `go-unixfs` with the `DefaultSplitter` already included.
+	var held *heldDagServ
+	dserv := fi.dagService
+	if fi.root.transformsNodes() {
+		held = &heldDagServ{DAGService: fi.dagService}
+		dserv = held
+	}
+	blockSize := fi.BlockSizeContext(ctx)
+	dmod, err := mod.NewDagModifier(context.TODO(), node, dserv, chunker.SizeSplitterGen(int64(blockSize)))
 	if err != nil {
 		return nil, err
 	}
 	dmod.RawLeaves = fi.RawLeaves
 
 	return &fileDescriptor{
-		inode: fi,
-		flags: flags,
-		mod:   dmod,
-		state: stateCreated,
+		inode:     fi,
+		mod:       dmod,
+		flags:     flags,
+		blockSize: blockSize,
+		held:      held,
+		state:     stateCreated,
+		release:   release,
 	}, nil
 }
 
+// acquireReader waits for a reader slot of the root of the file.
+func (fi *File) acquireReader(ctx context.Context) (func(), error) {
+	if fi.root == nil {
+		return func() {}, nil
+	}
+	return fi.root.acquireReader(ctx)
+}
+
+// acquireCallReader waits for a reader slot for a single read of the file
+// (`ReadAtContext`, `DetectContentType`), unless one of its read-only
+// descriptors already holds one: the caller may be the one holding it,
+// and waiting for another slot could deadlock.
+func (fi *File) acquireCallReader(ctx context.Context) (func(), error) {
+	if atomic.LoadInt32(&fi.openReaders) > 0 {
+		return func() {}, nil
+	}
+	return fi.acquireReader(ctx)
+}
+
 // Size returns the size of this file
 // TODO: Should we be providing this API?
 // TODO: There's already a `FileDescriptor.Size()` that
@@ -137,6 +318,401 @@ func (fi *File) Size() (int64, error) {
 	}
 }
 
+// ReadAt implements `io.ReaderAt` over the current (flushed) content of the
+// file, changes not yet flushed by a `FileDescriptor` aren't seen. Each call
+// reads through its own DAG reader, so calls at different offsets can run
+// concurrently (also with open descriptors) without sharing a position.
+func (fi *File) ReadAt(p []byte, off int64) (int, error) {
+	return fi.ReadAtContext(context.Background(), p, off)
+}
+
+// ReadAtContext reads as `ReadAt` waiting for a reader slot (see
+// `Root.MaxOpenReaders`), and for the nodes read, until 'ctx' is done.
+func (fi *File) ReadAtContext(ctx context.Context, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	}
+
+	nd, err := fi.GetNode()
+	if err != nil {
+		return 0, err
+	}
+
+	release, err := fi.acquireCallReader(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	r, err := uio.NewDagReader(ctx, nd, fi.dagService)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if uint64(off) >= r.Size() {
+		return 0, io.EOF
+	}
+	_, err = r.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// DetectContentType returns the MIME type of the file content, as detected
+// by `http.DetectContentType` from its first 512 bytes (read through a DAG
+// reader of its own). The result is cached until the node of the file changes.
+func (fi *File) DetectContentType(ctx context.Context) (string, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return "", err
+	}
+
+	fi.nodeLock.RLock()
+	cached, ctype := fi.contentTypeCid.Equals(nd.Cid()), fi.contentType
+	fi.nodeLock.RUnlock()
+	if cached {
+		return ctype, nil
+	}
+
+	release, err := fi.acquireCallReader(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	r, err := uio.NewDagReader(ctx, nd, fi.dagService)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	buf := make([]byte, 512)
+	n, err := r.CtxReadFull(ctx, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	ctype = http.DetectContentType(buf[:n])
+
+	fi.nodeLock.Lock()
+	fi.contentType = ctype
+	fi.contentTypeCid = nd.Cid()
+	fi.nodeLock.Unlock()
+	return ctype, nil
+}
+
+// FileInfo is the metadata of a `File` returned by `Stat`.
+type FileInfo struct {
+	// Size of the file content.
+	Size int64
+	// Mode of the file, UnixFS doesn't store permissions: regular files
+	// are reported as 0644 and symlinks as 0777.
+	Mode os.FileMode
+	// ModTime of the file (see `NodeListing.ModTime`).
+	ModTime time.Time
+	// RawLeaves is set if the data of the file is stored in raw nodes.
+	RawLeaves bool
+}
+
+// BlockCids returns the CIDs of the leaf blocks of the DAG of the file, the
+// ones holding its contents, in content order (a file stored in a single
+// node is its own leaf). Repeated chunks appear once per occurrence.
+func (fi *File) BlockCids(ctx context.Context) ([]cid.Cid, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []cid.Cid
+	err = fi.leafCids(ctx, nd, &out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (fi *File) leafCids(ctx context.Context, nd ipld.Node, out *[]cid.Cid) error {
+	links := nd.Links()
+	if len(links) == 0 {
+		*out = append(*out, nd.Cid())
+		return nil
+	}
+
+	for _, l := range links {
+		if l.Cid.Type() == cid.Raw {
+			*out = append(*out, l.Cid)
+			continue
+		}
+		child, err := l.GetNode(ctx, fi.dagService)
+		if err != nil {
+			return err
+		}
+		err = fi.leafCids(ctx, child, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leafSizes adds to 'out' the CIDs of the leaf blocks of the file with
+// the size of the data they hold.
+func (fi *File) leafSizes(ctx context.Context, out map[cid.Cid]int64) error {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return err
+	}
+	return fi.addLeafSizes(ctx, nd, out)
+}
+
+func (fi *File) addLeafSizes(ctx context.Context, nd ipld.Node, out map[cid.Cid]int64) error {
+	links := nd.Links()
+	if len(links) == 0 {
+		switch nd := nd.(type) {
+		case *dag.ProtoNode:
+			fsn, err := ft.FSNodeFromBytes(nd.Data())
+			if err != nil {
+				return err
+			}
+			out[nd.Cid()] = int64(len(fsn.Data()))
+		case *dag.RawNode:
+			out[nd.Cid()] = int64(len(nd.RawData()))
+		default:
+			return fmt.Errorf("unrecognized node type in mfs/file.leafSizes()")
+		}
+		return nil
+	}
+
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if l.Cid.Type() == cid.Raw {
+			// The size of a raw block is the size of its data.
+			out[l.Cid] = int64(l.Size)
+			continue
+		}
+		child, err := l.GetNode(ctx, fi.dagService)
+		if err != nil {
+			return err
+		}
+		err = fi.addLeafSizes(ctx, child, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat returns the size, mode, modification time and leaf format of the
+// file (see `StatContext`), fetching the nodes needed without a deadline.
+func (fi *File) Stat() (FileInfo, error) {
+	return fi.StatContext(context.Background())
+}
+
+// StatContext returns the size, mode, modification time and leaf format of
+// the file. All but the leaf format are read from its root node, the leaf
+// format from its first leaf, fetched with 'ctx' descending the first link
+// of each level of the DAG.
+func (fi *File) StatContext(ctx context.Context) (FileInfo, error) {
+	fi.nodeLock.RLock()
+	node, modTime := fi.node, fi.modTime
+	fi.nodeLock.RUnlock()
+
+	info := FileInfo{Mode: 0644, ModTime: modTime}
+	switch nd := node.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return FileInfo{}, err
+		}
+		info.Size = int64(fsn.FileSize())
+		if fsn.Type() == ft.TSymlink {
+			info.Mode = os.ModeSymlink | 0777
+		}
+		info.RawLeaves, err = fi.hasRawLeaves(ctx, nd)
+		if err != nil {
+			return FileInfo{}, err
+		}
+	case *dag.RawNode:
+		info.Size = int64(len(nd.RawData()))
+		info.RawLeaves = true
+	default:
+		return FileInfo{}, fmt.Errorf("unrecognized node type in mfs/file.Stat()")
+	}
+	return info, nil
+}
+
+// hasRawLeaves reports whether the first leaf of the DAG under 'nd' is a
+// raw node (a node without links is its own, UnixFS, leaf).
+func (fi *File) hasRawLeaves(ctx context.Context, nd *dag.ProtoNode) (bool, error) {
+	for {
+		links := nd.Links()
+		if len(links) == 0 {
+			return false, nil
+		}
+		if links[0].Cid.Type() == cid.Raw {
+			return true, nil
+		}
+		child, err := links[0].GetNode(ctx, fi.dagService)
+		if err != nil {
+			return false, err
+		}
+		pbnd, ok := child.(*dag.ProtoNode)
+		if !ok {
+			return false, dag.ErrNotProtobuf
+		}
+		nd = pbnd
+	}
+}
+
+// modifiedAt returns the last time the file content was modified (see
+// `modTime`).
+func (fi *File) modifiedAt() time.Time {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return fi.modTime
+}
+
+// isSymlink reports whether the node of the file is a UnixFS symlink.
+func (fi *File) isSymlink() bool {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+
+	nd, ok := fi.node.(*dag.ProtoNode)
+	if !ok {
+		return false
+	}
+	fsn, err := ft.FSNodeFromBytes(nd.Data())
+	return err == nil && fsn.Type() == ft.TSymlink
+}
+
+// symlinkTarget returns the target stored in the node of a symlink.
+func (fi *File) symlinkTarget() (string, error) {
+	nd, err := fi.GetNode()
+	if err != nil {
+		return "", err
+	}
+	fsnode, err := ft.ExtractFSNode(nd)
+	if err != nil {
+		return "", err
+	}
+	return string(fsnode.Data()), nil
+}
+
+// BlockSize returns the size of the chunks the file data is split into.
+// If it wasn't set at creation it's inferred from the size of the first
+// leaf of the file DAG, files consisting of a single block report the
+// default chunker size (unless their only block is bigger than that).
+func (fi *File) BlockSize() int {
+	return fi.BlockSizeContext(context.Background())
+}
+
+// BlockSizeContext is like `BlockSize` but fetching the nodes needed to
+// infer the size with 'ctx' (the default chunker size is returned if it
+// can't be inferred).
+func (fi *File) BlockSizeContext(ctx context.Context) int {
+	fi.nodeLock.RLock()
+	size, nd := fi.blockSize, fi.node
+	fi.nodeLock.RUnlock()
+	if size != 0 {
+		return size
+	}
+
+	size, err := leafBlockSize(ctx, nd, fi.dagService)
+	if err != nil {
+		log.Warningf("failed to infer block size of file %s: %s", fi.name, err)
+		return int(chunker.DefaultBlockSize)
+	}
+
+	fi.nodeLock.Lock()
+	defer fi.nodeLock.Unlock()
+	// Only cache it if the file wasn't modified (or configured) meanwhile.
+	if fi.blockSize == 0 && fi.node == nd {
+		fi.blockSize = size
+		fi.blockSizeInferred = true
+	}
+	return size
+}
+
+// setBlockSize configures the block size of the file (see
+// `NewFileWithBlockSize`).
+func (fi *File) setBlockSize(size int) {
+	fi.nodeLock.Lock()
+	defer fi.nodeLock.Unlock()
+	fi.blockSize = size
+	fi.blockSizeInferred = false
+}
+
+// markSynced clears the `unsynced` flag if 'nd' is still the node of the
+// file (i.e., the one propagated to the parent).
+func (fi *File) markSynced(nd ipld.Node) {
+	fi.nodeLock.Lock()
+	defer fi.nodeLock.Unlock()
+	if fi.node == nd {
+		fi.unsynced = false
+	}
+}
+
+// isUnsynced reports whether the node of the file may not have been
+// propagated to its parent yet (see `unsynced`).
+func (fi *File) isUnsynced() bool {
+	fi.nodeLock.RLock()
+	defer fi.nodeLock.RUnlock()
+	return fi.unsynced
+}
+
+// setNode replaces the node of the file, dropping the block size inferred
+// from the previous one. It must be called with the `nodeLock` taken.
+func (fi *File) setNode(nd ipld.Node) {
+	fi.node = nd
+	if fi.blockSizeInferred {
+		fi.blockSize = 0
+		fi.blockSizeInferred = false
+	}
+}
+
+// leafBlockSize descends through the first link of every node of the
+// file DAG rooted at `nd` and returns the data size of the leaf found.
+func leafBlockSize(ctx context.Context, nd ipld.Node, dserv ipld.DAGService) (int, error) {
+	isRoot := true
+	for len(nd.Links()) > 0 {
+		child, err := nd.Links()[0].GetNode(ctx, dserv)
+		if err != nil {
+			return 0, err
+		}
+		nd = child
+		isRoot = false
+	}
+
+	var size int
+	switch nd := nd.(type) {
+	case *dag.ProtoNode:
+		fsn, err := ft.FSNodeFromBytes(nd.Data())
+		if err != nil {
+			return 0, err
+		}
+		size = int(fsn.FileSize())
+	case *dag.RawNode:
+		size = len(nd.RawData())
+	default:
+		return 0, fmt.Errorf("unrecognized node type in mfs/file.BlockSize()")
+	}
+
+	// A single block file doesn't reveal the chunker size it was
+	// created with, only that it's at least as big as its data.
+	if size == 0 || (isRoot && size < int(chunker.DefaultBlockSize)) {
+		return int(chunker.DefaultBlockSize), nil
+	}
+	return size, nil
+}
+
 // GetNode returns the dag node associated with this file
 // TODO: Use this method and do not access the `nodeLock` directly anywhere else.
 func (fi *File) GetNode() (ipld.Node, error) {
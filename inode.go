@@ -18,4 +18,19 @@ type inode struct {
 	// dagService used to store modifications made to the contents
 	// of the file or directory the `inode` belongs to.
 	dagService ipld.DAGService
+
+	// root of the MFS this `inode` belongs to (taken from the `parent`).
+	root *Root
+}
+
+// rootOf returns the `Root` at the top of the chain of parents of `p`.
+func rootOf(p parent) *Root {
+	switch p := p.(type) {
+	case *Root:
+		return p
+	case *Directory:
+		return p.root
+	default:
+		return nil
+	}
 }
@@ -3,15 +3,20 @@ package mfs
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -20,7 +25,10 @@ import (
 	bserv "github.com/ipfs/go-blockservice"
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
+	hamt "github.com/ipfs/go-unixfs/hamt"
 	importer "github.com/ipfs/go-unixfs/importer"
+	balanced "github.com/ipfs/go-unixfs/importer/balanced"
+	helpers "github.com/ipfs/go-unixfs/importer/helpers"
 	uio "github.com/ipfs/go-unixfs/io"
 
 	cid "github.com/ipfs/go-cid"
@@ -30,6 +38,7 @@ import (
 	chunker "github.com/ipfs/go-ipfs-chunker"
 	offline "github.com/ipfs/go-ipfs-exchange-offline"
 	u "github.com/ipfs/go-ipfs-util"
+	cbor "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
@@ -44,6 +53,18 @@ func getDagserv(t *testing.T) ipld.DAGService {
 	return dag.NewDAGService(blockserv)
 }
 
+func emptyShardNode(t *testing.T, ds ipld.DAGService) ipld.Node {
+	shard, err := hamt.NewShard(ds, uio.DefaultShardWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := shard.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nd
+}
+
 func getRandFile(t *testing.T, ds ipld.DAGService, size int64) ipld.Node {
 	r := io.LimitReader(u.NewTimeSeededRand(), size)
 	return fileNodeFromReader(t, ds, r)
@@ -192,6 +213,22 @@ func assertFileAtPath(ds ipld.DAGService, root *Directory, expn ipld.Node, pth s
 	return nil
 }
 
+// resolveDagPath follows the links named by 'pth' starting at 'nd',
+// it resolves against the DAG service, not the MFS.
+func resolveDagPath(ctx context.Context, ds ipld.DAGService, nd ipld.Node, pth string) (ipld.Node, error) {
+	for _, name := range path.SplitList(pth) {
+		dir, err := uio.NewDirectoryFromNode(ds, nd)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %s", name, err)
+		}
+		nd, err = dir.Find(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("resolving %s: %s", name, err)
+		}
+	}
+	return nd, nil
+}
+
 func catNode(ds ipld.DAGService, nd *dag.ProtoNode) ([]byte, error) {
 	r, err := uio.NewDagReader(context.TODO(), nd, ds)
 	if err != nil {
@@ -1370,3 +1407,6456 @@ func TestFSNodeType(t *testing.T) {
 		t.Fatal("FSNode type should be file, but not")
 	}
 }
+
+func TestFileBlockSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+
+	data := make([]byte, 4096)
+	u.NewTimeSeededRand().Read(data)
+
+	// Block size of an imported file is inferred from its layout.
+	nd, err := importer.BuildDagFromReader(ds, chunker.NewSizeSplitter(bytes.NewReader(data), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := NewFile("imported", nd, dir, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := fi.BlockSize(); bs != 1024 {
+		t.Fatalf("expected block size 1024, got %d", bs)
+	}
+
+	// Single block files report the default chunker size.
+	small, err := NewFile("small", getRandFile(t, ds, 100), dir, ds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs := small.BlockSize(); bs != int(chunker.DefaultBlockSize) {
+		t.Fatalf("expected default block size, got %d", bs)
+	}
+
+	// Writes honor the configured block size.
+	empty := dag.NodeWithData(ft.FilePBData(nil, 0))
+	wfi, err := NewFileWithBlockSize("written", empty, dir, ds, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := wfi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp, err := importer.BuildTrickleDagFromReader(ds, chunker.NewSizeSplitter(bytes.NewReader(data), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wnd, err := wfi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wnd.Cid().Equals(exp.Cid()) {
+		t.Fatalf("expected %s, got %s", exp.Cid(), wnd.Cid())
+	}
+
+	// An inferred block size is dropped when the content changes.
+	fd, err = fi.Open(Flags{Write: true, Sync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bs := fi.BlockSize(); bs != int(chunker.DefaultBlockSize) {
+		t.Fatalf("expected default block size after truncating, got %d", bs)
+	}
+
+	// The block size can be set when creating a file with `OpenFile`.
+	fd, err = OpenFileWithOpts(ctx, rt, "/opened", os.O_WRONLY|os.O_CREATE, OpenFileOpts{BlockSize: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ofsn, err := Lookup(rt, "/opened")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ofi := ofsn.(*File)
+	if bs := ofi.BlockSize(); bs != 1024 {
+		t.Fatalf("expected block size 1024, got %d", bs)
+	}
+	ond, err := ofi.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ond.Cid().Equals(exp.Cid()) {
+		t.Fatalf("expected %s, got %s", exp.Cid(), ond.Cid())
+	}
+}
+
+// failingDagServ wraps a DAG service failing to add the nodes
+// selected by `fail` (while it's set).
+type failingDagServ struct {
+	ipld.DAGService
+
+	lk   sync.Mutex
+	fail func(ipld.Node) bool
+}
+
+func (fds *failingDagServ) setFail(fail func(ipld.Node) bool) {
+	fds.lk.Lock()
+	defer fds.lk.Unlock()
+	fds.fail = fail
+}
+
+func (fds *failingDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	fds.lk.Lock()
+	fail := fds.fail
+	fds.lk.Unlock()
+	if fail != nil && fail(nd) {
+		return errors.New("injected DAG failure")
+	}
+	return fds.DAGService.Add(ctx, nd)
+}
+
+func (fds *failingDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := fds.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFlushParentUpdateFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fds := &failingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, fds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := d.AddChild("afile", getRandFile(t, fds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail when storing the updated node of `a` (the one linking to `b`).
+	fds.setFail(func(nd ipld.Node) bool {
+		_, _, err := nd.ResolveLink([]string{"b"})
+		return err == nil
+	})
+
+	err = d.Flush()
+	if err == nil {
+		t.Fatal("expected flush to fail")
+	}
+	if !errors.Is(err, ErrNotPropagated) {
+		t.Fatalf("expected ErrNotPropagated, got: %s", err)
+	}
+	if !d.dirty {
+		t.Fatal("directory should still be dirty after a failed flush")
+	}
+
+	// Retry once the DAG service is healthy again.
+	fds.setFail(nil)
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if d.dirty {
+		t.Fatal("directory should be clean after flushing")
+	}
+
+	rootnd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveDagPath(ctx, fds, rootnd, "a/b/afile"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := d.AddChild("before", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := d.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("discarded", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, d, "c/d")
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone, got: %v", err)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "a/b", []string{"before"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err = d.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("committed", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != ErrTxDone {
+		t.Fatalf("expected ErrTxDone, got: %v", err)
+	}
+
+	rootnd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveDagPath(ctx, ds, rootnd, "a/b/committed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of concurrent `Commit` and `Rollback` calls finishes it.
+	tx, err = d.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- tx.Commit() }()
+	go func() { errs <- tx.Rollback() }()
+	done := 0
+	for i := 0; i < 2; i++ {
+		switch err := <-errs; err {
+		case nil:
+			done++
+		case ErrTxDone:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if done != 1 {
+		t.Fatalf("expected exactly one call to finish the transaction, got %d", done)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.MaxDepth = 2
+
+	err := Mkdir(rt, "/a/b", MkdirOpts{Mkparents: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Mkdir(rt, "/a/b/c", MkdirOpts{Mkparents: true})
+	if err != ErrTooDeep {
+		t.Fatalf("expected ErrTooDeep, got: %v", err)
+	}
+
+	b, err := Lookup(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.(*Directory).AddChild("c", ft.EmptyDirNode())
+	if err != ErrTooDeep {
+		t.Fatalf("expected ErrTooDeep, got: %v", err)
+	}
+
+	// Files are still allowed at the maximum depth.
+	err = b.(*Directory).AddChild("afile", getRandFile(t, ds, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The descendants of a prebuilt directory are checked too.
+	inner := ft.EmptyDirNode()
+	if err := ds.Add(ctx, inner); err != nil {
+		t.Fatal(err)
+	}
+	outer := ft.EmptyDirNode()
+	if err := outer.AddNodeLink("inner", inner); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Lookup(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.(*Directory).AddChild("outer", outer)
+	if err != ErrTooDeep {
+		t.Fatalf("expected ErrTooDeep, got: %v", err)
+	}
+	if _, err := ReplaceSubtree(ctx, rt, "/a/b", outer); err != ErrTooDeep {
+		t.Fatalf("expected ErrTooDeep, got: %v", err)
+	}
+	err = rt.GetDirectory().AddChild("outer", outer)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListSharded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if _, err := dir.Mkdir("basic"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("sharded", emptyShardNode(t, ds)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := dir.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range listing {
+		if e.Sharded != (e.Name == "sharded") {
+			t.Fatalf("unexpected sharding status for %s: %t", e.Name, e.Sharded)
+		}
+	}
+}
+
+func TestCompactHAMT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := rt.GetDirectory().AddChild("shard", emptyShardNode(t, ds)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := rt.GetDirectory().Child("shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fsn.(*Directory)
+
+	fi := getRandFile(t, ds, 100)
+	for i := 0; i < 500; i++ {
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var kept []string
+	for i := 0; i < 500; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if i%50 == 0 {
+			kept = append(kept, name)
+			continue
+		}
+		if err := dir.Unlink(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := dir.CompactHAMT(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "shard", kept); err != nil {
+		t.Fatal(err)
+	}
+
+	// The compacted HAMT matches one built from scratch.
+	exp, err := hamt.NewShard(ds, uio.DefaultShardWidth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range kept {
+		if err := exp.Set(ctx, name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expnd, err := exp.Node()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(expnd.Cid()) {
+		t.Fatalf("expected %s, got %s", expnd.Cid(), nd.Cid())
+	}
+
+	if err := rt.GetDirectory().CompactHAMT(ctx); err != ErrNotSharded {
+		t.Fatalf("expected ErrNotSharded, got: %v", err)
+	}
+}
+
+func TestCopyFileToAndChecksum(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	data := make([]byte, 1024*1024)
+	u.NewTimeSeededRand().Read(data)
+	if err := dir.AddChild("afile", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir("adir"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := dir.CopyFileTo(ctx, "afile", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("copied content doesn't match")
+	}
+
+	sum, err := dir.FileChecksum(ctx, "afile", sha256.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := sha256.Sum256(data); !bytes.Equal(sum, exp[:]) {
+		t.Fatal("checksum doesn't match")
+	}
+
+	if _, err := dir.CopyFileTo(ctx, "adir", &buf); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got: %v", err)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := dir.CopyFileTo(cctx, "afile", ioutil.Discard); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestAddInvalidChild(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("notunixfs", dag.NodeWithData([]byte("junk"))); err != ErrInvalidChild {
+		t.Fatalf("expected ErrInvalidChild, got: %v", err)
+	}
+
+	if _, err := dir.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListWithOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	var files []string
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file%d", i)
+		files = append(files, name)
+		if err := dir.AddChild(name, getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := mkdirP(t, dir, "dir0")
+	if err := sub.AddChild("nested", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	listNames := func(opts ListOptions) []string {
+		listing, err := dir.ListWithOptions(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, nl := range listing {
+			names = append(names, nl.Name)
+		}
+		return names
+	}
+
+	names := listNames(ListOptions{Sort: SortByName, TypeFilter: []NodeType{TFile}, Offset: 2, Limit: 3})
+	if !compStrArrs(names, files[2:5]) {
+		t.Fatalf("unexpected sorted window: %v", names)
+	}
+
+	names = listNames(ListOptions{TypeFilter: []NodeType{TFile}, Offset: 8, Limit: 5})
+	if len(names) != 2 {
+		t.Fatalf("expected 2 entries, got: %v", names)
+	}
+
+	names = listNames(ListOptions{TypeFilter: []NodeType{TDir}})
+	if !compStrArrs(names, []string{"dir0"}) {
+		t.Fatalf("unexpected directories: %v", names)
+	}
+
+	listing, err := dir.ListWithOptions(ctx, ListOptions{TypeFilter: []NodeType{TDir}, IncludeDirSizes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listing[0].Size <= 1000 {
+		t.Fatalf("expected cumulative directory size, got %d", listing[0].Size)
+	}
+}
+
+func TestPathExists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	d := mkdirP(t, dir, "a/b/c")
+	if err := d.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for pth, exp := range map[string]bool{
+		"/":                true,
+		"a/b/c/afile":      true,
+		"/a/b/":            true,
+		"a/b/c/nofile":     false,
+		"a/b/c/afile/more": false,
+		"x/b":              false,
+	} {
+		exists, err := dir.PathExists(ctx, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != exp {
+			t.Fatalf("expected PathExists(%q) to be %t", pth, exp)
+		}
+	}
+
+	if len(dir.entriesCache) != 0 {
+		t.Fatal("PathExists shouldn't cache entries")
+	}
+}
+
+func TestShardWidth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+	rt.ShardWidth = 16
+
+	uio.UseHAMTSharding = true
+	defer func() { uio.UseHAMTSharding = false }()
+
+	dir, err := rt.GetDirectory().Mkdir("sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fi := dag.NewRawNode([]byte("hamt reference"))
+	for i := 0; i < 100; i++ {
+		if err := dir.AddChild(fmt.Sprintf("file%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Computed with an independent implementation of the UnixFS HAMT
+	// (murmur3-x64-64, fanout 16).
+	const expected = "QmeJfQQeZ6vKaocEFg28WttdnqbQbtihtxG3tnuRrpnmgM"
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().String() != expected {
+		t.Fatalf("expected %s, got %s", expected, nd.Cid())
+	}
+
+	fsn, err := ft.ExtractFSNode(nd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Fanout() != 16 {
+		t.Fatalf("expected fanout 16, got %d", fsn.Fanout())
+	}
+}
+
+func TestSoftDelete(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	d := mkdirP(t, dir, "a/b")
+	if err := d.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("other", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SoftDelete(ctx, rt, "/a/b/afile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "a/b", []string{"other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	trash, err := lookupDir(rt, "/"+TrashDirName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := trash.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("expected one entry in the trash, got: %v", names)
+	}
+
+	if err := Restore(ctx, rt, names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(dir, "a/b", []string{"afile", "other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SoftDelete(ctx, rt, "/a/b/other"); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := PurgeTrash(ctx, rt, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 0 {
+		t.Fatal("recently deleted entries shouldn't be purged")
+	}
+	purged, err = PurgeTrash(ctx, rt, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected one purged entry, got %d", purged)
+	}
+	if err := assertDirAtPath(dir, TrashDirName, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cancelled call doesn't move anything.
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if err := SoftDelete(cctx, rt, "/a/b/afile"); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := PurgeTrash(cctx, rt, 0); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := assertDirAtPath(dir, "a/b", []string{"afile"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddChildCid(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 1000)
+	if err := dir.AddChildCid(ctx, "afile", fi.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, dir, fi, "afile"); err != nil {
+		t.Fatal(err)
+	}
+
+	junk := dag.NodeWithData([]byte("junk"))
+	if err := ds.Add(ctx, junk); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChildCid(ctx, "junk", junk.Cid()); err != ErrInvalidChild {
+		t.Fatalf("expected ErrInvalidChild, got: %v", err)
+	}
+}
+
+func TestCollectCids(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	// Multi-block file, added twice (its blocks are only reported once).
+	fi := getRandFile(t, ds, 1024*1024)
+	if err := d.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("same", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := Lookup(rt, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids, err := CollectCids(ctx, a.(*Directory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes of `a`, `b` and the file (with its 4 leaves).
+	if len(cids) != 7 {
+		t.Fatalf("expected 7 CIDs, got %d", len(cids))
+	}
+	for _, c := range cids {
+		if _, err := ds.Get(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFlushIfMatches(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	base, err := rt.FlushIfMatches(ctx, emptyDirNode().Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer commits a change on top of `base`.
+	if err := dir.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := rt.FlushIfMatches(ctx, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A writer still expecting `base` detects the conflict.
+	if err := dir.AddChild("other", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.FlushIfMatches(ctx, base); err != ErrCASFailed {
+		t.Fatalf("expected ErrCASFailed, got: %v", err)
+	}
+	if _, err := rt.FlushIfMatches(ctx, committed); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryFlushSerialized(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := d.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flush of the root in progress holds back the directory flushes.
+	rt.flushLock.Lock()
+	flushed := make(chan error, 2)
+	go func() { flushed <- d.Flush() }()
+	go func() { flushed <- rt.FlushMemFree(ctx) }()
+	select {
+	case <-flushed:
+		t.Fatal("flush didn't wait for the flush of the root")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rt.flushLock.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := <-flushed; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestForEachEntryShardStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	if err := rt.GetDirectory().AddChild("shard", emptyShardNode(t, ds)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := rt.GetDirectory().Child("shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := fsn.(*Directory)
+
+	fi := getRandFile(t, ds, 100)
+	var names []string
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("file%d", i)
+		names = append(names, name)
+		if err := dir.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var streamed []string
+	err = dir.ForEachEntryShardStream(ctx, func(l *ipld.Link) error {
+		if !l.Cid.Equals(fi.Cid()) {
+			t.Fatalf("unexpected CID for %s", l.Name)
+		}
+		streamed = append(streamed, l.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	sort.Strings(streamed)
+	if !compStrArrs(names, streamed) {
+		t.Fatal("streamed entries don't match")
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if err := dir.ForEachEntryShardStream(cctx, func(*ipld.Link) error { return nil }); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestGetPersistedNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	d := mkdirP(t, rt.GetDirectory(), "a")
+	if err := d.AddChild("flushed", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddChild("pending", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	nd, err := d.GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := nd.Links()
+	if len(links) != 1 || links[0].Name != "flushed" {
+		t.Fatalf("persisted node shouldn't include pending changes: %v", links)
+	}
+}
+
+func TestNewDirectoryWithChildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	children := make(map[string]ipld.Node)
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		names = append(names, name)
+		children[name] = getRandFile(t, ds, 100)
+	}
+	children["sub"] = ft.EmptyDirNode()
+	names = append(names, "sub")
+
+	dir, err := NewDirectoryWithChildren(ctx, "prepopulated", rt.GetDirectory(), ds, children, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("prepopulated", nd); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "prepopulated", names); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same result as adding the children one by one (in order).
+	exp := mkdirP(t, rt.GetDirectory(), "expected")
+	sort.Strings(names)
+	for _, name := range names {
+		if err := exp.AddChild(name, children[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expnd, err := exp.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(expnd.Cid()) {
+		t.Fatalf("expected %s, got %s", expnd.Cid(), nd.Cid())
+	}
+
+	// The names and depth are checked as with `AddChild`.
+	rt.RequireValidUTF8Names = true
+	rt.CaseInsensitive = true
+	rt.MaxDepth = 1
+	invalid := []map[string]ipld.Node{
+		{"bad\x00name": getRandFile(t, ds, 100)},
+		{"File": getRandFile(t, ds, 100), "file": getRandFile(t, ds, 100)},
+		{"sub": ft.EmptyDirNode()},
+	}
+	for _, children := range invalid {
+		if _, err := NewDirectoryWithChildren(ctx, "invalid", exp, ds, children, nil); err == nil {
+			t.Fatalf("expected %v to be rejected", children)
+		}
+	}
+}
+
+func TestValidateFlushable(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fds := &failingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, fds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := d.AddChild("afile", getRandFile(t, fds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directory linking to a block missing from the DAG service.
+	missing := dag.NodeWithData(ft.FilePBData([]byte("missing"), 7))
+	broken := ft.EmptyDirNode()
+	if err := broken.AddNodeLink("missing", missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.GetDirectory().AddChild("broken", broken); err != nil {
+		t.Fatal(err)
+	}
+	// Cached entry, synced on flush.
+	mkdirP(t, rt.GetDirectory(), "broken/sub")
+
+	adds := 0
+	fds.setFail(func(ipld.Node) bool {
+		adds++
+		return false
+	})
+
+	if err := rt.ValidateFlushable(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sharding "broken" needs to fetch all of its entries.
+	uio.UseHAMTSharding = true
+	defer func() { uio.UseHAMTSharding = false }()
+	if err := rt.ValidateFlushable(ctx); err == nil {
+		t.Fatal("expected validation to fail")
+	}
+
+	if adds != 0 {
+		t.Fatalf("validation shouldn't store nodes, stored %d", adds)
+	}
+
+	if err := rt.Flush(); err == nil {
+		t.Fatal("expected flush to fail as well")
+	}
+}
+
+func TestValidateFlushableSharded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fds := &failingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, fds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.GetDirectory().AddChild("shard", emptyShardNode(t, fds)); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := rt.GetDirectory().Child("shard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shard := fsn.(*Directory)
+	for i := 0; i < 50; i++ {
+		if err := shard.AddChild(fmt.Sprintf("file%d", i), getRandFile(t, fds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdirP(t, shard, "sub/dir")
+
+	adds := 0
+	fds.setFail(func(ipld.Node) bool {
+		adds++
+		return false
+	})
+	computed, err := shard.computeNode(ctx, newOverlayDagServ(fds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.ValidateFlushable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if adds != 0 {
+		t.Fatalf("validation shouldn't store nodes, stored %d", adds)
+	}
+	fds.setFail(nil)
+
+	nd, err := shard.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !computed.Cid().Equals(nd.Cid()) {
+		t.Fatalf("expected %s, computed %s", nd.Cid(), computed.Cid())
+	}
+}
+
+func TestRebuildWithCidBuilder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	b := mkdirP(t, rt.GetDirectory(), "a/b")
+	fi := getRandFile(t, ds, 1000)
+	if err := b.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+	shard := emptyShardNode(t, ds)
+	if err := rt.GetDirectory().AddChild("shard", shard); err != nil {
+		t.Fatal(err)
+	}
+	mkdirP(t, rt.GetDirectory(), "shard/sub")
+
+	c, err := RebuildWithCidBuilder(ctx, rt.GetDirectory(), dag.V1CidPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Version() != 1 {
+		t.Fatalf("expected a CIDv1, got %s", c)
+	}
+
+	rnd, err := ds.Get(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{"a", "a/b", "shard", "shard/sub"} {
+		nd, err := resolveDagPath(ctx, ds, rnd, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nd.Cid().Version() != 1 {
+			t.Fatalf("expected %s to have a CIDv1, got %s", pth, nd.Cid())
+		}
+	}
+
+	fnd, err := resolveDagPath(ctx, ds, rnd, "a/b/afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fnd.Cid().Equals(fi.Cid()) {
+		t.Fatal("file should have been left untouched")
+	}
+
+	// The root reflects the rebuilt tree.
+	if err := assertFileAtPath(ds, rt.GetDirectory(), fi, "a/b/afile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(c) {
+		t.Fatalf("expected root to be %s, got %s", c, nd.Cid())
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	write := func(flags int, data string) {
+		t.Helper()
+		fd, err := OpenFile(ctx, rt, "/a/b/file", flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func() string {
+		t.Helper()
+		fd, err := OpenFile(ctx, rt, "/a/b/file", os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		out, err := ioutil.ReadAll(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	if _, err := OpenFile(ctx, rt, "/a/b/file", os.O_RDONLY); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if _, err := OpenFile(ctx, rt, "/a/b/file", os.O_WRONLY|os.O_CREATE); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist without the parents, got %v", err)
+	}
+
+	write(os.O_WRONLY|os.O_CREATE|O_MKPARENTS, "hello")
+	if out := read(); out != "hello" {
+		t.Fatalf("expected %q, got %q", "hello", out)
+	}
+
+	write(os.O_WRONLY|os.O_APPEND, " world")
+	if out := read(); out != "hello world" {
+		t.Fatalf("expected %q, got %q", "hello world", out)
+	}
+
+	write(os.O_RDWR|os.O_TRUNC, "bye")
+	if out := read(); out != "bye" {
+		t.Fatalf("expected %q, got %q", "bye", out)
+	}
+
+	if _, err := OpenFile(ctx, rt, "/a/b/file", os.O_WRONLY|os.O_CREATE|os.O_EXCL); err != os.ErrExist {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+	if _, err := OpenFile(ctx, rt, "/a/b/file", os.O_RDONLY|os.O_TRUNC); err == nil {
+		t.Fatal("expected read-only truncation to fail")
+	}
+	if _, err := OpenFile(ctx, rt, "/a/b", os.O_RDONLY); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+}
+
+func TestCachedChildren(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "b")
+	if err := dir.AddChild("a", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("c", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only `Mkdir` caches the new entry.
+	if cached := dir.CachedChildren(); len(cached) != 1 || cached[0] != "b" {
+		t.Fatalf("expected [b] to be cached, got %v", cached)
+	}
+
+	if _, err := dir.Child("c"); err != nil {
+		t.Fatal(err)
+	}
+	if cached := dir.CachedChildren(); len(cached) != 2 || cached[0] != "b" || cached[1] != "c" {
+		t.Fatalf("expected [b c] to be cached, got %v", cached)
+	}
+
+	dir.Uncache("b")
+	if cached := dir.CachedChildren(); len(cached) != 1 || cached[0] != "c" {
+		t.Fatalf("expected [c] to be cached, got %v", cached)
+	}
+}
+
+func TestAutoFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	fds := &failingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, fds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.AutoFlushErrors() != nil {
+		t.Fatal("expected no errors channel before starting")
+	}
+
+	stop := rt.StartAutoFlush(10 * time.Millisecond)
+	errs := rt.AutoFlushErrors()
+
+	mkdirP(t, rt.GetDirectory(), "a/b")
+	for start := time.Now(); rt.GetDirectory().hasChanges(); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("root wasn't auto flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pnd, err := rt.GetDirectory().GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveDagPath(ctx, fds, pnd, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail to store the root node once it links to `c`.
+	fds.setFail(func(nd ipld.Node) bool {
+		_, _, err := nd.ResolveLink([]string{"c"})
+		return err == nil
+	})
+	mkdirP(t, rt.GetDirectory(), "c")
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatal("expected a flush error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("auto flush error wasn't reported")
+	}
+
+	// The final flush (on stop) succeeds.
+	fds.setFail(nil)
+	stop()
+	// Drain the errors of the flushes attempted before disabling the
+	// failure, the channel is closed once stopped.
+	for range errs {
+	}
+	if rt.GetDirectory().hasChanges() {
+		t.Fatal("expected a final flush on stop")
+	}
+	stop()
+}
+
+func TestHasChangesSyncedNode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed, _, _ := rt.LastFlush()
+
+	b, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// Syncing the change into the node of an intermediate directory
+	// (e.g., listing its parent) doesn't hide it.
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.GetNode(); err != nil {
+		t.Fatal(err)
+	}
+	if !rt.GetDirectory().hasChanges() {
+		t.Fatal("expected the synced change to be pending")
+	}
+
+	stop := rt.StartAutoFlush(time.Hour)
+	stop()
+	last, _, _ := rt.LastFlush()
+	if last.Equals(flushed) {
+		t.Fatal("expected the final flush to store the change")
+	}
+	if _, err := Lookup(rt, "/a/b/afile"); err != nil {
+		t.Fatal(err)
+	}
+	pnd, err := rt.GetDirectory().GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resolveDagPath(ctx, ds, pnd, "a/b/afile"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHasChangesCachedFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading (caching) a file doesn't change the tree.
+	fsn, err := dir.Child("afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir.hasChanges() {
+		t.Fatal("expected no changes with an unmodified cached file")
+	}
+
+	// Closing a descriptor without `Sync` leaves the file to be synced.
+	fd, err := fsn.(*File).Open(Flags{Write: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !dir.hasChanges() {
+		t.Fatal("expected the modified file to be a change")
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if dir.hasChanges() {
+		t.Fatal("expected no changes after the flush")
+	}
+}
+
+func TestAddChildDedup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 1000)
+	if err := dir.AddChild("a", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	err := dir.AddChildWithOpts("b", fi, AddChildOpts{Dedup: DedupError})
+	if !errors.Is(err, ErrDuplicateContent) {
+		t.Fatalf("expected ErrDuplicateContent, got %v", err)
+	}
+
+	var warned []string
+	err = dir.AddChildWithOpts("b", fi, AddChildOpts{
+		Dedup: DedupWarn,
+		OnDuplicate: func(name, existing string) {
+			// Called once added, it can call back into the directory.
+			if _, err := dir.Child(name); err != nil {
+				t.Errorf("duplicate %s not added: %s", name, err)
+			}
+			warned = append(warned, name, existing)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warned) != 2 || warned[0] != "b" || warned[1] != "a" {
+		t.Fatalf("expected a warning for b duplicating a, got %v", warned)
+	}
+
+	// Unflushed changes of cached entries are considered.
+	sub := mkdirP(t, dir, "sub")
+	if err := sub.AddChild("x", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	subnd, err := sub.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dir.AddChildWithOpts("sub2", subnd, AddChildOpts{Dedup: DedupError})
+	if !errors.Is(err, ErrDuplicateContent) {
+		t.Fatalf("expected ErrDuplicateContent, got %v", err)
+	}
+
+	if err := dir.AddChildWithOpts("c", getRandFile(t, ds, 1000), AddChildOpts{Dedup: DedupError}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadDirEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "adir")
+	if err := dir.AddChild("afile", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	sdata, err := ft.SymlinkData("afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("alink", dag.NodeWithData(sdata)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := dir.ReadDirEntries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name() != e.Name() || info.IsDir() != e.IsDir() || info.Mode().Type() != e.Type() {
+			t.Fatalf("info of %s doesn't match its entry", e.Name())
+		}
+
+		switch e.Name() {
+		case "adir":
+			if !e.IsDir() || e.Type() != os.ModeDir {
+				t.Fatal("expected adir to be a directory")
+			}
+			if info.ModTime().IsZero() {
+				t.Fatal("expected adir to have a modification time")
+			}
+		case "afile":
+			if e.IsDir() || e.Type() != 0 {
+				t.Fatal("expected afile to be a regular file")
+			}
+			if info.Size() != 1000 {
+				t.Fatalf("expected afile of size 1000, got %d", info.Size())
+			}
+		case "alink":
+			if e.Type() != os.ModeSymlink {
+				t.Fatal("expected alink to be a symlink")
+			}
+		default:
+			t.Fatalf("unexpected entry %s", e.Name())
+		}
+	}
+}
+
+// concurrencyDagServ records the maximum number of concurrent `Add` calls.
+type concurrencyDagServ struct {
+	ipld.DAGService
+
+	lk      sync.Mutex
+	running int
+	max     int
+}
+
+func (cds *concurrencyDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	cds.lk.Lock()
+	cds.running++
+	if cds.running > cds.max {
+		cds.max = cds.running
+	}
+	cds.lk.Unlock()
+
+	time.Sleep(time.Millisecond)
+
+	cds.lk.Lock()
+	cds.running--
+	cds.lk.Unlock()
+	return cds.DAGService.Add(ctx, nd)
+}
+
+func TestMaxConcurrentAdds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cds := &concurrencyDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, cds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.MaxConcurrentAdds = 2
+
+	var dirs []*Directory
+	for i := 0; i < 10; i++ {
+		dirs = append(dirs, mkdirP(t, rt.GetDirectory(), fmt.Sprintf("d%d/sub", i)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(dirs))
+	for _, d := range dirs {
+		wg.Add(1)
+		go func(d *Directory) {
+			defer wg.Done()
+			errs <- d.AddChild("afile", dag.NodeWithData(ft.FilePBData([]byte("data"), 4)))
+		}(d)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cds.max > 2 {
+		t.Fatalf("expected at most 2 concurrent adds, got %d", cds.max)
+	}
+}
+
+func TestStat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	d := mkdirP(t, rt.GetDirectory(), "a/b")
+	fi := getRandFile(t, ds, 1000)
+	if err := d.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	nl, err := Stat(ctx, rt, "/a/b/afile", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nl.Name != "afile" || nl.Type != int(TFile) || nl.Size != 1000 || nl.Hash != fi.Cid().String() {
+		t.Fatalf("unexpected file listing: %+v", nl)
+	}
+
+	nl, err = Stat(ctx, rt, "/a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nl.Name != "a" || nl.Type != int(TDir) || nl.Size != 0 {
+		t.Fatalf("unexpected directory listing: %+v", nl)
+	}
+
+	nl, err = Stat(ctx, rt, "/a/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nl.Size <= 1000 {
+		t.Fatalf("expected the cumulative size of a to include afile, got %d", nl.Size)
+	}
+
+	nl, err = Stat(ctx, rt, "/", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nl.Name != "/" || nl.Type != int(TDir) {
+		t.Fatalf("unexpected root listing: %+v", nl)
+	}
+
+	if _, err := Stat(ctx, rt, "/a/missing", false); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "a")
+	// Dangling, relative targets are preserved literally.
+	if err := Symlink(rt, "/a/link", "../missing/target"); err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := Readlink(rt, "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../missing/target" {
+		t.Fatalf("expected target %q, got %q", "../missing/target", target)
+	}
+
+	if err := Symlink(rt, "/a/link", "other"); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	if _, err := Readlink(rt, "/a"); err == nil {
+		t.Fatal("expected a directory not to be a symlink")
+	}
+
+	// Reloaded from the DAG.
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+	target, err = Readlink(rt, "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../missing/target" {
+		t.Fatalf("expected target %q after reload, got %q", "../missing/target", target)
+	}
+
+	// Symlinks can't be opened, the failed opens release their locks.
+	if _, err := OpenFile(ctx, rt, "/a/link", os.O_RDONLY); err == nil {
+		t.Fatal("expected opening a symlink to fail")
+	}
+	link, err := Lookup(rt, "/a/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := link.(*File).Open(Flags{Read: true}); err == nil {
+		t.Fatal("expected opening a symlink to fail")
+	}
+	if _, err := link.(*File).Open(Flags{Write: true}); err == nil {
+		t.Fatal("expected opening a symlink to fail")
+	}
+}
+
+func TestUnlinkDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "full/sub")
+	mkdirP(t, dir, "empty")
+	if err := dir.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.UnlinkDir("full", false); err != ErrDirNotEmpty {
+		t.Fatalf("expected ErrDirNotEmpty, got %v", err)
+	}
+	if err := dir.UnlinkDir("empty", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.UnlinkDir("afile", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.UnlinkDir("missing", false); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := dir.UnlinkDir("full", true); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("expected no entries left, got %v", names)
+	}
+}
+
+func TestLastFlush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	if _, _, ok := rt.LastFlush(); ok {
+		t.Fatal("expected no flush yet")
+	}
+
+	before := time.Now()
+	mkdirP(t, rt.GetDirectory(), "a")
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	c, when, ok := rt.LastFlush()
+	if !ok {
+		t.Fatal("expected a flush")
+	}
+	nd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Equals(nd.Cid()) {
+		t.Fatalf("expected last flush to be %s, got %s", nd.Cid(), c)
+	}
+	if when.Before(before) {
+		t.Fatal("flush time is too early")
+	}
+
+	// Propagated from a descendant.
+	b := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	c2, _, _ := rt.LastFlush()
+	if c2.Equals(c) {
+		t.Fatal("expected the propagated update to be recorded")
+	}
+}
+
+func TestFindLargeFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	b := mkdirP(t, dir, "a/b")
+	for name, size := range map[string]int64{"small": 10, "medium": 5000} {
+		if err := dir.AddChild(name, getRandFile(t, ds, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.AddChild("big", getRandFile(t, ds, 300000)); err != nil {
+		t.Fatal(err)
+	}
+	raw := dag.NewRawNode(make([]byte, 2000))
+	if err := b.AddChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := FindLargeFiles(ctx, dir, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, nl := range found {
+		names = append(names, nl.Name)
+	}
+	if fmt.Sprint(names) != "[a/b/big medium a/b/raw]" {
+		t.Fatalf("unexpected large files: %v", names)
+	}
+	if found[0].Size != 300000 {
+		t.Fatalf("expected big to have size 300000, got %d", found[0].Size)
+	}
+
+	found, err = FindLargeFiles(ctx, dir, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Name != "a/b/big" {
+		t.Fatalf("expected only a/b/big, got %v", found)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := FindLargeFiles(cctx, dir, 100, 0); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestSwap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "adir")
+	fi := getRandFile(t, ds, 1000)
+	if err := dir.AddChild("afile", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Swap("adir", "missing"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := dir.Swap("adir", "afile"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := assertFileAtPath(ds, dir, fi, "adir"); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dir.Child("afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != sub {
+		t.Fatal("expected the cached directory to be swapped")
+	}
+	if sub.Path() != "/afile" {
+		t.Fatalf("expected the directory to be renamed, got %s", sub.Path())
+	}
+
+	// Updates of the swapped directory reach its new entry.
+	mkdirP(t, sub, "child")
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DirLookup(dir, "afile/child"); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, dir, fi, "adir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// With case folding the entries keep the spelling they are stored with.
+	rt.CaseInsensitive = true
+	if err := dir.Swap("ADIR", "afile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Swap("afile", "AFILE"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[adir afile]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	if err := assertFileAtPath(ds, dir, fi, "afile"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// slowDagServ delays every `Get` recording how many run concurrently.
+type slowDagServ struct {
+	ipld.DAGService
+
+	lk      sync.Mutex
+	running int
+	max     int
+}
+
+func (sds *slowDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	sds.lk.Lock()
+	sds.running++
+	if sds.running > sds.max {
+		sds.max = sds.running
+	}
+	sds.lk.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	sds.lk.Lock()
+	sds.running--
+	sds.lk.Unlock()
+	return sds.DAGService.Get(ctx, c)
+}
+
+func TestForEachEntryPrefetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sds := &slowDagServ{DAGService: getDagserv(t)}
+
+	dir := emptyDirNode()
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("file%02d", i)
+		fnd := getRandFile(t, sds, 100)
+		if err := dir.AddNodeLink(name, fnd); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := sds.Add(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRoot(ctx, sds, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mkdirP(t, rt.GetDirectory(), "zdir")
+	names = append(names, "zdir")
+
+	var listed []string
+	err = rt.GetDirectory().ForEachEntryWithOptions(ctx, ListOptions{Prefetch: 4}, func(nl NodeListing) error {
+		listed = append(listed, nl.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(names) {
+		t.Fatalf("expected %v, got %v", names, listed)
+	}
+	if sds.max < 2 || sds.max > 4 {
+		t.Fatalf("expected between 2 and 4 concurrent fetches, got %d", sds.max)
+	}
+	if len(rt.GetDirectory().CachedChildren()) != len(names) {
+		t.Fatal("expected the prefetched entries to be cached")
+	}
+
+	// Stopping early.
+	stop := errors.New("stop")
+	err = rt.GetDirectory().ForEachEntryWithOptions(ctx, ListOptions{Prefetch: 4}, func(NodeListing) error {
+		return stop
+	})
+	if err != stop {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+}
+
+func TestEmptyRoot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	rt, err := EmptyRoot(ctx, ds, dag.V1CidPrefix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Version() != 1 {
+		t.Fatalf("expected a CIDv1 root, got %s", nd.Cid())
+	}
+	if _, err := ds.Get(ctx, nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := dir.IsEmpty(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !empty {
+		t.Fatal("expected the root to be empty")
+	}
+
+	mkdirP(t, dir, "a")
+	empty, err = dir.IsEmpty(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if empty {
+		t.Fatal("expected the root not to be empty")
+	}
+}
+
+type recordingLogger struct {
+	lk     sync.Mutex
+	events []string
+}
+
+func (rl *recordingLogger) record(format string, args ...interface{}) {
+	rl.lk.Lock()
+	defer rl.lk.Unlock()
+	rl.events = append(rl.events, fmt.Sprintf(format, args...))
+}
+
+func (rl *recordingLogger) ShardingSwitched(path string, entries int) {
+	rl.record("shard %s %d", path, entries)
+}
+
+func (rl *recordingLogger) FlushStarted() {
+	rl.record("flush start")
+}
+
+func (rl *recordingLogger) FlushFinished(nodes int, elapsed time.Duration, err error) {
+	rl.record("flush end %t %v", nodes > 0, err)
+}
+
+func (rl *recordingLogger) CacheEvicted(path string) {
+	rl.record("evict %s", path)
+}
+
+func TestEventLogger(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rl := &recordingLogger{}
+	rt.EventLogger = rl
+
+	d := mkdirP(t, rt.GetDirectory(), "a")
+	for _, name := range []string{"x", "y"} {
+		if err := d.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uio.UseHAMTSharding = true
+	err := d.AddChild("z", getRandFile(t, ds, 10))
+	uio.UseHAMTSharding = false
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rt.GetDirectory().Uncache("missing")
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"shard /a 2",
+		"flush start",
+		"flush end true <nil>",
+		"evict /a",
+	}
+	if fmt.Sprint(rl.events) != fmt.Sprint(expected) {
+		t.Fatalf("expected events %q, got %q", expected, rl.events)
+	}
+}
+
+func TestListModifiedSince(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "old")
+	if err := dir.AddChild("oldfile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Now()
+	time.Sleep(time.Millisecond)
+
+	mkdirP(t, dir, "new")
+	if err := dir.AddChild("newfile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loaded (and flushed) but not modified.
+	if _, err := dir.Child("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Written (loaded from the DAG).
+	fd, err := OpenFile(ctx, rt, "/oldfile", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	modified, err := dir.ListModifiedSince(ctx, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, nl := range modified {
+		if nl.ModTime.Before(since) {
+			t.Fatalf("%s has modification time before %s", nl.Name, since)
+		}
+		names = append(names, nl.Name)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[new newfile oldfile]" {
+		t.Fatalf("unexpected modified entries: %v", names)
+	}
+}
+
+func TestAddChildReplaceOtherType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "entry/sub")
+	entry, err := dir.Child("entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 100)
+
+	if err := dir.AddChild("entry", fi); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	// Same type.
+	if err := dir.AddChildWithOpts("entry", emptyDirNode(), AddChildOpts{ReplaceOtherType: true}); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+
+	if err := dir.AddChildWithOpts("entry", fi, AddChildOpts{ReplaceOtherType: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := assertFileAtPath(ds, dir, fi, "entry"); err != nil {
+		t.Fatal(err)
+	}
+	if cached := entry.(*Directory).CachedChildren(); len(cached) != 0 {
+		t.Fatalf("expected the replaced subtree to be uncached, got %v", cached)
+	}
+
+	// And back.
+	if err := dir.AddChildWithOpts("entry", emptyDirNode(), AddChildOpts{ReplaceOtherType: true}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dir.Child("entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsDir(c) {
+		t.Fatal("expected entry to be a directory")
+	}
+	if _, err := DirLookup(dir, "entry/sub"); err != os.ErrNotExist {
+		t.Fatalf("expected the old subtree to be gone, got %v", err)
+	}
+}
+
+type mutationLog struct {
+	lk      sync.Mutex
+	entries []Mutation
+}
+
+func (ml *mutationLog) LogMutation(m Mutation) {
+	ml.lk.Lock()
+	defer ml.lk.Unlock()
+	ml.entries = append(ml.entries, m)
+}
+
+func TestReplayLog(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	ml := &mutationLog{}
+	rt.MutationLogger = ml
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b")
+	if err := PutNode(rt, "/a/b/afile", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := PutNode(rt, "/a/other", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/a/b/afile", "/a/moved"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Swap("moved", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChildWithOpts("b", getRandFile(t, ds, 10), AddChildOpts{ReplaceOtherType: true}); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := OpenFile(ctx, rt, "/a/other", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("appended")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if last := ml.entries[len(ml.entries)-1]; last.Op != MutationWrite || last.Path != "/a/other" {
+		t.Fatalf("expected the write to be logged last, got: %+v", last)
+	}
+	if _, err := a.UpdateFileContent(ctx, "moved", strings.NewReader("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if last := ml.entries[len(ml.entries)-1]; last.Op != MutationWrite || last.Path != "/a/moved" {
+		t.Fatalf("expected the update to be logged last, got: %+v", last)
+	}
+	// Directories created from a template are replayed with its entries.
+	if err := dir.SetTemplate(map[string]ipld.Node{".keep": getRandFile(t, ds, 10)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mkdir(rt, "/p", MkdirOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.SetTemplate(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range ml.entries {
+		if m.Time.IsZero() {
+			t.Fatalf("mutation of %s not timestamped", m.Path)
+		}
+	}
+	if ml.entries[0].Op != MutationMkdir || ml.entries[0].Path != "/a" {
+		t.Fatalf("unexpected first mutation: %+v", ml.entries[0])
+	}
+
+	expected, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt2, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayLog(ctx, rt2, ml.entries); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := rt2.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Cid().Equals(expected.Cid()) {
+		t.Fatalf("replayed root %s doesn't match %s", replayed.Cid(), expected.Cid())
+	}
+}
+
+func TestFlushSelf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	b := mkdirP(t, rt.GetDirectory(), "a/b")
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	persisted, err := rt.GetDirectory().GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.AddChild("afile", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := b.FlushSelf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds.Get(ctx, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not propagated.
+	pnd, err := rt.GetDirectory().GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pnd.Cid().Equals(persisted.Cid()) {
+		t.Fatal("FlushSelf shouldn't propagate to the ancestors")
+	}
+	if !b.hasChanges() {
+		t.Fatal("expected the directory to stay dirty")
+	}
+
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pnd, err = rt.GetDirectory().GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bnd, err := resolveDagPath(ctx, ds, pnd, "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bnd.Cid().Equals(c) {
+		t.Fatal("expected the staged node to be propagated by Flush")
+	}
+}
+
+func TestCycleDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	mkdirP(t, rt.GetDirectory(), "a/b")
+	for _, dst := range []string{"/a/b/c", "/a/b/", "/a/c", "/a"} {
+		if err := Mv(rt, "/a", dst); err != ErrCycleDetected {
+			t.Fatalf("moving /a to %s: expected ErrCycleDetected, got %v", dst, err)
+		}
+	}
+	if _, err := Lookup(rt, "/a/b"); err != nil {
+		t.Fatal("failed moves shouldn't modify the tree")
+	}
+	if err := Mv(rt, "/a/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rnd, err := rt.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChildWithOpts("root", rnd, AddChildOpts{RejectAncestors: true}); err != ErrCycleDetected {
+		t.Fatalf("expected ErrCycleDetected, got %v", err)
+	}
+	if err := a.AddChild("root", rnd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileStat(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("proto", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("raw", dag.NewRawNode([]byte("raw data"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/link", "proto"); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func(name string) FileInfo {
+		t.Helper()
+		c, err := dir.Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.(*File).Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	if info := stat("proto"); info.Size != 1000 || info.Mode != 0644 || info.RawLeaves || !info.ModTime.IsZero() {
+		t.Fatalf("unexpected stat of proto: %+v", info)
+	}
+	if info := stat("raw"); info.Size != 8 || !info.RawLeaves {
+		t.Fatalf("unexpected stat of raw: %+v", info)
+	}
+	if info := stat("link"); info.Mode&os.ModeSymlink == 0 {
+		t.Fatalf("unexpected stat of link: %+v", info)
+	}
+
+	// The leaves of a multi-level DAG are found below its root.
+	dbp := &helpers.DagBuilderParams{Dagserv: ds, Maxlinks: 4, RawLeaves: true}
+	db, err := dbp.New(chunker.NewSizeSplitter(bytes.NewReader(make([]byte, 100)), 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deep, err := balanced.Layout(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deep.Links()[0].Cid.Type() == cid.Raw {
+		t.Fatal("expected the root to link to internal nodes")
+	}
+	if err := dir.AddChild("deep", deep); err != nil {
+		t.Fatal(err)
+	}
+	if info := stat("deep"); info.Size != 100 || !info.RawLeaves {
+		t.Fatalf("unexpected stat of deep: %+v", info)
+	}
+
+	fd, err := OpenFile(ctx, rt, "/proto", os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if info := stat("proto"); info.Size != 1004 || info.ModTime.IsZero() {
+		t.Fatalf("unexpected stat of proto after writing: %+v", info)
+	}
+}
+
+func TestFileReadAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 1024*1024)
+	u.NewTimeSeededRand().Read(data)
+	if err := rt.GetDirectory().AddChild("afile", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.GetDirectory().Child("afile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := c.(*File)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 1000)
+			n, err := fi.ReadAt(buf, off)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if n != len(buf) || !bytes.Equal(buf, data[off:off+1000]) {
+				errs <- fmt.Errorf("wrong data read at %d", off)
+			}
+		}(int64(i) * 100000)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	n, err := fi.ReadAt(buf, int64(len(data)-10))
+	if err != io.EOF || n != 10 || !bytes.Equal(buf[:n], data[len(data)-10:]) {
+		t.Fatalf("expected a short read of 10 bytes with EOF, got %d (%v)", n, err)
+	}
+	if _, err := fi.ReadAt(buf, int64(len(data))); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestListGrouped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	for _, name := range []string{"d1", "d2"} {
+		mkdirP(t, dir, name)
+	}
+	for _, name := range []string{"f1", "f2", "f3"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dirs, files, err := dir.ListGrouped(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 2 || len(files) != 3 {
+		t.Fatalf("expected 2 directories and 3 files, got %d and %d", len(dirs), len(files))
+	}
+	for _, nl := range dirs {
+		if nl.Type != int(TDir) {
+			t.Fatalf("%s is not a directory", nl.Name)
+		}
+	}
+	for _, nl := range files {
+		if nl.Type != int(TFile) {
+			t.Fatalf("%s is not a file", nl.Name)
+		}
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	html := fileNodeFromReader(t, ds, bytes.NewReader([]byte("<html><body>hello</body></html>")))
+	if err := rt.GetDirectory().AddChild("page", html); err != nil {
+		t.Fatal(err)
+	}
+	c, err := rt.GetDirectory().Child("page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := c.(*File)
+
+	ctype, err := fi.DetectContentType(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctype != "text/html; charset=utf-8" {
+		t.Fatalf("expected text/html, got %s", ctype)
+	}
+
+	// Detected again once the content changes.
+	fd, err := OpenFile(ctx, rt, "/page", os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("%PDF-1.4 ...")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ctype, err = fi.DetectContentType(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctype != "application/pdf" {
+		t.Fatalf("expected application/pdf, got %s", ctype)
+	}
+}
+
+// ctxDagServ fails the operations made with a cancelled context.
+type ctxDagServ struct {
+	ipld.DAGService
+}
+
+func (cds *ctxDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return cds.DAGService.Get(ctx, c)
+}
+
+func (cds *ctxDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return cds.DAGService.Add(ctx, nd)
+}
+
+func TestDirectoryContextOverloads(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &ctxDagServ{getDagserv(t)}
+
+	rctx, rcancel := context.WithCancel(ctx)
+	rt, err := NewRoot(rctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a")
+
+	// The construction context no longer affects the overloads.
+	rcancel()
+	if _, err := dir.Mkdir("b"); err == nil {
+		t.Fatal("expected the construction context to fail Mkdir")
+	}
+	if _, err := dir.MkdirContext(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChildContext(ctx, "afile", getRandFile(t, ds, 100), AddChildOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.UnlinkContext(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading the (uncached) added file fetches it.
+	if _, err := dir.Child("afile"); err == nil {
+		t.Fatal("expected the construction context to fail Child")
+	}
+	if _, err := dir.ChildContext(ctx, "afile"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChildContext(ctx, "other", getRandFile(t, ds, 100), AddChildOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.SwapContext(ctx, "afile", "other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.UnlinkDirContext(ctx, "other", false); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[afile b]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+}
+
+func TestProofPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.ShardWidth = 16
+
+	uio.UseHAMTSharding = true
+	defer func() { uio.UseHAMTSharding = false }()
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b")
+	sharded, err := dir.Mkdir("sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := getRandFile(t, ds, 100)
+	for i := 0; i < 300; i++ {
+		if err := sharded.AddChild(fmt.Sprintf("file%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rt.GetDirectory().Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkProof := func(pth string, min int) {
+		proof, err := dir.ProofPath(ctx, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof) < min {
+			t.Fatalf("%s: expected at least %d nodes, got %d", pth, min, len(proof))
+		}
+		for i := 0; i+1 < len(proof); i++ {
+			nd, err := ds.Get(ctx, proof[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			linked := false
+			for _, l := range nd.Links() {
+				linked = linked || l.Cid.Equals(proof[i+1])
+			}
+			if !linked {
+				t.Fatalf("%s: node %d doesn't link to node %d", pth, i, i+1)
+			}
+		}
+		if !proof[len(proof)-1].Equals(fi.Cid()) && pth != "a/b" {
+			t.Fatalf("%s: expected proof to end at the file", pth)
+		}
+	}
+
+	checkProof("a/b", 3)
+	for i := 0; i < 300; i += 37 {
+		// Root, the sharded directory, at least one internal shard and the file.
+		checkProof(fmt.Sprintf("/sharded/file%d", i), 4)
+	}
+
+	if _, err := dir.ProofPath(ctx, "sharded/nope"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := dir.ProofPath(ctx, "a/nope"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	// Unflushed changes are proven without flushing them.
+	persisted, err := dir.GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := lookupDir(rt, "/a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := getRandFile(t, ds, 100)
+	if err := b.AddChild("fresh", fresh); err != nil {
+		t.Fatal(err)
+	}
+	proof, err := dir.ProofPath(ctx, "a/b/fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proof) != 4 || !proof[3].Equals(fresh.Cid()) {
+		t.Fatalf("unexpected proof of the unflushed entry: %v", proof)
+	}
+	if proof[0].Equals(persisted.Cid()) {
+		t.Fatal("expected the proof to start at the current root node")
+	}
+	if !dir.hasChanges() {
+		t.Fatal("expected ProofPath not to flush the tree")
+	}
+	if _, err := ds.Get(ctx, proof[0]); err == nil {
+		t.Fatal("expected the current root node not to be stored")
+	}
+}
+
+func TestRenameEach(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "A/sub")
+	for _, name := range []string{"B", "c", "Skip"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub, err := dir.Child("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "B" and "c" would both be renamed to "x", nothing should change.
+	err = dir.RenameEach(func(name string) (string, bool) {
+		if strings.ToLower(name) == name || name == "B" {
+			return "x", true
+		}
+		return name, false
+	})
+	if err == nil {
+		t.Fatal("expected a collision error")
+	}
+	err = dir.RenameEach(func(name string) (string, bool) {
+		if name == "B" {
+			return "c", true
+		}
+		return name, true
+	})
+	if err == nil {
+		t.Fatal("expected a collision with an entry left in place")
+	}
+	after, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !before.Cid().Equals(after.Cid()) {
+		t.Fatal("failed renames modified the directory")
+	}
+
+	// A cycle of renames plus a plain one.
+	err = dir.RenameEach(func(name string) (string, bool) {
+		switch name {
+		case "B":
+			return "c", true
+		case "c":
+			return "B", true
+		case "A":
+			return "a", true
+		}
+		return "ignored", false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[B Skip a c]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	renamed, err := dir.Child("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renamed != sub {
+		t.Fatal("expected the cached directory to be kept")
+	}
+	if _, err := DirLookup(rt.GetDirectory(), "/a/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if sub.(*Directory).Path() != "/a" {
+		t.Fatalf("unexpected path: %s", sub.(*Directory).Path())
+	}
+
+	// The callback can inspect the directory, renaming the directories.
+	err = dir.RenameEachContext(ctx, func(name string) (string, bool) {
+		c, err := dir.Child(name)
+		if err != nil {
+			t.Error(err)
+			return name, false
+		}
+		return "dir-" + name, c.Type() == TDir
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := assertDirAtPath(rt.GetDirectory(), "dir-a", []string{"sub"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries changed while mapping the names aren't renamed.
+	err = dir.RenameEach(func(name string) (string, bool) {
+		if name == "B" {
+			if err := dir.Unlink("Skip"); err != nil {
+				t.Error(err)
+			}
+		}
+		return name + "-renamed", true
+	})
+	if err == nil {
+		t.Fatal("expected the change of the entries to be detected")
+	}
+	if _, err := dir.Child("B"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirCache(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+	rt.DirCacheSize = 2
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b")
+	mkdirP(t, dir, "c")
+	mkdirP(t, dir, "d/d")
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	children := make(map[string]FSNode)
+	for _, name := range []string{"a", "c", "d"} {
+		c, err := dir.Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children[name] = c
+	}
+
+	dir.Uncache("a")
+	if got, err := dir.Child("a"); err != nil || got != children["a"] {
+		t.Fatal("expected the evicted directory to be reused")
+	}
+
+	// Evicting more directories than the cache holds drops the oldest ones.
+	for _, name := range []string{"a", "c", "d"} {
+		dir.Uncache(name)
+	}
+	for name, reused := range map[string]bool{"a": false, "c": true, "d": true} {
+		got, err := dir.Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (got == children[name]) != reused {
+			t.Fatalf("%s: expected reuse to be %t", name, reused)
+		}
+		children[name] = got
+	}
+
+	// A directory modified after being evicted isn't reused.
+	c := children["c"].(*Directory)
+	dir.Uncache("c")
+	oldCid := c.flushedCid
+	if _, err := c.Mkdir("e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if cached := dir.evictedDir("c", oldCid); cached != nil {
+		t.Fatal("expected the modified directory to be invalidated")
+	}
+	got, err := dir.Child("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == children["c"] {
+		t.Fatal("unexpected reuse of a modified directory")
+	}
+	if _, err := DirLookup(dir, "/c/e"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type getCountDagServ struct {
+	ipld.DAGService
+	lock sync.Mutex
+	gets map[cid.Cid]int
+}
+
+func (gds *getCountDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	gds.lock.Lock()
+	gds.gets[c]++
+	gds.lock.Unlock()
+	return gds.DAGService.Get(ctx, c)
+}
+
+func TestExportManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &getCountDagServ{DAGService: getDagserv(t), gets: make(map[cid.Cid]int)}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := rt.GetDirectory()
+	a := mkdirP(t, dir, "a")
+	big := getRandFile(t, ds, 1024*1024)
+	if err := a.AddChild("big", big); err != nil {
+		t.Fatal(err)
+	}
+	raw := dag.NewRawNode([]byte("hello"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/a/link", "big"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := ExportManifest(ctx, dir, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e ManifestEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %s %d", e.Path, e.Type, e.Size))
+		if e.Path == "a/big" && e.Cid != big.Cid().String() {
+			t.Fatalf("unexpected cid for a/big: %s", e.Cid)
+		}
+	}
+	sort.Strings(got)
+	expected := []string{"a directory 0", "a/big file 1048576", "a/link symlink 0", "raw file 5"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	if ds.gets[raw.Cid()] != 0 {
+		t.Fatal("raw leaf fetched")
+	}
+	for _, l := range big.Links() {
+		if ds.gets[l.Cid] != 0 {
+			t.Fatal("file contents fetched")
+		}
+	}
+}
+
+func TestMaxOpenReaders(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.MaxOpenReaders = 1
+
+	dir := rt.GetDirectory()
+	for _, name := range []string{"file", "other"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := dir.Child("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := fi.(*File)
+	fi, err = dir.Child("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := fi.(*File)
+
+	rfd, err := file.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tctx, tcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer tcancel()
+	if _, err := file.OpenContext(tctx, Flags{Read: true}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the second reader to time out, got %v", err)
+	}
+
+	// The holder of the slot reading the same file doesn't need another.
+	if _, err := file.ReadAtContext(tctx, make([]byte, 10), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.DetectContentType(tctx); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := other.ReadAt(make([]byte, 10), 0)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("ReadAt didn't wait for a reader slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := rfd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "c")
+	if err := dir.AddChild("e", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before, _, _ := rt.LastFlush()
+
+	ml := &mutationLog{}
+	rt.MutationLogger = ml
+
+	// The last operation fails, nothing is applied.
+	b := NewBatch(rt)
+	b.Mkdir("/a/b", MkdirOpts{Mkparents: true})
+	b.Mv("/c", "/d")
+	b.Remove("/e")
+	b.Remove("/missing")
+	if err := b.Commit(ctx); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the batch to fail with os.ErrNotExist, got %v", err)
+	}
+	if len(ml.entries) != 0 {
+		t.Fatalf("failed batch logged mutations: %v", ml.entries)
+	}
+
+	// Operations are validated against the ones before them.
+	for _, ops := range []func(b *Batch){
+		func(b *Batch) { b.Mv("/c", "/d"); b.Remove("/c") },
+		func(b *Batch) { b.Remove("/c"); b.Mkdir("/c/x", MkdirOpts{}) },
+		func(b *Batch) { b.Mkdir("/x", MkdirOpts{}); b.Mv("/x", "/x/y") },
+		func(b *Batch) { b.Mv("/e", "/c/"); b.Remove("/e") },
+	} {
+		b := NewBatch(rt)
+		ops(b)
+		if err := b.Commit(ctx); err == nil {
+			t.Fatal("expected the batch to fail")
+		}
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[c e]" {
+		t.Fatalf("failed batch modified the tree: %v", names)
+	}
+	if after, _, _ := rt.LastFlush(); !after.Equals(before) {
+		t.Fatal("failed batch flushed the root")
+	}
+
+	if len(ml.entries) != 0 {
+		t.Fatalf("failed batches logged mutations: %v", ml.entries)
+	}
+
+	// A change made before the commit, outside the batch, is kept.
+	if err := dir.AddChild("g", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	ml.entries = nil
+
+	b = NewBatch(rt)
+	b.Mkdir("/a/b", MkdirOpts{Mkparents: true})
+	b.Mv("/c", "/d")
+	b.Mkdir("/d/f", MkdirOpts{})
+	b.Mv("/e", "/d/f/")
+	b.Mv("/a", "/d/f/a")
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names, err = dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[d g]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	for _, p := range []string{"/d/f/e", "/d/f/a/b"} {
+		if _, err := Lookup(rt, p); err != nil {
+			t.Fatalf("%s: %s", p, err)
+		}
+	}
+	if len(ml.entries) == 0 {
+		t.Fatal("expected the batch to log its mutations")
+	}
+	last, _, _ := rt.LastFlush()
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equals(nd.Cid()) {
+		t.Fatal("expected the batch to be flushed")
+	}
+
+	// The depth of a moved subtree is only checked when applying the
+	// move, the steps applied by then are undone.
+	mkdirP(t, dir, "p/q")
+	rt.MaxDepth = 3
+	ml.entries = nil
+	b = NewBatch(rt)
+	b.Mkdir("/n/m", MkdirOpts{Mkparents: true})
+	b.Remove("/g")
+	b.Mv("/p", "/n/m/p")
+	if err := b.Commit(ctx); !errors.Is(err, ErrTooDeep) {
+		t.Fatalf("expected ErrTooDeep, got %v", err)
+	}
+	if len(ml.entries) != 0 {
+		t.Fatalf("failed batch logged mutations: %v", ml.entries)
+	}
+	names, err = dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[d g p]" {
+		t.Fatalf("failed batch modified the tree: %v", names)
+	}
+	if _, err := Lookup(rt, "/p/q"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecomputeSizes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	fi := getRandFile(t, ds, 1000)
+	sub := ft.EmptyDirNode()
+	if err := sub.AddRawLink("f", &ipld.Link{Size: 1, Cid: fi.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	old := ft.EmptyDirNode()
+	if err := old.AddRawLink("sub", &ipld.Link{Size: 2, Cid: sub.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.AddRawLink("f", &ipld.Link{Size: 3, Cid: fi.Cid()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AddMany(ctx, []ipld.Node{sub, old}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("old", old); err != nil {
+		t.Fatal(err)
+	}
+	d, err := dir.Child("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RecomputeSizes(ctx, d.(*Directory)); err != nil {
+		t.Fatal(err)
+	}
+
+	var check func(nd ipld.Node)
+	check = func(nd ipld.Node) {
+		for _, l := range nd.Links() {
+			cnd, err := l.GetNode(ctx, ds)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := cnd.Size()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.Size != size {
+				t.Fatalf("link %s: expected size %d, got %d", l.Name, size, l.Size)
+			}
+			if isDirNode(cnd) {
+				check(cnd)
+			}
+		}
+	}
+	rnd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(rnd)
+
+	f, err := DirLookup(dir, "/old/sub/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnd, err := f.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fnd.Cid().Equals(fi.Cid()) {
+		t.Fatal("files shouldn't be rewritten")
+	}
+}
+
+func TestAddChildUnchecked(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	for i := 0; i < 50; i++ {
+		if err := dir.AddChildUnchecked(fmt.Sprintf("file%d", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dir.AddChildUnchecked("dir", ft.EmptyDirNode()); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChildUnchecked("", fi); err == nil {
+		t.Fatal("expected an empty name to be rejected")
+	}
+	if err := dir.AddChildUnchecked("a/b", fi); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	// As with the checked entry points.
+	if err := dir.AddChild("a/b", fi); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	if _, err := dir.Mkdir("x/y"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 51 {
+		t.Fatalf("expected 51 entries, got %d", len(names))
+	}
+
+	// An existing entry is replaced.
+	other := getRandFile(t, ds, 200)
+	if err := dir.AddChildUnchecked("file0", other); err != nil {
+		t.Fatal(err)
+	}
+	c, err := dir.Child("file0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := c.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nd.Cid().Equals(other.Cid()) {
+		t.Fatal("expected file0 to be replaced")
+	}
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEmptyDirs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b/c")
+	mkdirP(t, dir, "a/d")
+	mkdirP(t, dir, "e")
+	f := mkdirP(t, dir, "f/g")
+	if err := f.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	empty, err := FindEmptyDirs(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(empty) != "[a/b/c a/d e]" {
+		t.Fatalf("unexpected empty directories: %v", empty)
+	}
+
+	n, err := dir.PruneEmptyDirs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a/b/c, a/b (left empty), a/d, a (left empty) and e.
+	if n != 5 {
+		t.Fatalf("expected 5 directories pruned, got %d", n)
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(names) != "[f]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	if _, err := DirLookup(dir, "/f/g/file"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.CaseInsensitive = true
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "Docs")
+	if err := dir.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.AddChild("FILE", getRandFile(t, ds, 100)); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+	if _, err := dir.Mkdir("docs"); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	if _, err := DirLookup(dir, "/DOCS"); err != nil {
+		t.Fatal(err)
+	}
+	err := dir.RenameEach(func(name string) (string, bool) {
+		return "Docs", name == "file"
+	})
+	if err == nil {
+		t.Fatal("expected a collision differing in case")
+	}
+
+	// Replacing keeps a single entry, with the new name.
+	if err := dir.AddChildWithOpts("FILE", ft.EmptyDirNode(), AddChildOpts{ReplaceOtherType: true}); err != nil {
+		t.Fatal(err)
+	}
+	docs, err := lookupDir(rt, "/Docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/Docs", "/docs"); err != nil {
+		t.Fatal(err)
+	}
+	names, err := dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[FILE docs]" {
+		t.Fatalf("unexpected entries: %v", names)
+	}
+	// The entry is renamed in place.
+	if c, err := dir.Child("docs"); err != nil || c != FSNode(docs) || entryName(docs) != "docs" {
+		t.Fatalf("expected the cached directory to be renamed, got %v", err)
+	}
+
+	// Collisions are checked with the same folding as lookups.
+	if err := dir.AddChild("σ", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Child("ς"); err != nil {
+		t.Fatal(err)
+	}
+	err = dir.RenameEach(func(name string) (string, bool) {
+		return "ς", name == "FILE"
+	})
+	if err == nil {
+		t.Fatal("expected a collision differing in case")
+	}
+
+	if ok, err := dir.PathExists(ctx, "DOCS"); err != nil || !ok {
+		t.Fatalf("expected the entry to exist, got %v", err)
+	}
+	if err := dir.Unlink("DOCS"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := dir.PathExists(ctx, "docs"); err != nil || ok {
+		t.Fatalf("expected the entry to be removed, got %v", err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.ScrubReadsPerSecond = 1000
+
+	a := mkdirP(t, rt.GetDirectory(), "a")
+	fi := getRandFile(t, ds, 1024*1024)
+	if err := a.AddChild("file", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	leaf := fi.Links()[1].Cid
+	if err := ds.Remove(ctx, leaf); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan FsckError, 10)
+	stop := rt.StartScrub(ctx, 10*time.Millisecond, func(e FsckError) {
+		select {
+		case errs <- e:
+		default:
+		}
+	})
+	defer stop()
+
+	select {
+	case e := <-errs:
+		if e.Path != "/a/file" || !e.Cid.Equals(leaf) {
+			t.Fatalf("unexpected error: %s", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrub didn't report the missing block")
+	}
+	stop()
+}
+
+func TestCaseOnlyRename(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, insensitive := range []bool{false, true} {
+		ds, rt := setupRoot(ctx, t)
+		rt.CaseInsensitive = insensitive
+		dir := rt.GetDirectory()
+
+		fi := getRandFile(t, ds, 100)
+		if err := dir.AddChild("file", fi); err != nil {
+			t.Fatal(err)
+		}
+		mkdirP(t, dir, "dir/sub")
+
+		if err := Mv(rt, "/file", "/File"); err != nil {
+			t.Fatal(err)
+		}
+		if err := Mv(rt, "/dir", "/DIR"); err != nil {
+			t.Fatal(err)
+		}
+		err := dir.RenameEach(func(name string) (string, bool) {
+			return strings.ToLower(name) + "2", name == "DIR"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dir.RenameEach(func(name string) (string, bool) {
+			return "Dir2", name == "dir2"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names, err := dir.ListNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		if fmt.Sprint(names) != "[Dir2 File]" {
+			t.Fatalf("case insensitive %t: unexpected entries: %v", insensitive, names)
+		}
+		if _, err := DirLookup(dir, "/Dir2/sub"); err != nil {
+			t.Fatal(err)
+		}
+		nd, err := dir.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(nd.Links()) != 2 {
+			t.Fatalf("expected 2 links, got %d", len(nd.Links()))
+		}
+	}
+
+	// Moving between different directories with the same name.
+	_, rt := setupRoot(ctx, t)
+	mkdirP(t, rt.GetDirectory(), "a/x")
+	mkdirP(t, rt.GetDirectory(), "b/a")
+	if err := Mv(rt, "/a/x", "/b/a/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/a/x"); err != os.ErrNotExist {
+		t.Fatalf("expected the source to be removed, got %v", err)
+	}
+}
+
+func TestListSortByModTime(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	// Entries loaded from the DAG have an unknown modification time.
+	nd := ft.EmptyDirNode()
+	fi := getRandFile(t, ds, 100)
+	if err := nd.AddNodeLink("old", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Add(ctx, nd); err != nil {
+		t.Fatal(err)
+	}
+	rt, err := NewRoot(ctx, ds, nd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := rt.GetDirectory()
+
+	for _, name := range []string{"c", "b"} {
+		if err := dir.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, unknownLast := range []bool{false, true} {
+		out, err := dir.ListWithOptions(ctx, ListOptions{Sort: SortByModTime, UnknownModTimeLast: unknownLast})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, nl := range out {
+			names = append(names, nl.Name)
+		}
+		expected := "[old c b]"
+		if unknownLast {
+			expected = "[c b old]"
+		}
+		if fmt.Sprint(names) != expected {
+			t.Fatalf("expected %s, got %v", expected, names)
+		}
+	}
+}
+
+func TestDeltaSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	x := mkdirP(t, dir, "a/x")
+	mkdirP(t, dir, "b/y")
+	if err := x.AddChild("f", getRandFile(t, ds, 300*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("gone", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	nda, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rta, err := NewRoot(ctx, ds, nda.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := x.AddChild("g", getRandFile(t, ds, 500*1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Unlink("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("new", getRandFile(t, ds, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	ndb, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := func(nd ipld.Node) map[cid.Cid]int64 {
+		out := map[cid.Cid]int64{nd.Cid(): int64(len(nd.RawData()))}
+		err := dag.EnumerateChildren(ctx, dag.GetLinksWithDAG(ds), nd.Cid(), func(c cid.Cid) bool {
+			if _, ok := out[c]; ok {
+				return false
+			}
+			n, err := ds.Get(ctx, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[c] = int64(len(n.RawData()))
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	inA := blocks(nda)
+	var expected int64
+	for c, size := range blocks(ndb) {
+		if _, ok := inA[c]; !ok {
+			expected += size
+		}
+	}
+
+	delta, err := DeltaSize(ctx, rta.GetDirectory(), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta != expected || delta <= 500*1024 {
+		t.Fatalf("expected %d, got %d", expected, delta)
+	}
+
+	delta, err = DeltaSize(ctx, dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta != 0 {
+		t.Fatalf("expected no delta with itself, got %d", delta)
+	}
+}
+
+func TestDirectoryWriteAt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("file", fileNodeFromReader(t, ds, bytes.NewReader([]byte("hello")))); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func() string {
+		var buf bytes.Buffer
+		if _, err := dir.CopyFileTo(ctx, "file", &buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// At EOF, past it (leaving a zeroed gap) and over existing contents.
+	if n, err := dir.WriteAt(ctx, "file", []byte(" world"), 5); err != nil || n != 6 {
+		t.Fatalf("unexpected write at EOF: %d, %v", n, err)
+	}
+	if _, err := dir.WriteAt(ctx, "file", []byte("!"), 14); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.WriteAt(ctx, "file", []byte("H"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(); got != "Hello world\x00\x00\x00!" {
+		t.Fatalf("unexpected contents: %q", got)
+	}
+
+	// Changes are synced up to the root.
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _, _ := rt.LastFlush()
+	if !last.Equals(nd.Cid()) {
+		t.Fatal("expected the write to be propagated to the root")
+	}
+
+	mkdirP(t, dir, "adir")
+	if _, err := dir.WriteAt(ctx, "adir", []byte("x"), 0); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := dir.WriteAt(ctx, "file", []byte{byte('0' + i)}, 20); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := read(); len(got) != 21 {
+		t.Fatalf("unexpected contents after concurrent writes: %q", got)
+	}
+}
+
+func TestFileBlockCids(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	data := make([]byte, 1024*1024+100)
+	u.NewTimeSeededRand().Read(data)
+	if err := dir.AddChild("big", fileNodeFromReader(t, ds, bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	small := fileNodeFromReader(t, ds, bytes.NewReader([]byte("small")))
+	if err := dir.AddChild("small", small); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := dir.Child("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids, err := fsn.(*File).BlockCids(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 5 {
+		t.Fatalf("expected 5 leaves, got %d", len(cids))
+	}
+	var contents []byte
+	for _, c := range cids {
+		nd, err := ds.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := ft.ReadUnixFSNodeData(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, leaf...)
+	}
+	if !bytes.Equal(contents, data) {
+		t.Fatal("leaves don't make up the contents in order")
+	}
+
+	fsn, err = dir.Child("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids, err = fsn.(*File).BlockCids(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cids) != 1 || !cids[0].Equals(small.Cid()) {
+		t.Fatalf("expected the single node to be its own leaf, got %v", cids)
+	}
+}
+
+func TestAlwaysShard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.AlwaysShard = true
+	rt.ShardWidth = 16
+
+	dir := rt.GetDirectory()
+	a, err := dir.Mkdir("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range []*Directory{a, dir} {
+		nd, err := d.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := ft.ExtractFSNode(nd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fsn.Type() != ft.THAMTShard || fsn.Fanout() != 16 {
+			t.Fatalf("%s: expected a HAMT of width 16, got %s (fanout %d)", d.Path(), fsn.Type(), fsn.Fanout())
+		}
+	}
+	if _, err := DirLookup(dir, "/a/file"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSplitPath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	b := mkdirP(t, dir, "a/b")
+	if err := b.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	for pth, expected := range map[string]string{
+		"/a/b/file": "/a/b file",
+		"a/b/":      "/a b",
+		"//a//b/c":  "/a/b c",
+		"/a":        "/ a",
+	} {
+		parent, name, err := SplitPath(ctx, rt, pth)
+		if err != nil {
+			t.Fatalf("%s: %s", pth, err)
+		}
+		if got := parent.Path() + " " + name; got != expected {
+			t.Fatalf("%s: expected %q, got %q", pth, expected, got)
+		}
+	}
+
+	for _, pth := range []string{"/", "", "/missing/x", "/a/b/file/x"} {
+		if _, _, err := SplitPath(ctx, rt, pth); err == nil {
+			t.Fatalf("%s: expected an error", pth)
+		}
+	}
+}
+
+func TestListWithPrefix(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	uio.UseHAMTSharding = true
+	defer func() { uio.UseHAMTSharding = false }()
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	for _, name := range []string{"foo", "foobar", "fob", "bar", "fo"} {
+		if err := dir.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for prefix, expected := range map[string]string{
+		"foo": "[foo foobar]",
+		"fo":  "[fo fob foo foobar]",
+		"x":   "[]",
+		"":    "[bar fo fob foo foobar]",
+	} {
+		names, err := dir.ListWithPrefix(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(names) != expected {
+			t.Fatalf("prefix %q: expected %s, got %v", prefix, expected, names)
+		}
+	}
+}
+
+func TestFlushDetached(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	a := mkdirP(t, dir, "a")
+	b := mkdirP(t, a, "b")
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Unlink("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChild("file", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Flush(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	// Also when propagating from a descendant.
+	if _, err := b.Mkdir("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Flush(); !errors.Is(err, ErrDetached) {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if _, err := dir.Child("a"); err != os.ErrNotExist {
+		t.Fatalf("expected the directory to stay unlinked, got %v", err)
+	}
+
+	// A directory replaced by another one with the same name.
+	a2 := mkdirP(t, dir, "a")
+	if err := a.Flush(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if err := a2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Also when the new one isn't cached, the stale one isn't resurrected.
+	x := mkdirP(t, dir, "x")
+	if err := dir.Unlink("x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("x", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x.Mkdir("sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Flush(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if fsn, err := dir.Child("x"); err != nil || fsn.Type() != TFile {
+		t.Fatalf("expected x to stay a file, got %v", err)
+	}
+
+	// Only uncached, still attached.
+	dir.Uncache("a")
+	if err := a2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListRecursive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	b := mkdirP(t, dir, "a/b")
+	if err := b.AddChild("f", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("g", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(maxDepth int) []string {
+		entries, err := dir.ListRecursive(ctx, maxDepth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, e := range entries {
+			out = append(out, e.Name)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	for depth, expected := range map[int]string{
+		0: "[a a/b a/b/f g]",
+		1: "[a g]",
+		2: "[a a/b g]",
+		3: "[a a/b a/b/f g]",
+	} {
+		if got := fmt.Sprint(names(depth)); got != expected {
+			t.Fatalf("depth %d: expected %s, got %s", depth, expected, got)
+		}
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	// The CIDs `ipfs add` produces for an empty file.
+	emptyV0 := "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"
+	emptyV1 := "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"
+
+	cidOf := func(pth string) string {
+		fsn, err := Lookup(rt, pth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nd.Cid().String()
+	}
+	readAll := func(pth string) string {
+		fd, err := OpenFile(ctx, rt, pth, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		data, err := ioutil.ReadAll(fd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	dir := rt.GetDirectory()
+	if _, err := dir.AddFileFromReader(ctx, "reader", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := OpenFile(ctx, rt, "/created", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, pth := range []string{"/reader", "/created"} {
+		if c := cidOf(pth); c != emptyV0 {
+			t.Fatalf("%s: expected %s, got %s", pth, emptyV0, c)
+		}
+	}
+
+	v1 := mkdirP(t, dir, "v1")
+	v1.SetCidBuilder(dag.V1CidPrefix())
+	if _, err := v1.AddFileFromReader(ctx, "reader", bytes.NewReader(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if c := cidOf("/v1/reader"); c != emptyV1 {
+		t.Fatalf("expected %s, got %s", emptyV1, c)
+	}
+
+	// Writing to an empty raw file.
+	fd, err = OpenFile(ctx, rt, "/v1/reader", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if data := readAll("/v1/reader"); data != "data" {
+		t.Fatalf("expected %q, got %q", "data", data)
+	}
+
+	rt.EmptyFiles = EmptyFileProto
+	fd, err = OpenFile(ctx, rt, "/v1/created", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := cid.Decode(cidOf("/v1/created")); err != nil || c.Type() != cid.DagProtobuf {
+		t.Fatalf("expected a dag-pb empty file, got %s (%v)", c, err)
+	}
+
+	rt.EmptyFiles = EmptyFileRaw
+	fd, err = OpenFile(ctx, rt, "/raw", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c := cidOf("/raw"); c != emptyV1 {
+		t.Fatalf("expected %s, got %s", emptyV1, c)
+	}
+	if data := readAll("/raw"); data != "" {
+		t.Fatalf("expected empty file, got %q", data)
+	}
+}
+
+func TestListDotEntries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "sub")
+	if err := sub.AddChild("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(l []NodeListing) string {
+		var out []string
+		for _, e := range l {
+			out = append(out, e.Name)
+		}
+		return fmt.Sprint(out)
+	}
+
+	entries, err := sub.ListWithOptions(ctx, ListOptions{IncludeDotEntries: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[. .. f]" {
+		t.Fatalf("expected [. .. f], got %s", got)
+	}
+	for i, d := range []*Directory{sub, dir} {
+		nd, err := d.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entries[i].Hash != nd.Cid().String() || entries[i].Type != int(TDir) {
+			t.Fatalf("wrong listing of %q: %+v", entries[i].Name, entries[i])
+		}
+	}
+
+	entries, err = dir.ListWithOptions(ctx, ListOptions{IncludeDotEntries: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[. sub]" {
+		t.Fatalf("expected [. sub], got %s", got)
+	}
+
+	entries, err = sub.ListWithOptions(ctx, ListOptions{IncludeDotEntries: true, TypeFilter: []NodeType{TFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[f]" {
+		t.Fatalf("expected [f], got %s", got)
+	}
+
+	// The dot entries are the first ones of the window.
+	if err := sub.AddChild("g", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	var pages []string
+	for offset := 0; offset < 5; offset += 2 {
+		entries, err = sub.ListWithOptions(ctx, ListOptions{IncludeDotEntries: true, Sort: SortByName, Offset: offset, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, names(entries))
+	}
+	if got := fmt.Sprint(pages); got != "[[. ..] [f g] []]" {
+		t.Fatalf("unexpected pages: %s", got)
+	}
+	entries, err = sub.ListWithOptions(ctx, ListOptions{IncludeDotEntries: true, Sort: SortByName, Offset: 1, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[.. f]" {
+		t.Fatalf("expected [.. f], got %s", got)
+	}
+}
+
+func TestUpdateFileContent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if _, err := dir.AddFileFromReader(ctx, "f", strings.NewReader("old content")); err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := dir.Child("f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi := fsn.(*File)
+
+	c, err := dir.UpdateFileContent(ctx, "f", strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again, err := dir.Child("f"); err != nil || again != FSNode(fi) {
+		t.Fatalf("expected the same file entry, got %v (%v)", again, err)
+	}
+	fd, err := fi.Open(Flags{Read: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("expected %q, got %q", "new", data)
+	}
+
+	entries, err := dir.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Hash != c.String() || entries[0].ModTime.IsZero() {
+		t.Fatalf("unexpected listing: %+v", entries)
+	}
+
+	mkdirP(t, dir, "d")
+	if _, err := dir.UpdateFileContent(ctx, "d", strings.NewReader("x")); err != ErrIsDirectory {
+		t.Fatalf("expected ErrIsDirectory, got %v", err)
+	}
+	if _, err := dir.UpdateFileContent(ctx, "missing", strings.NewReader("x")); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestUncacheBelow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	c := mkdirP(t, dir, "a/b/c")
+	if err := c.AddChild("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.UncacheBelow(-1); err == nil {
+		t.Fatal("expected error for negative depth")
+	}
+
+	if err := dir.UncacheBelow(2); err != nil {
+		t.Fatal(err)
+	}
+	a := dir.entriesCache["a"].(*Directory)
+	b := a.entriesCache["b"].(*Directory)
+	if fmt.Sprint(dir.CachedChildren(), a.CachedChildren(), b.CachedChildren()) != "[a] [b] []" {
+		t.Fatalf("unexpected caches: %v %v %v", dir.CachedChildren(), a.CachedChildren(), b.CachedChildren())
+	}
+
+	// The unflushed addition was kept.
+	if _, err := Lookup(rt, "/a/b/c/f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rnd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2, err := NewRoot(ctx, ds, rnd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt2, "/a/b/c/f"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.UncacheBelow(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.CachedChildren()) != 0 {
+		t.Fatalf("expected empty cache, got %v", dir.CachedChildren())
+	}
+}
+
+// prefixTransformer encodes nodes as raw nodes with their codec and data
+// after a marker prefix.
+type prefixTransformer struct{}
+
+var transformPrefix = []byte("enc:")
+
+func (prefixTransformer) Encode(ctx context.Context, nd ipld.Node) (ipld.Node, error) {
+	data := append(append([]byte{}, transformPrefix...), byte(nd.Cid().Type()))
+	return dag.NewRawNodeWPrefix(append(data, nd.RawData()...), dag.V1CidPrefix().WithCodec(cid.Raw))
+}
+
+func (prefixTransformer) Decode(ctx context.Context, nd ipld.Node) (ipld.Node, error) {
+	data := nd.RawData()
+	if !bytes.HasPrefix(data, transformPrefix) {
+		return nil, fmt.Errorf("node %s not encoded", nd.Cid())
+	}
+	data = data[len(transformPrefix):]
+	if data[0] == byte(cid.Raw) {
+		return dag.NewRawNode(data[1:]), nil
+	}
+	return dag.DecodeProtobuf(data[1:])
+}
+
+func TestNodeTransformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.NodeTransformer = prefixTransformer{}
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "a")
+	if _, err := sub.AddFileFromReader(ctx, "f", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	rnd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range rnd.Links() {
+		stored, err := ds.Get(ctx, l.Cid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(stored.RawData(), transformPrefix) {
+			t.Fatalf("link %q points to an untransformed node", l.Name)
+		}
+	}
+
+	rt2, err := NewRoot(ctx, ds, rnd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2.NodeTransformer = prefixTransformer{}
+	fd, err := OpenFile(ctx, rt2, "/a/f", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "content" {
+		t.Fatalf("expected %q, got %q", "content", data)
+	}
+
+	// Flushing again doesn't change anything.
+	if err := rt2.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rnd2, err := rt2.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rnd2.Cid().Equals(rnd.Cid()) {
+		t.Fatalf("expected %s, got %s", rnd.Cid(), rnd2.Cid())
+	}
+}
+
+// recordingTransformer is a `prefixTransformer` recording the CIDs of the
+// nodes it encodes.
+type recordingTransformer struct {
+	prefixTransformer
+
+	lk      sync.Mutex
+	encoded map[cid.Cid]bool
+}
+
+func (rt *recordingTransformer) Encode(ctx context.Context, nd ipld.Node) (ipld.Node, error) {
+	rt.lk.Lock()
+	rt.encoded[nd.Cid()] = true
+	rt.lk.Unlock()
+	return rt.prefixTransformer.Encode(ctx, nd)
+}
+
+// addRecordingDagServ records the CIDs of the nodes added to it.
+type addRecordingDagServ struct {
+	ipld.DAGService
+
+	lk    sync.Mutex
+	added map[cid.Cid]bool
+}
+
+func (ards *addRecordingDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	ards.lk.Lock()
+	ards.added[nd.Cid()] = true
+	ards.lk.Unlock()
+	return ards.DAGService.Add(ctx, nd)
+}
+
+func (ards *addRecordingDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := ards.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestNodeTransformerStoresEncoded(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &addRecordingDagServ{DAGService: getDagserv(t), added: make(map[cid.Cid]bool)}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &recordingTransformer{encoded: make(map[cid.Cid]bool)}
+	rt.NodeTransformer = tr
+
+	dir := rt.GetDirectory()
+	a := mkdirP(t, dir, "a/b")
+	a, err = lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AddFileFromReader(ctx, "f", strings.NewReader("content")); err != nil {
+		t.Fatal(err)
+	}
+	big := make([]byte, 3*chunker.DefaultBlockSize/2)
+	rand.Read(big)
+	if _, err := a.AddFileFromReader(ctx, "big", bytes.NewReader(big)); err != nil {
+		t.Fatal(err)
+	}
+	for _, flags := range []int{os.O_CREATE | os.O_WRONLY, os.O_WRONLY | os.O_APPEND} {
+		fd, err := OpenFile(ctx, rt, "/a/w", flags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write([]byte("written")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fd.Write(big); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := a.UpdateFileContent(ctx, "f", strings.NewReader("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Swap("f", "w"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.RenameEach(func(name string) (string, bool) {
+		return name + "2", name == "w"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/a/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tr.encoded) == 0 {
+		t.Fatal("expected nodes to be encoded")
+	}
+	for c := range tr.encoded {
+		if ds.added[c] {
+			t.Fatalf("decoded node %s added to the DAG service", c)
+		}
+	}
+
+	// The persisted nodes are loaded through the parent.
+	pnd, err := a.GetPersistedNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := a.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pnd.Cid().Equals(nd.Cid()) {
+		t.Fatalf("expected the persisted node %s, got %s", nd.Cid(), pnd.Cid())
+	}
+
+	// The tree can be loaded back.
+	rnd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2, err := NewRoot(ctx, ds, rnd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2.NodeTransformer = prefixTransformer{}
+	for pth, expected := range map[string]string{
+		"/a/w2": "updated",
+		"/a/f":  "written" + string(big) + "written" + string(big),
+	} {
+		fd, err := OpenFile(ctx, rt2, pth, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("%s: unexpected content (%d bytes)", pth, len(data))
+		}
+	}
+	if _, err := lookupDir(rt2, "/c"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPathType(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b")
+	if err := PutNode(rt, "/a/f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/a/l", "f"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for pth, expected := range map[string]NodeType{
+		"/":     TDir,
+		"/a":    TDir,
+		"/a/b/": TDir,
+		"/a/f":  TFile,
+		"/a/l":  TSymlink,
+	} {
+		typ, err := PathType(ctx, rt, pth)
+		if err != nil {
+			t.Fatalf("%s: %s", pth, err)
+		}
+		if typ != expected {
+			t.Fatalf("%s: expected type %d, got %d", pth, expected, typ)
+		}
+	}
+
+	a, err := DirLookup(dir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached := a.(*Directory).CachedChildren(); len(cached) != 0 {
+		t.Fatalf("expected no entries loaded, got %v", cached)
+	}
+
+	// Also from the cached entries.
+	if _, err := Lookup(rt, "/a/l"); err != nil {
+		t.Fatal(err)
+	}
+	if typ, err := PathType(ctx, rt, "/a/l"); err != nil || typ != TSymlink {
+		t.Fatalf("expected TSymlink, got %d (%v)", typ, err)
+	}
+
+	if _, err := PathType(ctx, rt, "/a/missing"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestCachedCumulativeSize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "sub")
+	if err := dir.AddChild("f", getRandFile(t, ds, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(warm bool) {
+		t.Helper()
+		size, ok := dir.CachedCumulativeSize()
+		if ok != warm {
+			t.Fatalf("expected warm %v, got %v", warm, ok)
+		}
+		nd, err := dir.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := nd.Size()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(expected) {
+			t.Fatalf("expected size %d, got %d", expected, size)
+		}
+	}
+
+	check(false)
+	check(true)
+
+	if err := dir.AddChild("g", getRandFile(t, ds, 500)); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+
+	// Replaced through the propagation of an entry.
+	if err := sub.AddChild("h", getRandFile(t, ds, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sub.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+
+	if err := dir.Unlink("f"); err != nil {
+		t.Fatal(err)
+	}
+	check(true)
+
+	if err := dir.Swap("g", "sub"); err != nil {
+		t.Fatal(err)
+	}
+	check(false)
+}
+
+func TestReadCar(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	sub := mkdirP(t, rt.GetDirectory(), "sub")
+	sub.SetCidBuilder(dag.V1CidPrefix())
+	data := make([]byte, 600000)
+	rand.Read(data)
+	if _, err := sub.AddFileFromReader(ctx, "f", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	root, err := sub.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cids, err := CollectCids(ctx, sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var car bytes.Buffer
+	writeSection := func(data []byte) {
+		car.Write(binary.AppendUvarint(nil, uint64(len(data))))
+		car.Write(data)
+	}
+	header, err := cbor.DumpObject(carHeader{Roots: []cid.Cid{root.Cid()}, Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSection(header)
+	for _, c := range cids {
+		nd, err := ds.Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeSection(append(c.Bytes(), nd.RawData()...))
+	}
+
+	ds2, rt2 := setupRoot(ctx, t)
+	dst := rt2.GetDirectory()
+	if err := ReadCar(ctx, dst, "imported", bytes.NewReader(car.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ds2.Get(ctx, cids[len(cids)-1]); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := OpenFile(ctx, rt2, "/imported/f", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Fatal("imported file content doesn't match")
+	}
+
+	if err := ReadCar(ctx, dst, "imported", bytes.NewReader(car.Bytes())); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+
+	// A corrupted block is rejected.
+	corrupt := car.Bytes()
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := ReadCar(ctx, dst, "corrupt", bytes.NewReader(corrupt)); err == nil {
+		t.Fatal("expected error reading corrupted CAR")
+	}
+}
+
+func TestCommonAncestor(t *testing.T) {
+	for _, tc := range []struct{ a, b, expected string }{
+		{"/a/b/c", "/a/b/d", "/a/b"},
+		{"/a/b", "/a/b/c/d", "/a/b"},
+		{"a/b/", "/a/b", "/a/b"},
+		{"/a/bc", "/a/b", "/a"},
+		{"/a", "/b", "/"},
+		{"/", "/a/b", "/"},
+		{"/a/./b/../c", "/a/c/d", "/a/c"},
+	} {
+		if got := CommonAncestor(tc.a, tc.b); got != tc.expected {
+			t.Fatalf("CommonAncestor(%q, %q): expected %q, got %q", tc.a, tc.b, tc.expected, got)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	b := mkdirP(t, rt.GetDirectory(), "a/b")
+	mkdirP(t, rt.GetDirectory(), "a/c")
+	if err := b.AddChild("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := CommonAncestorDir(ctx, rt, "/a/b/f", "/a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path() != "/a" {
+		t.Fatalf("expected /a, got %s", d.Path())
+	}
+	if _, err := CommonAncestorDir(ctx, rt, "/a/b/f", "/a/b/f"); err == nil {
+		t.Fatal("expected error for a file ancestor")
+	}
+}
+
+// storeDagServ is a DAG service reporting the nodes in its blockstore as
+// local (see `LocalChecker`).
+type storeDagServ struct {
+	ipld.DAGService
+	bs bstore.Blockstore
+}
+
+func (sds *storeDagServ) HasLocal(ctx context.Context, c cid.Cid) (bool, error) {
+	return sds.bs.Has(c)
+}
+
+func setupStoreRoot(ctx context.Context, t *testing.T) (*storeDagServ, *Root) {
+	bs := bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+	dserv := &storeDagServ{dag.NewDAGService(bserv.New(bs, offline.Exchange(bs))), bs}
+	rt, err := NewRoot(ctx, dserv, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dserv, rt
+}
+
+// flushHookLogger runs 'onStart' when a flush starts.
+type flushHookLogger struct {
+	recordingLogger
+	onStart func()
+}
+
+func (fl *flushHookLogger) FlushStarted() {
+	fl.onStart()
+}
+
+func TestFlushWithStats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dserv, rt := setupStoreRoot(ctx, t)
+	bs := dserv.bs
+
+	dir := rt.GetDirectory()
+	c := mkdirP(t, dir, "a/b/c")
+	mkdirP(t, dir, "d/e")
+	if _, err := rt.FlushWithStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed, no directory is added again. The additions made
+	// by other operations during the flush aren't counted.
+	rt.EventLogger = &flushHookLogger{onStart: func() {
+		if err := dir.dagService.Add(ctx, getRandFile(t, dserv, 100)); err != nil {
+			t.Error(err)
+		}
+	}}
+	stats, err := rt.FlushWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Adds != 0 || stats.Skipped != 6 {
+		t.Fatalf("expected 0 adds and 6 skipped, got %+v", stats)
+	}
+	rt.EventLogger = nil
+
+	// Only the directories from the modified one up to the root change.
+	if err := c.AddChild("f", getRandFile(t, dserv, 100)); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = rt.FlushWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Adds != 4 || stats.Skipped != 2 {
+		t.Fatalf("expected 4 adds and 2 skipped, got %+v", stats)
+	}
+
+	// An unchanged node removed from the store is added again.
+	nd, err := c.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.DeleteBlock(nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = rt.FlushWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Adds != 1 || stats.Skipped != 5 {
+		t.Fatalf("expected 1 add and 5 skipped, got %+v", stats)
+	}
+	if has, err := bs.Has(nd.Cid()); err != nil || !has {
+		t.Fatalf("expected %s stored again, got %t (%v)", nd.Cid(), has, err)
+	}
+
+	// Without `LocalChecker` support every directory is added.
+	_, rt2 := setupRoot(ctx, t)
+	mkdirP(t, rt2.GetDirectory(), "a/b")
+	if _, err := rt2.FlushWithStats(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = rt2.FlushWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Adds != 3 || stats.Skipped != 0 {
+		t.Fatalf("expected 3 adds and 0 skipped, got %+v", stats)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	b := mkdirP(t, dir, "a/b")
+	if err := b.AddChild("f", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("g", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.FlushMemFree(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var visited []string
+	err := dir.Walk(ctx, WalkOptions{}, func(pth string, n FSNode) error {
+		visited = append(visited, pth)
+		if pth == "a/b" {
+			// Changes made during the walk are kept (and visited,
+			// the entries are listed after the directory).
+			return n.(*Directory).AddChild("new", fi)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(visited)
+	if fmt.Sprint(visited) != "[a a/b a/b/f a/b/new g]" {
+		t.Fatalf("unexpected walk: %v", visited)
+	}
+	if cached := dir.CachedChildren(); len(cached) != 0 {
+		t.Fatalf("expected nothing cached, got %v", cached)
+	}
+	if _, err := Lookup(rt, "/a/b/new"); err != nil {
+		t.Fatal(err)
+	}
+	// The change synced up when uncaching the entries is pending a flush.
+	dir.lock.Lock()
+	dirty := dir.dirty
+	dir.lock.Unlock()
+	if !dirty {
+		t.Fatal("expected the root directory dirty after a change beneath it")
+	}
+
+	// Walking unmodified entries leaves the directory clean.
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.Walk(ctx, WalkOptions{}, func(string, FSNode) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	dir.lock.Lock()
+	dirty = dir.dirty
+	dir.lock.Unlock()
+	if dirty {
+		t.Fatal("expected the root directory clean after an unmodifying walk")
+	}
+
+	visited = nil
+	err = dir.Walk(ctx, WalkOptions{KeepCached: true}, func(pth string, n FSNode) error {
+		visited = append(visited, pth)
+		if pth == "a" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(visited)
+	if fmt.Sprint(visited) != "[a g]" {
+		t.Fatalf("unexpected walk: %v", visited)
+	}
+	if cached := dir.CachedChildren(); fmt.Sprint(cached) != "[a g]" {
+		t.Fatalf("expected [a g] cached, got %v", cached)
+	}
+}
+
+func TestPauseRepublish(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	published := make(chan cid.Cid, 16)
+	rt, err := NewRoot(ctx, getDagserv(t), emptyDirNode(), func(ctx context.Context, c cid.Cid) error {
+		published <- c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rt.PauseRepublish()
+	dir := rt.GetDirectory()
+	for i := 0; i < 3; i++ {
+		if _, err := dir.Mkdir(fmt.Sprint("d", i)); err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Well past the short timeout of the republisher.
+	select {
+	case c := <-published:
+		t.Fatalf("unexpected publish of %s while paused", c)
+	case <-time.After(time.Second):
+	}
+
+	rt.ResumeRepublish()
+	last, _, _ := rt.LastFlush()
+	select {
+	case c := <-published:
+		if !c.Equals(last) {
+			t.Fatalf("expected %s published, got %s", last, c)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no publish after resuming")
+	}
+
+	rt.PauseRepublish()
+	if _, err := dir.Mkdir("e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.RepublishNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	last, _, _ = rt.LastFlush()
+	if c := <-published; !c.Equals(last) {
+		t.Fatalf("expected %s published, got %s", last, c)
+	}
+
+	// Already published, resuming has nothing left to publish.
+	rt.ResumeRepublish()
+	if err := rt.RepublishNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-published:
+		t.Fatalf("unexpected publish of %s", c)
+	default:
+	}
+}
+
+func TestCheckCidBuilder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a")
+	if err := dir.AddChild("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.CheckCidBuilder(ctx, dir.GetCidBuilder()); err != nil {
+		t.Fatal(err)
+	}
+	err := dir.CheckCidBuilder(ctx, dag.V1CidPrefix())
+	if !errors.Is(err, ErrCidBuilderMismatch) {
+		t.Fatalf("expected ErrCidBuilderMismatch, got %v", err)
+	}
+
+	// Setting the builder doesn't rebuild the existing entries.
+	dir.SetCidBuilder(dag.V1CidPrefix())
+	if err := dir.CheckCidBuilder(ctx, dir.GetCidBuilder()); !errors.Is(err, ErrCidBuilderMismatch) {
+		t.Fatalf("expected ErrCidBuilderMismatch, got %v", err)
+	}
+
+	if _, err := RebuildWithCidBuilder(ctx, dir, dag.V1CidPrefix()); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Lookup(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.(*Directory).CheckCidBuilder(ctx, dag.V1CidPrefix()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListExcludeHidden(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	for _, name := range []string{".hidden", "a", ".git", "b"} {
+		if err := dir.AddChild(name, getRandFile(t, ds, 10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(l []NodeListing) string {
+		var out []string
+		for _, e := range l {
+			out = append(out, e.Name)
+		}
+		return fmt.Sprint(out)
+	}
+
+	entries, err := dir.ListWithOptions(ctx, ListOptions{Sort: SortByName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[.git .hidden a b]" {
+		t.Fatalf("expected [.git .hidden a b], got %s", got)
+	}
+
+	// Hidden entries aren't counted in the window.
+	entries, err = dir.ListWithOptions(ctx, ListOptions{Sort: SortByName, ExcludeHidden: true, Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(entries); got != "[b]" {
+		t.Fatalf("expected [b], got %s", got)
+	}
+
+	for _, prefetch := range []int{0, 2} {
+		var seen []NodeListing
+		err = dir.ForEachEntryWithOptions(ctx, ListOptions{ExcludeHidden: true, Prefetch: prefetch}, func(nl NodeListing) error {
+			seen = append(seen, nl)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != 2 || strings.HasPrefix(seen[0].Name, ".") || strings.HasPrefix(seen[1].Name, ".") {
+			t.Fatalf("expected only visible entries, got %s", names(seen))
+		}
+	}
+}
+
+func TestBuildListingManifest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 100)
+	for _, name := range []string{"b", "a", "c"} {
+		if err := dir.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mkdirP(t, dir, "d")
+
+	c1, err := dir.BuildListingManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same entries, added in another order to a sharded directory.
+	rt2, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt2.GetDirectory().AddChild("sharded", emptyShardNode(t, ds)); err != nil {
+		t.Fatal(err)
+	}
+	sharded, err := Lookup(rt2, "/sharded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir2 := sharded.(*Directory)
+	mkdirP(t, dir2, "d")
+	for _, name := range []string{"c", "a", "b"} {
+		if err := dir2.AddChild(name, fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c2, err := dir2.BuildListingManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c1.Equals(c2) || c1.Type() != cid.DagCBOR {
+		t.Fatalf("expected the same dag-cbor manifest, got %s and %s", c1, c2)
+	}
+
+	nd, err := ds.Get(ctx, c1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries map[string]cid.Cid
+	if err := cbor.DecodeInto(nd.RawData(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || !entries["a"].Equals(fi.Cid()) {
+		t.Fatalf("unexpected manifest: %v", entries)
+	}
+
+	if err := dir.Unlink("c"); err != nil {
+		t.Fatal(err)
+	}
+	c3, err := dir.BuildListingManifest(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3.Equals(c1) {
+		t.Fatal("expected a different manifest after removing an entry")
+	}
+}
+
+func TestPruneSubtree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 10)
+	populate := func() *Directory {
+		old := mkdirP(t, dir, "old")
+		for i := 0; i < 3; i++ {
+			sub := mkdirP(t, old, fmt.Sprintf("sub%d/deeper", i))
+			for j := 0; j < 80; j++ {
+				if err := sub.AddChild(fmt.Sprint("f", j), fi); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		return old
+	}
+
+	// 3 * (80 files + "deeper" + "subN").
+	old := populate()
+	var progress []int
+	if err := PruneSubtree(ctx, old, func(n int) { progress = append(progress, n) }); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[100 200 246]" {
+		t.Fatalf("unexpected progress: %v", progress)
+	}
+	if empty, err := old.IsEmpty(ctx); err != nil || !empty {
+		t.Fatalf("expected an empty directory (%v)", err)
+	}
+
+	// Cancelled midway the tree is left partially pruned.
+	old = populate()
+	pctx, pcancel := context.WithCancel(ctx)
+	err := PruneSubtree(pctx, old, func(n int) {
+		if n == 100 {
+			pcancel()
+		}
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := FindEmptyDirs(ctx, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := old.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || len(paths) != 0 {
+		t.Fatalf("unexpected state after cancelling: %v, empty %v", names, paths)
+	}
+}
+
+func TestFileRoot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := getDagserv(t)
+
+	published := make(chan cid.Cid, 16)
+	fnd := fileNodeFromReader(t, ds, bytes.NewReader([]byte("hello")))
+	rt, err := NewFileRoot(ctx, ds, fnd, func(ctx context.Context, c cid.Cid) error {
+		published <- c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt.GetDirectory() != nil || rt.GetFile() == nil {
+		t.Fatal("expected a root file")
+	}
+
+	fd, err := OpenFile(ctx, rt, "/", os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.Write([]byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := rt.GetFile().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _, _ := rt.LastFlush()
+	if !last.Equals(nd.Cid()) {
+		t.Fatalf("expected the file %s as last flush, got %s", nd.Cid(), last)
+	}
+	if data, err := catNode(ds, nd.(*dag.ProtoNode)); err != nil || string(data) != "hello world" {
+		t.Fatalf("unexpected content %q (%v)", data, err)
+	}
+	if err := rt.RepublishNow(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-published; !c.Equals(nd.Cid()) {
+		t.Fatalf("expected %s published, got %s", nd.Cid(), c)
+	}
+	if _, err := rt.FlushIfMatches(ctx, nd.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Lookup(rt, "/a"); err != ErrFileRoot {
+		t.Fatalf("expected ErrFileRoot, got %v", err)
+	}
+	if err := Mkdir(rt, "/a", MkdirOpts{}); err != ErrFileRoot {
+		t.Fatalf("expected ErrFileRoot, got %v", err)
+	}
+	if err := rt.FlushMemFree(ctx); err != ErrFileRoot {
+		t.Fatalf("expected ErrFileRoot, got %v", err)
+	}
+
+	if _, err := NewFileRoot(ctx, ds, emptyDirNode(), nil); err == nil {
+		t.Fatal("expected an error for a directory node")
+	}
+	if err := rt.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingDagServ counts the nodes added to it and their bytes.
+type countingDagServ struct {
+	ipld.DAGService
+	nodes, bytes int64
+}
+
+func (cds *countingDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	atomic.AddInt64(&cds.nodes, 1)
+	atomic.AddInt64(&cds.bytes, int64(len(nd.RawData())))
+	return cds.DAGService.Add(ctx, nd)
+}
+
+func (cds *countingDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		atomic.AddInt64(&cds.nodes, 1)
+		atomic.AddInt64(&cds.bytes, int64(len(nd.RawData())))
+	}
+	return cds.DAGService.AddMany(ctx, nds)
+}
+
+func TestSkipUnchangedWrites(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds := &countingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.SkipUnchangedWrites = true
+
+	dir := rt.GetDirectory()
+	c, err := dir.AddFileFromReader(ctx, "f", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := dir.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := entries[0].ModTime
+
+	adds := atomic.LoadInt64(&ds.nodes)
+	same, err := dir.UpdateFileContent(ctx, "f", strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Equals(c) || atomic.LoadInt64(&ds.nodes) != adds {
+		t.Fatalf("expected no writes for the same content, got %s", same)
+	}
+	entries, err = dir.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entries[0].ModTime.Equal(modTime) {
+		t.Fatalf("modification time changed from %s to %s", modTime, entries[0].ModTime)
+	}
+
+	// Different content is still written (and stored).
+	changed, err := dir.UpdateFileContent(ctx, "f", strings.NewReader("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Equals(c) {
+		t.Fatal("expected new content")
+	}
+	if _, err := ds.Get(ctx, changed); err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding an identical entry over an existing one still fails.
+	fnd, err := ds.Get(ctx, changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("f", fnd); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+
+	// Only the blocks that changed (and the nodes above them) are stored.
+	data := make([]byte, 3*chunker.DefaultBlockSize)
+	if _, err := dir.AddFileFromReader(ctx, "big", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	data[chunker.DefaultBlockSize+1] = 1
+	added := atomic.LoadInt64(&ds.bytes)
+	updated, err := dir.UpdateFileContent(ctx, "big", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&ds.bytes) - added; n < chunker.DefaultBlockSize || n >= 2*chunker.DefaultBlockSize {
+		t.Fatalf("expected only the changed block stored, got %d bytes", n)
+	}
+	und, err := ds.Get(ctx, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, err := catNode(ds, und.(*dag.ProtoNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rd, data) {
+		t.Fatal("unexpected content after the update")
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	b := mkdirP(t, dir, "a/b")
+	if err := b.AddChild("f", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	for pth, target := range map[string]string{
+		"/link":      "a/b",
+		"/a/abs":     "/a/b/f",
+		"/a/chain":   "abs",
+		"/a/missing": "nowhere",
+	} {
+		if err := Symlink(rt, pth, target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := dir.ListRecursiveWithOptions(ctx, RecursiveListOptions{FollowSymlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	types := make(map[string]int)
+	for _, e := range entries {
+		types[e.Name] = e.Type
+	}
+	if len(types) != 8 || types["link"] != int(TDir) || types["link/f"] != int(TFile) {
+		t.Fatalf("unexpected listing: %v", types)
+	}
+	fnd, _ := Lookup(rt, "/a/b/f")
+	fc, _ := fnd.GetNode()
+	for _, e := range entries {
+		if (e.Name == "a/abs" || e.Name == "a/chain") && e.Hash != fc.Cid().String() {
+			t.Fatalf("%s not listed as its target: %+v", e.Name, e)
+		}
+	}
+
+	var visited []string
+	err = dir.Walk(ctx, WalkOptions{FollowSymlinks: true}, func(pth string, n FSNode) error {
+		visited = append(visited, pth)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != 8 {
+		t.Fatalf("unexpected walk: %v", visited)
+	}
+
+	// A symlink to an ancestor.
+	if err := Symlink(rt, "/a/b/up", "../.."); err != nil {
+		t.Fatal(err)
+	}
+	_, err = dir.ListRecursiveWithOptions(ctx, RecursiveListOptions{FollowSymlinks: true})
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected ErrSymlinkLoop, got %v", err)
+	}
+	err = dir.Walk(ctx, WalkOptions{FollowSymlinks: true}, func(string, FSNode) error { return nil })
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected ErrSymlinkLoop, got %v", err)
+	}
+
+	// A cycle of symlinks.
+	if err := dir.Unlink("link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Unlink("up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/y", "x"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = dir.ListRecursiveWithOptions(ctx, RecursiveListOptions{FollowSymlinks: true})
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected ErrSymlinkLoop, got %v", err)
+	}
+
+	// Without following, the symlinks are just entries.
+	if _, err := dir.ListRecursive(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	mkdirP(t, dir, "a/b/c")
+	mkdirP(t, dir, "d")
+	if err := dir.AddChild("f", getRandFile(t, ds, 10)); err != nil {
+		t.Fatal(err)
+	}
+	rnd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gds := &getCountDagServ{DAGService: ds, gets: make(map[cid.Cid]int)}
+	rt2, err := NewRoot(ctx, gds, rnd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt2.Warm(ctx, []string{"/a/b/c", "f", "/"}); err != nil {
+		t.Fatal(err)
+	}
+	if cached := rt2.GetDirectory().CachedChildren(); fmt.Sprint(cached) != "[a f]" {
+		t.Fatalf("expected [a f] cached, got %v", cached)
+	}
+
+	gets := len(gds.gets)
+	for _, pth := range []string{"/a/b/c", "/f"} {
+		if _, err := Lookup(rt2, pth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(gds.gets) != gets {
+		t.Fatal("expected the warmed paths to be resolved without fetching")
+	}
+
+	if err := rt2.Warm(ctx, []string{"/d", "/missing", "/a"}); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+	if err := rt2.Warm(ctx, []string{"/f/x"}); err == nil {
+		t.Fatal("expected an error resolving under a file")
+	}
+}
+
+func TestMaxDirtyDirs(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	rt.MaxDirtyDirs = 1
+
+	dir := rt.GetDirectory()
+	a := mkdirP(t, dir, "a")
+	b := mkdirP(t, dir, "b")
+	if err := rt.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	flushed, _, _ := rt.LastFlush()
+
+	isDirty := func(d *Directory) bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		return d.dirty
+	}
+
+	if _, err := a.Mkdir("1"); err != nil {
+		t.Fatal(err)
+	}
+	if !isDirty(a) {
+		t.Fatal("expected a dirty directory within the budget")
+	}
+
+	// Over the budget the oldest dirty directory is flushed.
+	if _, err := b.Mkdir("1"); err != nil {
+		t.Fatal(err)
+	}
+	if isDirty(a) || !isDirty(b) || isDirty(dir) {
+		t.Fatalf("unexpected dirty state: a %t, b %t, root %t", isDirty(a), isDirty(b), isDirty(dir))
+	}
+	last, _, _ := rt.LastFlush()
+	if last.Equals(flushed) {
+		t.Fatal("expected the flush to reach the root")
+	}
+	rnd, err := ds.Get(ctx, last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt2, err := NewRoot(ctx, ds, rnd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt2, "/a/1"); err != nil {
+		t.Fatalf("expected /a/1 in the flushed root: %v", err)
+	}
+
+	// A dirty directory unlinked meanwhile is just dropped.
+	if err := dir.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Mkdir("2"); err != nil {
+		t.Fatal(err)
+	}
+	rt.dirtyLock.Lock()
+	n := rt.dirtyDirs.Len()
+	rt.dirtyLock.Unlock()
+	if n > 1 {
+		t.Fatalf("expected at most 1 dirty directory, got %d", n)
+	}
+
+	// Unchecked adds are within the budget as well.
+	c := mkdirP(t, dir, "c")
+	if err := c.AddChildUnchecked("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddChildUnchecked("f", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	if isDirty(c) || !isDirty(a) {
+		t.Fatalf("unexpected dirty state: a %t, c %t", isDirty(a), isDirty(c))
+	}
+}
+
+func TestRawData(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "sub")
+	raw := dag.NewRawNode([]byte("raw bytes"))
+	if err := ds.Add(ctx, raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("raw", raw); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := dir.RawData(ctx, "raw")
+	if err != nil || string(data) != "raw bytes" {
+		t.Fatalf("unexpected raw data %q (%v)", data, err)
+	}
+
+	data, err = dir.RawData(ctx, "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsn, err := ft.FSNodeFromBytes(data)
+	if err != nil || !fsn.IsDir() {
+		t.Fatalf("expected UnixFS directory data, got %v (%v)", fsn, err)
+	}
+	if c, err := dir.Child("sub"); err != nil || c != FSNode(sub) {
+		t.Fatal("expected the entry to stay cached")
+	}
+
+	if _, err := dir.RawData(ctx, "missing"); err != os.ErrNotExist {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestShardingThreshold(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	if paths, err := FindNearThreshold(ctx, dir, 10); err != nil || len(paths) != 0 {
+		t.Fatalf("expected nothing without threshold, got %v (%v)", paths, err)
+	}
+
+	rt.ShardingThreshold = 5
+	fi := getRandFile(t, ds, 10)
+	near := mkdirP(t, dir, "a/near")
+	far := mkdirP(t, dir, "a/far")
+	for i := 0; i < 4; i++ {
+		if err := near.AddChild(fmt.Sprint("f", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := far.AddChild("f", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := FindNearThreshold(ctx, dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != "[a/near]" {
+		t.Fatalf("expected [a/near], got %v", paths)
+	}
+	paths, err = FindNearThreshold(ctx, dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != "[. a a/far a/near]" {
+		t.Fatalf("expected [. a a/far a/near], got %v", paths)
+	}
+
+	// Reaching the threshold keeps it basic, going over it shards.
+	if err := near.AddChild("f4", fi); err != nil {
+		t.Fatal(err)
+	}
+	if near.isSharded() {
+		t.Fatal("expected a basic directory at the threshold")
+	}
+	// Replacing an entry doesn't add one.
+	if _, err := near.UpdateFileContent(ctx, "f4", strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	if near.isSharded() {
+		t.Fatal("expected a basic directory after replacing an entry")
+	}
+	if err := near.AddChild("f5", fi); err != nil {
+		t.Fatal(err)
+	}
+	if !near.isSharded() {
+		t.Fatal("expected a sharded directory over the threshold")
+	}
+	if names, err := near.ListNames(ctx); err != nil || len(names) != 6 {
+		t.Fatalf("unexpected entries %v (%v)", names, err)
+	}
+
+	paths, err = FindNearThreshold(ctx, dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(paths) != "[. a a/far]" {
+		t.Fatalf("expected [. a a/far], got %v", paths)
+	}
+}
+
+func TestRequireValidUTF8Names(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	fi := getRandFile(t, ds, 10)
+	if err := dir.AddChild("bad\x01", fi); err != nil {
+		t.Fatal(err)
+	}
+
+	rt.RequireValidUTF8Names = true
+	for _, name := range []string{"\xff\xfe", "tab\tname", "new\nline", "del\x7f"} {
+		if err := dir.AddChild(name, fi); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("%q: expected ErrInvalidName, got %v", name, err)
+		}
+		if _, err := dir.Mkdir(name); !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("%q: expected ErrInvalidName, got %v", name, err)
+		}
+	}
+	if err := Mv(rt, "/bad\x01", "/still\x02bad"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	err := dir.RenameEach(func(name string) (string, bool) {
+		return "x\x1b", true
+	})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+
+	// Valid names (including non-ASCII ones) and existing entries are fine.
+	if err := dir.AddChild("héllo 世界", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := Mv(rt, "/bad\x01", "/fixed"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkOverlap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	data := make([]byte, 4000)
+	u.NewTimeSeededRand().Read(data)
+	mkFile := func(name string, content []byte) *File {
+		nd, err := importer.BuildDagFromReader(ds, chunker.NewSizeSplitter(bytes.NewReader(content), 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.GetDirectory().AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+		fsn, err := rt.GetDirectory().Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fsn.(*File)
+	}
+
+	// 'b' shares its first two chunks with 'a', 'c' repeats one chunk.
+	a := mkFile("a", data[:3000])
+	b := mkFile("b", append(append([]byte{}, data[:2000]...), data[3000:]...))
+	c := mkFile("c", append(append([]byte{}, data[:1000]...), data[:1000]...))
+
+	shared, total, err := ChunkOverlap(ctx, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != 2000 || total != 4000 {
+		t.Fatalf("expected 2000/4000 shared bytes, got %d/%d", shared, total)
+	}
+
+	shared, total, err = ChunkOverlap(ctx, a, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != 1000 || total != 3000 {
+		t.Fatalf("expected 1000/3000 shared bytes, got %d/%d", shared, total)
+	}
+
+	shared, total, err = ChunkOverlap(ctx, a, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared != 3000 || total != 3000 {
+		t.Fatalf("expected 3000/3000 shared bytes, got %d/%d", shared, total)
+	}
+}
+
+func TestListCheckLocal(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dserv, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	x := getRandFile(t, dserv, 100)
+	y := getRandFile(t, dserv, 200)
+	if err := dir.AddChild("x", x); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.AddChild("y", y); err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkLocal := func(list []NodeListing, want map[string]bool) {
+		t.Helper()
+		if len(list) != len(want) {
+			t.Fatalf("expected %d entries, got %d", len(want), len(list))
+		}
+		for _, nl := range list {
+			if nl.Local != want[nl.Name] {
+				t.Fatalf("%s: expected local %v, got %v", nl.Name, want[nl.Name], nl.Local)
+			}
+		}
+	}
+
+	// Without `LocalChecker` support nothing is reported as local.
+	plain, err := NewRoot(ctx, dserv, nd.(*dag.ProtoNode), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := plain.GetDirectory().ListWithOptions(ctx, ListOptions{CheckLocal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkLocal(list, map[string]bool{"x": false, "y": false})
+
+	for _, prefetch := range []int{0, 2} {
+		// Only 'x' is in the blockstore checked, all of them can be fetched.
+		bs := bstore.NewBlockstore(dssync.MutexWrap(ds.NewMapDatastore()))
+		if err := bs.Put(x); err != nil {
+			t.Fatal(err)
+		}
+		lrt, err := NewRoot(ctx, &storeDagServ{dserv, bs}, nd.(*dag.ProtoNode), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ldir := lrt.GetDirectory()
+
+		opts := ListOptions{CheckLocal: true, Prefetch: prefetch}
+		list, err = ldir.ListWithOptions(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLocal(list, map[string]bool{"x": true, "y": false})
+
+		// Listing loads the entries, they are in memory afterwards.
+		list, err = ldir.ListWithOptions(ctx, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLocal(list, map[string]bool{"x": true, "y": true})
+
+		list, err = ldir.ListWithOptions(ctx, ListOptions{Prefetch: prefetch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkLocal(list, map[string]bool{"x": false, "y": false})
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "sub")
+	mkdirP(t, dir, "sub/nested")
+	fa := getRandFile(t, ds, 100)
+	fb := getRandFile(t, ds, 200)
+	for name, nd := range map[string]ipld.Node{"a": fa, "b": fb, "sub": fa} {
+		if err := sub.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dir.AddChild("a", fb); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a callback the conflicts abort the operation untouched.
+	if err := Flatten(ctx, dir, "sub", nil); err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+	names, err := sub.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 4 {
+		t.Fatalf("expected 4 entries left in sub, got %v", names)
+	}
+
+	// A callback returning a taken name fails as well.
+	err = Flatten(ctx, dir, "sub", func(name string) string { return "a" })
+	if err != os.ErrExist {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+
+	if err := Flatten(ctx, dir, "a", nil); err == nil {
+		t.Fatal("expected error flattening a file")
+	}
+
+	err = Flatten(ctx, dir, "sub", func(name string) string { return name + ".1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err = dir.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "a,a.1,b,nested,sub.1" {
+		t.Fatalf("unexpected entries after flattening: %v", names)
+	}
+	for name, nd := range map[string]ipld.Node{"a": fb, "a.1": fa, "b": fb, "sub.1": fa} {
+		fsn, err := dir.Child(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := fsn.GetNode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Cid().Equals(nd.Cid()) {
+			t.Fatalf("%s: unexpected content", name)
+		}
+	}
+	if _, err := dir.Child("nested"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The names returned by the callback are validated.
+	sub = mkdirP(t, dir, "sub")
+	if err := sub.AddChild("b", fa); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"", "x/y"} {
+		err := Flatten(ctx, dir, "sub", func(string) string { return bad })
+		if !errors.Is(err, ErrInvalidName) {
+			t.Fatalf("%q: expected ErrInvalidName, got %v", bad, err)
+		}
+	}
+}
+
+func TestFlattenUndo(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fds := &failingDagServ{DAGService: getDagserv(t)}
+	rt, err := NewRoot(ctx, fds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The entries are added to the HAMT as they're moved, the last one
+	// fails.
+	dir := rt.GetDirectory()
+	if err := dir.AddChild("h", emptyShardNode(t, fds)); err != nil {
+		t.Fatal(err)
+	}
+	h := mkdirP(t, dir, "h")
+	sub := mkdirP(t, h, "sub")
+	fa := getRandFile(t, fds, 100)
+	fz := getRandFile(t, fds, 200)
+	for name, nd := range map[string]ipld.Node{"a": fa, "z": fz} {
+		if err := sub.AddChild(name, nd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	order, err := sub.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := sub.Child(order[len(order)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lnd, err := last.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the first addition fails.
+	failed := false
+	fds.setFail(func(nd ipld.Node) bool {
+		if failed || !nd.Cid().Equals(lnd.Cid()) {
+			return false
+		}
+		failed = true
+		return true
+	})
+
+	if err := Flatten(ctx, h, "sub", nil); err == nil {
+		t.Fatal("expected the failed addition")
+	}
+	names, err := sub.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[a z]" {
+		t.Fatalf("expected [a z] left in sub, got %v", names)
+	}
+	if names, err := h.ListNames(ctx); err != nil || fmt.Sprint(names) != "[sub]" {
+		t.Fatalf("expected [sub] in h, got %v (%v)", names, err)
+	}
+
+	if err := Flatten(ctx, h, "sub", nil); err != nil {
+		t.Fatal(err)
+	}
+	names, err = h.ListNames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if fmt.Sprint(names) != "[a z]" {
+		t.Fatalf("expected [a z] in h, got %v", names)
+	}
+}
+
+func TestFlushMeasured(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupStoreRoot(ctx, t)
+
+	rt.ShardingThreshold = 3
+	dir := rt.GetDirectory()
+	sub := mkdirP(t, dir, "a/b")
+	fi := getRandFile(t, ds, 10)
+	for i := 0; i < 4; i++ {
+		if err := sub.AddChild(fmt.Sprint("f", i), fi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, err := rt.FlushMeasured(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Cid.Equals(nd.Cid()) {
+		t.Fatalf("expected root %s, got %s", nd.Cid(), res.Cid)
+	}
+	if res.ShardingSwitches != 1 || res.ShardingNodes == 0 || res.ShardingBytes == 0 {
+		t.Fatalf("expected 1 sharding switch measured, got %+v", res)
+	}
+	if res.Nodes == 0 || res.Bytes == 0 || res.Duration <= 0 {
+		t.Fatalf("expected nodes, bytes and duration measured, got %+v", res)
+	}
+
+	// Nothing changed since, at most the HAMT node is added again. The
+	// additions made by other operations during the flush aren't counted.
+	rt.EventLogger = &flushHookLogger{onStart: func() {
+		if err := dir.dagService.Add(ctx, getRandFile(t, ds, 100)); err != nil {
+			t.Error(err)
+		}
+	}}
+	res, err = rt.FlushMeasured(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ShardingSwitches != 0 || res.ShardingNodes != 0 || res.Nodes > 1 || res.Skipped == 0 {
+		t.Fatalf("expected an empty flush, got %+v", res)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := rt.FlushMeasured(cctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// The context is checked while syncing the tree.
+	if err := sub.AddChild("f4", fi); err != nil {
+		t.Fatal(err)
+	}
+	cctx, ccancel = context.WithCancel(ctx)
+	rt.EventLogger = &flushHookLogger{onStart: ccancel}
+	if _, err := rt.FlushMeasured(cctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	rt.EventLogger = nil
+	if _, err := rt.FlushMeasured(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectoryTemplate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	keep := dag.NodeWithData(ft.FilePBData(nil, 0))
+	if err := dir.SetTemplate(map[string]ipld.Node{"": keep}); err == nil {
+		t.Fatal("expected error with an empty name")
+	}
+	if err := dir.SetTemplate(map[string]ipld.Node{".keep": keep}); err != nil {
+		t.Fatal(err)
+	}
+
+	hasEntries := func(d *Directory, want string) {
+		t.Helper()
+		names, err := d.ListNames(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != want {
+			t.Fatalf("%s: expected entries %q, got %v", d.Path(), want, names)
+		}
+	}
+
+	a := mkdirP(t, dir, "a/b")
+	hasEntries(a, ".keep")
+	aDir, err := dir.Child("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasEntries(aDir.(*Directory), ".keep,b")
+
+	// The nearest template applies.
+	readme := dag.NewRawNode([]byte("readme"))
+	if err := aDir.(*Directory).SetTemplate(map[string]ipld.Node{"README": readme}); err != nil {
+		t.Fatal(err)
+	}
+	c := mkdirP(t, a, "c")
+	hasEntries(c, "README")
+
+	// The template entries are encoded with the new directory's builder.
+	err = Mkdir(rt, "/v1", MkdirOpts{CidBuilder: dag.V1CidPrefix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := Lookup(rt, "/v1/.keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nd, err := v1.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd.Cid().Version() != 1 {
+		t.Fatalf("expected a CIDv1 template entry, got %s", nd.Cid())
+	}
+	if err := dir.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Batches apply the templates too.
+	batch := NewBatch(rt)
+	batch.Mkdir("/batched", MkdirOpts{})
+	if err := batch.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Lookup(rt, "/batched/.keep"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directories of the template count for the `MaxDepth`.
+	deeper := emptyDirNode()
+	nested := emptyDirNode()
+	if err := nested.AddNodeLink("deeper", deeper); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.AddMany(ctx, []ipld.Node{deeper, nested}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.SetTemplate(map[string]ipld.Node{"nested": nested}); err != nil {
+		t.Fatal(err)
+	}
+	rt.MaxDepth = 3
+	mkdirP(t, dir, "d1")
+	if err := MkdirContext(ctx, rt, "/d1/d2", MkdirOpts{}); err != ErrTooDeep {
+		t.Fatalf("expected ErrTooDeep, got %v", err)
+	}
+	rt.MaxDepth = 0
+
+	if err := dir.SetTemplate(nil); err != nil {
+		t.Fatal(err)
+	}
+	hasEntries(mkdirP(t, dir, "empty"), "")
+}
+
+func TestResolvePath(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	c := mkdirP(t, dir, "a/b/c")
+	fi := getRandFile(t, ds, 10)
+	if err := c.AddChild("f", fi); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/link", "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/a/up", "../link/c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Symlink(rt, "/loop", "loop"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsn, err := ResolvePath(ctx, rt, "/a/b/c/f", ResolveOptions{MaxSteps: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd, _ := fsn.GetNode(); !nd.Cid().Equals(fi.Cid()) {
+		t.Fatal("resolved the wrong entry")
+	}
+	_, err = ResolvePath(ctx, rt, "/a/b/c/f", ResolveOptions{MaxSteps: 3})
+	if !errors.Is(err, ErrResolutionBudgetExceeded) {
+		t.Fatalf("expected ErrResolutionBudgetExceeded, got %v", err)
+	}
+
+	// Without following them symlinks are returned as they are.
+	fsn, err = ResolvePath(ctx, rt, "/link", ResolveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsn.Type() != TFile {
+		t.Fatalf("expected the symlink, got %v", fsn.Type())
+	}
+	if _, err := ResolvePath(ctx, rt, "/link/c", ResolveOptions{}); err == nil {
+		t.Fatal("expected error resolving through an unfollowed symlink")
+	}
+
+	// a, up and its hop, link and its hop, a, b, c, f: 9 steps.
+	opts := ResolveOptions{FollowSymlinks: true, MaxSteps: 9}
+	fsn, err = ResolvePath(ctx, rt, "/a/up/f", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd, _ := fsn.GetNode(); !nd.Cid().Equals(fi.Cid()) {
+		t.Fatal("resolved the wrong entry")
+	}
+	opts.MaxSteps = 8
+	_, err = ResolvePath(ctx, rt, "/a/up/f", opts)
+	if !errors.Is(err, ErrResolutionBudgetExceeded) {
+		t.Fatalf("expected ErrResolutionBudgetExceeded, got %v", err)
+	}
+
+	_, err = ResolvePath(ctx, rt, "/loop", ResolveOptions{FollowSymlinks: true, MaxSteps: 10})
+	if !errors.Is(err, ErrResolutionBudgetExceeded) {
+		t.Fatalf("expected ErrResolutionBudgetExceeded, got %v", err)
+	}
+	_, err = ResolvePath(ctx, rt, "/loop", ResolveOptions{FollowSymlinks: true})
+	if !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("expected ErrSymlinkLoop, got %v", err)
+	}
+
+	// A dangling symlink is returned as it is without following it, as a
+	// missing entry when following it.
+	if err := Symlink(rt, "/dangling", "/nowhere"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ResolvePath(ctx, rt, "/dangling", ResolveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ResolvePath(ctx, rt, "/dangling", ResolveOptions{FollowSymlinks: true})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestReplaceSubtree(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ds, rt := setupRoot(ctx, t)
+	ml := &mutationLog{}
+	rt.MutationLogger = ml
+
+	dir := rt.GetDirectory()
+	site := mkdirP(t, dir, "site/old")
+	if err := site.AddChild("index", getRandFile(t, ds, 100)); err != nil {
+		t.Fatal(err)
+	}
+	oldSite, err := Lookup(rt, "/site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := oldSite.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	oldNd, err := oldSite.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not flushed, it is dropped with the entry.
+	if _, err := oldSite.(*Directory).Mkdir("pending"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A tree built elsewhere.
+	_, build := setupRoot(ctx, t)
+	newIndex := getRandFile(t, ds, 200)
+	if err := PutNode(build, "/index", newIndex); err != nil {
+		t.Fatal(err)
+	}
+	newNd, err := build.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ReplaceSubtree(ctx, rt, "/missing", newNd); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := ReplaceSubtree(ctx, rt, "/site", dag.NodeWithData([]byte("junk"))); err != ErrInvalidChild {
+		t.Fatalf("expected ErrInvalidChild, got %v", err)
+	}
+	if _, err := ReplaceSubtree(ctx, rt, "/", newNd); err == nil {
+		t.Fatal("expected error replacing the root")
+	}
+
+	replaced, err := ReplaceSubtree(ctx, rt, "/site", newNd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replaced.Equals(oldNd.Cid()) {
+		t.Fatalf("expected replaced %s, got %s", oldNd.Cid(), replaced)
+	}
+	if _, err := Lookup(rt, "/site/old"); err != os.ErrNotExist {
+		t.Fatalf("expected the old subtree gone, got %v", err)
+	}
+	fsn, err := Lookup(rt, "/site/index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nd, _ := fsn.GetNode(); !nd.Cid().Equals(newIndex.Cid()) {
+		t.Fatal("unexpected content after replacing")
+	}
+	final, err := dir.GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The replacement is logged as a single mutation that replays.
+	last := ml.entries[len(ml.entries)-1]
+	if last.Op != MutationReplace || last.Path != "/site" || !last.Cid.Equals(newNd.Cid()) {
+		t.Fatalf("unexpected mutation logged: %+v", last)
+	}
+	replay, err := NewRoot(ctx, ds, emptyDirNode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReplayLog(ctx, replay, ml.entries); err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := replay.GetDirectory().GetNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Cid().Equals(final.Cid()) {
+		t.Fatal("replayed tree differs")
+	}
+
+	// A handle to the replaced directory can't revert the replacement.
+	if _, err := oldSite.(*Directory).Mkdir("stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldSite.Flush(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+	if nd, err := dir.GetNode(); err != nil {
+		t.Fatal(err)
+	} else if !nd.Cid().Equals(final.Cid()) {
+		t.Fatal("the stale handle changed the root")
+	}
+	if _, err := Lookup(rt, "/site/stale"); err != os.ErrNotExist {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	c := mkdirP(t, dir, "a/b/c")
+	ancestors, err := c.Ancestors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, a := range ancestors {
+		paths = append(paths, a.Path())
+	}
+	if strings.Join(paths, ",") != "/a/b,/a,/" {
+		t.Fatalf("unexpected ancestors: %v", paths)
+	}
+	if ancestors[len(ancestors)-1] != dir {
+		t.Fatal("expected the root directory last")
+	}
+
+	ancestors, err = dir.Ancestors()
+	if err != nil || len(ancestors) != 0 {
+		t.Fatalf("expected no ancestors for the root, got %v (%v)", ancestors, err)
+	}
+
+	a, err := lookupDir(rt, "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unlink("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Ancestors(); err != ErrDetached {
+		t.Fatalf("expected ErrDetached, got %v", err)
+	}
+
+	orphan, err := NewDirectory(ctx, "orphan", emptyDirNode(), nil, rt.GetDirectory().dagService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := orphan.Ancestors(); err == nil {
+		t.Fatal("expected error for a directory without a root")
+	}
+}
+
+type unreadableReader struct{ t *testing.T }
+
+func (r unreadableReader) Read([]byte) (int, error) {
+	r.t.Error("unexpected read")
+	return 0, io.EOF
+}
+
+func TestAddFileFromReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, rt := setupRoot(ctx, t)
+
+	dir := rt.GetDirectory()
+	v1 := mkdirP(t, dir, "v1")
+	v1.SetCidBuilder(dag.V1CidPrefix())
+
+	data := make([]byte, 3*chunker.DefaultBlockSize/2)
+	rand.Read(data)
+	for _, tc := range []struct {
+		dir       *Directory
+		pth       string
+		rawLeaves bool
+	}{
+		{dir, "/f", false},
+		{v1, "/v1/f", true},
+	} {
+		c, err := tc.dir.AddFileFromReader(ctx, "f", bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Version() != tc.dir.GetCidBuilder().(cid.Prefix).Version {
+			t.Fatalf("%s: unexpected CID version %d", tc.pth, c.Version())
+		}
+		nd, err := rt.dagService().Get(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		links := nd.Links()
+		if len(links) != 2 {
+			t.Fatalf("%s: expected 2 blocks, got %d", tc.pth, len(links))
+		}
+		if raw := links[0].Cid.Type() == cid.Raw; raw != tc.rawLeaves {
+			t.Fatalf("%s: expected raw leaves %t", tc.pth, tc.rawLeaves)
+		}
+
+		fd, err := OpenFile(ctx, rt, tc.pth, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%s: unexpected content", tc.pth)
+		}
+	}
+
+	// An existing name is rejected before reading.
+	if _, err := dir.AddFileFromReader(ctx, "f", unreadableReader{t}); err != ErrDirExists {
+		t.Fatalf("expected ErrDirExists, got %v", err)
+	}
+
+	// Only one of concurrent adds of the same name succeeds.
+	var wg sync.WaitGroup
+	var added int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dir.AddFileFromReader(ctx, "same", strings.NewReader("content")); err == nil {
+				atomic.AddInt32(&added, 1)
+			} else if err != ErrDirExists {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if added != 1 {
+		t.Fatalf("expected a single add, got %d", added)
+	}
+}
@@ -1,15 +1,28 @@
 package mfs
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	gopath "path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	dag "github.com/ipfs/go-merkledag"
 	path "github.com/ipfs/go-path"
+	ft "github.com/ipfs/go-unixfs"
+	uio "github.com/ipfs/go-unixfs/io"
 
+	blocks "github.com/ipfs/go-block-format"
 	cid "github.com/ipfs/go-cid"
+	cbor "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 )
 
@@ -48,17 +61,30 @@ func Mv(r *Root, src, dst string) error {
 		return err
 	}
 
+	// A directory can't be moved inside itself.
+	srcDirObj, _ := srcObj.(*Directory)
+	if srcDirObj != nil && dstDir.isWithin(srcDirObj) {
+		return ErrCycleDetected
+	}
+
 	nd, err := srcObj.GetNode()
 	if err != nil {
 		return err
 	}
 
 	fsn, err := dstDir.Child(dstFname)
+	if err == nil && fsn == srcObj && dstFname != srcFname {
+		// Only changing the case of the name (see `Root.CaseInsensitive`).
+		return dstDir.renameCase(dstDir.ctx, srcFname, dstFname)
+	}
 	if err == nil {
 		switch n := fsn.(type) {
 		case *File:
 			_ = dstDir.Unlink(dstFname)
 		case *Directory:
+			if n == srcDirObj {
+				return ErrCycleDetected
+			}
 			dstDir = n
 			dstFname = srcFname
 		default:
@@ -73,7 +99,10 @@ func Mv(r *Root, src, dst string) error {
 		return err
 	}
 
-	if srcDir.name == dstDir.name && srcFname == dstFname {
+	// Same entry, nothing to remove. The directories are compared (not
+	// just their names), and names exactly, so a move that only changes
+	// the case of the name doesn't unlink the entry just added.
+	if srcDir == dstDir && srcFname == dstFname {
 		return nil
 	}
 
@@ -94,6 +123,67 @@ func lookupDir(r *Root, path string) (*Directory, error) {
 	return d, nil
 }
 
+// SplitPath resolves all the components of 'pth' but the last one to the
+// directory containing it, returning it with the last component. The path
+// is cleaned first (it's always relative to the root, trailing slashes are
+// ignored), the root itself has no parent and returns an error.
+func SplitPath(ctx context.Context, rt *Root, pth string) (parent *Directory, name string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	dirp, name := gopath.Split(gopath.Clean("/" + pth))
+	if name == "" {
+		return nil, "", fmt.Errorf("the root directory has no parent")
+	}
+
+	parent, err = lookupDir(rt, dirp)
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, name, nil
+}
+
+// CommonAncestor returns the deepest path that is an ancestor of (or equal
+// to) both 'a' and 'b', from the path components alone (without resolving
+// anything). The paths are cleaned first (as relative to the root), so the
+// result is always absolute, "/" if they only share the root.
+func CommonAncestor(a, b string) string {
+	ca := strings.Split(gopath.Clean("/"+a), "/")
+	cb := strings.Split(gopath.Clean("/"+b), "/")
+
+	n := 0
+	for n < len(ca) && n < len(cb) && ca[n] == cb[n] {
+		n++
+	}
+	return gopath.Clean("/" + strings.Join(ca[:n], "/"))
+}
+
+// CommonAncestorDir resolves the `CommonAncestor` of 'a' and 'b' to its
+// directory. If one of them is an ancestor of the other the common one
+// is the ancestor itself, which must be a directory.
+func CommonAncestorDir(ctx context.Context, rt *Root, a, b string) (*Directory, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return lookupDir(rt, CommonAncestor(a, b))
+}
+
+// PathType returns the type of the entry at 'pth': `TDir`, `TFile` or
+// `TSymlink`. Only the directories containing it are loaded, the entry
+// itself is inspected from its node (unless it's already cached).
+func PathType(ctx context.Context, rt *Root, pth string) (NodeType, error) {
+	if gopath.Clean("/"+pth) == "/" {
+		return TDir, nil
+	}
+
+	parent, name, err := SplitPath(ctx, rt, pth)
+	if err != nil {
+		return 0, err
+	}
+	return parent.entryType(ctx, name)
+}
+
 // PutNode inserts 'nd' at 'path' in the given mfs
 // TODO: Rename or clearly document that this is not about nodes but actually
 // MFS files/directories (that in the underlying representation can be
@@ -128,6 +218,12 @@ type MkdirOpts struct {
 // Mkdir creates a directory at 'path' under the directory 'd', creating
 // intermediary directories as needed if 'mkparents' is set to true
 func Mkdir(r *Root, pth string, opts MkdirOpts) error {
+	return MkdirContext(r.context(), r, pth, opts)
+}
+
+// MkdirContext creates a directory as `Mkdir`, with 'ctx' for the lookups
+// and creations of the directories along 'pth'.
+func MkdirContext(ctx context.Context, r *Root, pth string, opts MkdirOpts) error {
 	if pth == "" {
 		return fmt.Errorf("no path given to Mkdir")
 	}
@@ -150,10 +246,13 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 	}
 
 	cur := r.GetDirectory()
+	if cur == nil {
+		return ErrFileRoot
+	}
 	for i, d := range parts[:len(parts)-1] {
-		fsn, err := cur.Child(d)
+		fsn, err := cur.ChildContext(ctx, d)
 		if err == os.ErrNotExist && opts.Mkparents {
-			mkd, err := cur.Mkdir(d)
+			mkd, err := cur.mkdir(ctx, d, opts.CidBuilder)
 			if err != nil {
 				return err
 			}
@@ -172,7 +271,7 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 		cur = next
 	}
 
-	final, err := cur.Mkdir(parts[len(parts)-1])
+	final, err := cur.mkdir(ctx, parts[len(parts)-1], opts.CidBuilder)
 	if err != nil {
 		if !opts.Mkparents || err != os.ErrExist || final == nil {
 			return err
@@ -193,9 +292,18 @@ func Mkdir(r *Root, pth string, opts MkdirOpts) error {
 }
 
 // Lookup extracts the root directory and performs a lookup under it.
-// TODO: Now that the root is always a directory, can this function
-// be collapsed with `DirLookup`? Or at least be made a method of `Root`?
+// For a single-file `Root` (see `NewFileRoot`) the root path returns the
+// file and any other one `ErrFileRoot`.
+// TODO: Can this function be collapsed with `DirLookup`? Or at least be
+// made a method of `Root`?
 func Lookup(r *Root, path string) (FSNode, error) {
+	if fi := r.GetFile(); fi != nil {
+		if strings.Trim(path, "/") != "" {
+			return nil, ErrFileRoot
+		}
+		return fi, nil
+	}
+
 	dir := r.GetDirectory()
 
 	return DirLookup(dir, path)
@@ -228,6 +336,113 @@ func DirLookup(d *Directory, pth string) (FSNode, error) {
 	return cur, nil
 }
 
+// ResolveOptions configures `ResolvePath`.
+type ResolveOptions struct {
+	// MaxSteps bounds the work of the resolution, e.g., of paths from
+	// untrusted input: every path segment resolved (each one may fetch a
+	// node) and every symlink followed count as a step, including the
+	// segments of symlink targets. Exceeding it aborts the resolution with
+	// `ErrResolutionBudgetExceeded`. Zero means no limit.
+	MaxSteps int
+
+	// Resolve the symlinks found along the path, the last segment included,
+	// to their targets (relative ones from the directory of the symlink).
+	// Following more than 40 of them returns `ErrSymlinkLoop`. Unlike the
+	// listings (see `RecursiveListOptions.FollowSymlinks`), which keep a
+	// dangling symlink as it is, resolving one fails with `os.ErrNotExist`
+	// as it does for a missing entry: the path names its target.
+	FollowSymlinks bool
+}
+
+// ResolvePath looks up 'pth' as `Lookup` within the limits of 'opts'.
+func ResolvePath(ctx context.Context, r *Root, pth string, opts ResolveOptions) (FSNode, error) {
+	if r.GetFile() != nil {
+		return Lookup(r, pth)
+	}
+
+	steps, hops := 0, 0
+	step := func() error {
+		steps++
+		if opts.MaxSteps > 0 && steps > opts.MaxSteps {
+			return fmt.Errorf("%w: %s", ErrResolutionBudgetExceeded, pth)
+		}
+		return ctx.Err()
+	}
+
+	splitPath := func(p string) []string {
+		p = strings.Trim(gopath.Clean("/"+p), "/")
+		if p == "" {
+			return nil
+		}
+		return strings.Split(p, "/")
+	}
+
+	var cur FSNode = r.GetDirectory()
+	curPath := "/"
+	remaining := splitPath(pth)
+	for len(remaining) > 0 {
+		name := remaining[0]
+		remaining = remaining[1:]
+
+		if err := step(); err != nil {
+			return nil, err
+		}
+		dir, ok := cur.(*Directory)
+		if !ok {
+			return nil, fmt.Errorf("cannot access %s: Not a directory", gopath.Join(curPath, name))
+		}
+		child, err := dir.ChildContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if fi, ok := child.(*File); ok && opts.FollowSymlinks && fi.isSymlink() {
+			if hops == maxSymlinkHops {
+				return nil, fmt.Errorf("%w: %s", ErrSymlinkLoop, pth)
+			}
+			hops++
+			if err := step(); err != nil {
+				return nil, err
+			}
+
+			target, err := fi.symlinkTarget()
+			if err != nil {
+				return nil, err
+			}
+			if !gopath.IsAbs(target) {
+				target = gopath.Join(curPath, target)
+			}
+			// Resolved again from the root, the target may go up.
+			remaining = append(splitPath(target), remaining...)
+			cur, curPath = r.GetDirectory(), "/"
+			continue
+		}
+
+		cur, curPath = child, gopath.Join(curPath, name)
+	}
+	return cur, nil
+}
+
+// ReplaceSubtree replaces the existing entry at 'pth' (of any type) with
+// 'newNode', a UnixFS directory or file (e.g., a freshly built tree to
+// deploy), in a single update of its parent directory: the node is added to
+// the DAG service and linked in place of the old one under the lock of the
+// parent, so no intermediate state is ever visible, and the cached subtree
+// of the old entry is dropped (its changes not flushed yet are discarded,
+// flushing an existing handle to it fails with `ErrDetached`). It returns
+// the CID the old entry was linked with (e.g., to roll back). The root itself can't be replaced.
+func ReplaceSubtree(ctx context.Context, rt *Root, pth string, newNode ipld.Node) (cid.Cid, error) {
+	if rt.GetFile() != nil {
+		return cid.Undef, ErrFileRoot
+	}
+
+	parent, name, err := SplitPath(ctx, rt, pth)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return parent.replaceChild(ctx, name, newNode)
+}
+
 // TODO: Document this function and link its functionality
 // with the republisher.
 func FlushPath(ctx context.Context, rt *Root, pth string) (ipld.Node, error) {
@@ -244,3 +459,2160 @@ func FlushPath(ctx context.Context, rt *Root, pth string) (ipld.Node, error) {
 	rt.repub.WaitPub(ctx)
 	return nd.GetNode()
 }
+
+// Stat returns the listing of the file or directory at 'pth' (named after
+// its last component, "/" for the root). The size of files is the size of
+// their content, the one of directories is only set (to the cumulative size
+// of their DAG) if 'includeDirSize' is set, as it may be expensive.
+func Stat(ctx context.Context, rt *Root, pth string, includeDirSize bool) (*NodeListing, error) {
+	fsn, err := Lookup(rt, pth)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	nl, err := nodeListing(gopath.Base(gopath.Clean("/"+pth)), fsn, includeDirSize)
+	if err != nil {
+		return nil, err
+	}
+	return &nl, nil
+}
+
+// Symlink creates at 'pth' a UnixFS symlink node storing the literal
+// 'target' (which isn't resolved nor required to exist). Tools importing
+// a filesystem should use it to preserve symlinks instead of following
+// them, `Readlink` returns the target back when exporting.
+func Symlink(r *Root, pth string, target string) error {
+	data, err := ft.SymlinkData(target)
+	if err != nil {
+		return err
+	}
+
+	nd := dag.NodeWithData(data)
+	dirp, _ := gopath.Split(gopath.Clean("/" + pth))
+	pdir, err := lookupDir(r, dirp)
+	if err != nil {
+		return err
+	}
+	nd.SetCidBuilder(pdir.GetCidBuilder())
+
+	return PutNode(r, gopath.Clean("/"+pth), nd)
+}
+
+// Readlink returns the target of the symlink at 'pth'.
+func Readlink(r *Root, pth string) (string, error) {
+	fsn, err := Lookup(r, pth)
+	if err != nil {
+		return "", err
+	}
+
+	fi, ok := fsn.(*File)
+	if !ok || !fi.isSymlink() {
+		return "", fmt.Errorf("%s is not a symlink", pth)
+	}
+
+	return fi.symlinkTarget()
+}
+
+// O_MKPARENTS can be combined with `os.O_CREATE` in the flags of `OpenFile`
+// to also create the missing parent directories of the file. Its value
+// isn't used by any of the `os.O_*` flags.
+const O_MKPARENTS = 1 << 30
+
+// OpenFile opens the file at 'pth' with `os.OpenFile`-like 'flags':
+// exactly one of `os.O_RDONLY`, `os.O_WRONLY` or `os.O_RDWR`, optionally
+// combined with `os.O_CREATE` (with `os.O_EXCL` and `O_MKPARENTS`),
+// `os.O_TRUNC`, `os.O_APPEND` and `os.O_SYNC` (which maps to `Flags.Sync`).
+// `os.O_APPEND` only positions the descriptor at the end of the file when
+// it's opened, later seeks aren't restricted.
+func OpenFile(ctx context.Context, rt *Root, pth string, flags int) (FileDescriptor, error) {
+	return OpenFileWithOpts(ctx, rt, pth, flags, OpenFileOpts{})
+}
+
+// OpenFileOpts is used by OpenFileWithOpts
+type OpenFileOpts struct {
+	// BlockSize, if non-zero, is the size of the chunks the content of a
+	// file created by the call is split into (see
+	// `NewFileWithBlockSize`). It's ignored if the file already exists.
+	BlockSize int
+}
+
+// OpenFileWithOpts is like `OpenFile` but with the options 'opts' applied
+// to the creation of the file.
+func OpenFileWithOpts(ctx context.Context, rt *Root, pth string, flags int, opts OpenFileOpts) (FileDescriptor, error) {
+	if opts.BlockSize < 0 {
+		return nil, fmt.Errorf("invalid block size: %d", opts.BlockSize)
+	}
+
+	var fdFlags Flags
+	switch flags & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		fdFlags.Read = true
+	case os.O_WRONLY:
+		fdFlags.Write = true
+	case os.O_RDWR:
+		fdFlags.Read = true
+		fdFlags.Write = true
+	default:
+		return nil, fmt.Errorf("invalid access mode in open flags: %#x", flags)
+	}
+	fdFlags.Sync = flags&os.O_SYNC == os.O_SYNC
+
+	if !fdFlags.Write && flags&(os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, fmt.Errorf("cannot truncate or append to %s: opened read-only", pth)
+	}
+
+	fsn, err := Lookup(rt, pth)
+	switch {
+	case err == nil:
+		if flags&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, os.ErrExist
+		}
+	case err == os.ErrNotExist && flags&os.O_CREATE != 0:
+		var fi *File
+		fi, err = createFile(rt, pth, flags&O_MKPARENTS != 0)
+		if err != nil {
+			return nil, err
+		}
+		if opts.BlockSize != 0 {
+			fi.setBlockSize(opts.BlockSize)
+		}
+		fsn = fi
+	default:
+		return nil, err
+	}
+
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, ErrIsDirectory
+	}
+	if fi.isSymlink() {
+		return nil, fmt.Errorf("cannot open %s: is a symlink", pth)
+	}
+
+	fd, err := fi.OpenContext(ctx, fdFlags)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags&os.O_TRUNC != 0 {
+		err = fd.Truncate(0)
+	} else if flags&os.O_APPEND != 0 {
+		_, err = fd.Seek(0, io.SeekEnd)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return fd, nil
+}
+
+// createFile adds an empty file at 'pth' (see `Root.EmptyFiles`), with the
+// CID builder of its parent directory (which is created if 'mkparents' is
+// set).
+func createFile(rt *Root, pth string, mkparents bool) (*File, error) {
+	dirp, fname := gopath.Split(gopath.Clean("/" + pth))
+	if fname == "" {
+		return nil, fmt.Errorf("cannot create file with empty name")
+	}
+
+	if mkparents {
+		err := Mkdir(rt, dirp, MkdirOpts{Mkparents: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pdir, err := lookupDir(rt, dirp)
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := emptyFileNode(emptyFileFormat(rt), pdir.GetCidBuilder())
+	if err != nil {
+		return nil, err
+	}
+	err = pdir.AddChild(fname, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	fsn, err := pdir.Child(fname)
+	if err != nil {
+		return nil, err
+	}
+	fi, ok := fsn.(*File)
+	if !ok {
+		return nil, fmt.Errorf("%s was replaced by a directory", pth)
+	}
+	return fi, nil
+}
+
+// TrashDirName is the name of the directory (under the root) where
+// `SoftDelete` moves the deleted entries.
+const TrashDirName = ".trash"
+
+// SoftDelete moves the entry at 'pth' to the trash directory (creating it
+// if needed) instead of unlinking it, so it can be recovered later with
+// `Restore`. The entry name in the trash records the deletion time and
+// the original path. The entry and the trash directory are looked up (or
+// created) with 'ctx', which is checked again before moving the entry.
+func SoftDelete(ctx context.Context, rt *Root, pth string) error {
+	pth = gopath.Clean("/" + pth)
+	if pth == "/" {
+		return fmt.Errorf("cannot delete the root directory")
+	}
+	if strings.SplitN(pth[1:], "/", 2)[0] == TrashDirName {
+		return fmt.Errorf("cannot soft delete %s: already in the trash", pth)
+	}
+
+	if _, err := ResolvePath(ctx, rt, pth, ResolveOptions{}); err != nil {
+		return err
+	}
+
+	err := MkdirContext(ctx, rt, "/"+TrashDirName, MkdirOpts{Mkparents: true})
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	trashName := strconv.FormatInt(time.Now().UnixNano(), 10) + "-" + url.PathEscape(pth)
+	return Mv(rt, pth, gopath.Join("/", TrashDirName, trashName))
+}
+
+// parseTrashName extracts the deletion time and original path
+// from the name of an entry in the trash.
+func parseTrashName(trashName string) (time.Time, string, error) {
+	parts := strings.SplitN(trashName, "-", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", fmt.Errorf("invalid trash entry name: %s", trashName)
+	}
+
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid trash entry name: %s", trashName)
+	}
+
+	pth, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid trash entry name: %s", trashName)
+	}
+
+	return time.Unix(0, nsec), pth, nil
+}
+
+// Restore moves the trash entry 'trashName' back to its original path,
+// which must not have been taken in the meantime (checked with 'ctx', as
+// in `SoftDelete`).
+func Restore(ctx context.Context, rt *Root, trashName string) error {
+	_, pth, err := parseTrashName(trashName)
+	if err != nil {
+		return err
+	}
+
+	_, err = ResolvePath(ctx, rt, pth, ResolveOptions{})
+	if err == nil {
+		return fmt.Errorf("cannot restore %s: %s", pth, os.ErrExist)
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return Mv(rt, gopath.Join("/", TrashDirName, trashName), pth)
+}
+
+// PurgeTrash permanently unlinks the trash entries deleted more than
+// 'olderThan' ago, returning how many of them were removed.
+func PurgeTrash(ctx context.Context, rt *Root, olderThan time.Duration) (int, error) {
+	fsn, err := ResolvePath(ctx, rt, "/"+TrashDirName, ResolveOptions{})
+	if err == os.ErrNotExist {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	trash, ok := fsn.(*Directory)
+	if !ok {
+		return 0, fmt.Errorf("/%s is not a directory", TrashDirName)
+	}
+
+	names, err := trash.ListNames(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return purged, err
+		}
+
+		deleted, _, err := parseTrashName(name)
+		if err != nil {
+			// Not created by `SoftDelete`, leave it alone.
+			continue
+		}
+		if time.Since(deleted) <= olderThan {
+			continue
+		}
+
+		err = trash.UnlinkContext(ctx, name)
+		if err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// CollectCids flushes the directory 'd' and returns the (deduplicated) CIDs
+// of all the blocks reachable from its node, including the internal nodes of
+// file DAGs and HAMT shards, i.e., everything needed to pin the subtree.
+func CollectCids(ctx context.Context, d *Directory) ([]cid.Cid, error) {
+	err := d.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	nd, err := d.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	set := cid.NewSet()
+	set.Add(nd.Cid())
+	err = dag.EnumerateChildren(ctx, dag.GetLinksWithDAG(d.dagService), nd.Cid(), set.Visit)
+	if err != nil {
+		return nil, err
+	}
+
+	return set.Keys(), nil
+}
+
+// DeltaSize returns the total size of the blocks reachable from the current
+// node of the directory 'b' that aren't reachable from the one of 'a', e.g.,
+// to estimate how much transferring 'b' to a node already storing 'a' would
+// cost. Both trees are walked side by side by entry name, skipping entries
+// with the same CID (whose subtrees aren't fetched); only the differing
+// parts of both trees are collected and compared. Blocks of 'b' that are
+// in 'a' only under entries shared by both trees (e.g., a copied subtree)
+// are counted as new.
+func DeltaSize(ctx context.Context, a, b *Directory) (int64, error) {
+	nda, err := a.GetNode()
+	if err != nil {
+		return 0, err
+	}
+	ndb, err := b.GetNode()
+	if err != nil {
+		return 0, err
+	}
+
+	dw := &deltaWalker{
+		dsa:  a.dagService,
+		dsb:  b.dagService,
+		seen: make(map[cid.Cid]bool),
+		newb: make(map[cid.Cid]int64),
+	}
+	err = dw.diffDirs(ctx, nda, ndb)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for c, size := range dw.newb {
+		if !dw.seen[c] {
+			total += size
+		}
+	}
+	return total, nil
+}
+
+// deltaWalker collects the blocks of the differing parts of two trees:
+// `seen` (the ones of the first tree) and `newb` (the ones of the second
+// tree with their size).
+type deltaWalker struct {
+	dsa, dsb ipld.DAGService
+	seen     map[cid.Cid]bool
+	newb     map[cid.Cid]int64
+}
+
+func (dw *deltaWalker) diffDirs(ctx context.Context, nda, ndb ipld.Node) error {
+	if err := dw.dirBlocks(ctx, dw.dsa, nda, dw.addA); err != nil {
+		return err
+	}
+	if err := dw.dirBlocks(ctx, dw.dsb, ndb, dw.addB); err != nil {
+		return err
+	}
+
+	entriesA, err := dirLinks(ctx, dw.dsa, nda)
+	if err != nil {
+		return err
+	}
+	entriesB, err := dirLinks(ctx, dw.dsb, ndb)
+	if err != nil {
+		return err
+	}
+
+	for name, lb := range entriesB {
+		la, ok := entriesA[name]
+		delete(entriesA, name)
+		if ok && la.Cid.Equals(lb.Cid) {
+			continue
+		}
+
+		cb, err := lb.GetNode(ctx, dw.dsb)
+		if err != nil {
+			return err
+		}
+		if ok && isDirNode(cb) {
+			ca, err := la.GetNode(ctx, dw.dsa)
+			if err != nil {
+				return err
+			}
+			if isDirNode(ca) {
+				if err := dw.diffDirs(ctx, ca, cb); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		if ok {
+			if err := dw.collect(ctx, dw.dsa, la.Cid, dw.addA); err != nil {
+				return err
+			}
+		}
+		if err := dw.collect(ctx, dw.dsb, lb.Cid, dw.addB); err != nil {
+			return err
+		}
+	}
+
+	// Entries only in the first tree.
+	for _, la := range entriesA {
+		if err := dw.collect(ctx, dw.dsa, la.Cid, dw.addA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dw *deltaWalker) addA(nd ipld.Node) bool {
+	if dw.seen[nd.Cid()] {
+		return false
+	}
+	dw.seen[nd.Cid()] = true
+	return true
+}
+
+func (dw *deltaWalker) addB(nd ipld.Node) bool {
+	if _, ok := dw.newb[nd.Cid()]; ok {
+		return false
+	}
+	dw.newb[nd.Cid()] = int64(len(nd.RawData()))
+	return true
+}
+
+// collect adds (through 'add') all the blocks of the DAG of 'c'.
+func (dw *deltaWalker) collect(ctx context.Context, dserv ipld.DAGService, c cid.Cid, add func(ipld.Node) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	nd, err := dserv.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	if !add(nd) {
+		return nil
+	}
+	for _, l := range nd.Links() {
+		if err := dw.collect(ctx, dserv, l.Cid, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirBlocks adds (through 'add') the blocks of the directory node 'nd'
+// itself, i.e., the node and, for HAMTs, its internal shards.
+func (dw *deltaWalker) dirBlocks(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, add func(ipld.Node) bool) error {
+	if !add(nd) {
+		return nil
+	}
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return dag.ErrNotProtobuf
+	}
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return err
+	}
+	if fsn.Type() != ft.THAMTShard {
+		return nil
+	}
+
+	padLen := len(fmt.Sprintf("%X", fsn.Fanout()-1))
+	for _, l := range pbnd.Links() {
+		if len(l.Name) != padLen {
+			continue
+		}
+		shard, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		if err := dw.dirBlocks(ctx, dserv, shard, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirLinks returns the links of the entries of the directory node 'nd'
+// by name.
+func dirLinks(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (map[string]*ipld.Link, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]*ipld.Link)
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		out[l.Name] = &ipld.Link{Name: l.Name, Size: l.Size, Cid: l.Cid}
+		return nil
+	})
+	return out, err
+}
+
+// ChunkOverlap compares the leaf blocks (the chunks holding the contents)
+// of the files 'a' and 'b' and returns the data size of the distinct chunks
+// present in both (`shared`) and of the distinct chunks of either of them
+// (`total`), e.g., to evaluate how much a chunker deduplicates between
+// similar files. Chunks repeated inside a file are counted once.
+func ChunkOverlap(ctx context.Context, a, b *File) (shared, total int64, err error) {
+	leavesA := make(map[cid.Cid]int64)
+	err = a.leafSizes(ctx, leavesA)
+	if err != nil {
+		return 0, 0, err
+	}
+	leavesB := make(map[cid.Cid]int64)
+	err = b.leafSizes(ctx, leavesB)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for c, size := range leavesA {
+		total += size
+		if _, ok := leavesB[c]; ok {
+			shared += size
+		}
+	}
+	for c, size := range leavesB {
+		if _, ok := leavesA[c]; !ok {
+			total += size
+		}
+	}
+	return shared, total, nil
+}
+
+// RebuildWithCidBuilder rewrites the directory 'd' and all the directories
+// under it with the CID builder 'b' (e.g., to migrate a subtree to CIDv1),
+// flushes the result and returns the new CID of 'd'. HAMT directories keep
+// their fanout. Files (and other non-directory entries) are linked as they
+// are, their DAGs are not re-chunked.
+// CAUTION: References to children of 'd' obtained before calling this
+// function will be stale (see `Root.FlushMemFree`).
+func RebuildWithCidBuilder(ctx context.Context, d *Directory, b cid.Builder) (cid.Cid, error) {
+	nd, err := d.GetNode()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	nd, err = rebuildDirNode(ctx, d.dagService, nd, b)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	err = d.replaceNode(nd)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	err = d.Flush()
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	return nd.Cid(), nil
+}
+
+// rebuildDirNode returns a copy of the directory node 'nd' built with the
+// CID builder 'b', recursively rebuilding (and adding to 'dserv') all the
+// directories under it.
+func rebuildDirNode(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, b cid.Builder) (ipld.Node, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*ipld.Link
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links = append(links, &ipld.Link{Name: l.Name, Size: l.Size, Cid: l.Cid})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, l := range links {
+		if l.Cid.Type() == cid.Raw {
+			continue
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return nil, err
+		}
+		if !isDirNode(cnd) {
+			continue
+		}
+
+		cnd, err = rebuildDirNode(ctx, dserv, cnd, b)
+		if err != nil {
+			return nil, err
+		}
+		err = dserv.Add(ctx, cnd)
+		if err != nil {
+			return nil, err
+		}
+
+		links[i], err = ipld.MakeLink(cnd)
+		if err != nil {
+			return nil, err
+		}
+		links[i].Name = l.Name
+	}
+
+	fsn, err := ft.ExtractFSNode(nd)
+	if err != nil {
+		return nil, err
+	}
+
+	if fsn.Type() == ft.THAMTShard {
+		hamtDir, err := newHAMTDirectory(ctx, dserv, links, int(fsn.Fanout()), b)
+		if err != nil {
+			return nil, err
+		}
+		return hamtDir.GetNode()
+	}
+
+	out := ft.EmptyDirNode()
+	out.SetCidBuilder(b)
+	for _, l := range links {
+		err = out.AddRawLink(l.Name, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// RecomputeSizes rewrites the directory 'd' and all the directories under
+// it so the sizes of their links are the actual cumulative sizes of the DAGs
+// they point to (the inaccurate ones of older importers end up in listings),
+// and flushes the result. The nodes of files are trusted: their links aren't
+// rewritten (which would change their CIDs), their size is computed from
+// their root nodes. Directories keep their CID builders (and HAMTs their
+// fanout).
+// CAUTION: References to children of 'd' obtained before calling this
+// function will be stale (see `Root.FlushMemFree`).
+func RecomputeSizes(ctx context.Context, d *Directory) error {
+	nd, err := d.GetNode()
+	if err != nil {
+		return err
+	}
+
+	nd, err = recomputeDirSizes(ctx, d.dagService, nd)
+	if err != nil {
+		return err
+	}
+
+	err = d.replaceNode(nd)
+	if err != nil {
+		return err
+	}
+	return d.Flush()
+}
+
+// recomputeDirSizes returns a copy of the directory node 'nd' with links
+// (re)made from the nodes they point to, recursively rewriting (and adding
+// to 'dserv') all the directories under it.
+func recomputeDirSizes(ctx context.Context, dserv ipld.DAGService, nd ipld.Node) (ipld.Node, error) {
+	pbnd, ok := nd.(*dag.ProtoNode)
+	if !ok {
+		return nil, dag.ErrNotProtobuf
+	}
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	var links []*ipld.Link
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		links = append(links, &ipld.Link{Name: l.Name, Size: l.Size, Cid: l.Cid})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, l := range links {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return nil, err
+		}
+		if isDirNode(cnd) {
+			cnd, err = recomputeDirSizes(ctx, dserv, cnd)
+			if err != nil {
+				return nil, err
+			}
+			err = dserv.Add(ctx, cnd)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		links[i], err = ipld.MakeLink(cnd)
+		if err != nil {
+			return nil, err
+		}
+		links[i].Name = l.Name
+	}
+
+	fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+	if err != nil {
+		return nil, err
+	}
+
+	if fsn.Type() == ft.THAMTShard {
+		hamtDir, err := newHAMTDirectory(ctx, dserv, links, int(fsn.Fanout()), pbnd.CidBuilder())
+		if err != nil {
+			return nil, err
+		}
+		return hamtDir.GetNode()
+	}
+
+	out := ft.EmptyDirNode()
+	out.SetCidBuilder(pbnd.CidBuilder())
+	for _, l := range links {
+		err = out.AddRawLink(l.Name, l)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// FindLargeFiles returns the (up to 'limit', if positive) files under the
+// directory 'd' bigger than 'minSize', biggest first, named after their path
+// relative to 'd'. The subtree is walked in the DAG from the current node
+// of 'd' (without caching its entries), file sizes are read from the
+// UnixFS metadata of their root nodes.
+func FindLargeFiles(ctx context.Context, d *Directory, minSize int64, limit int) ([]NodeListing, error) {
+	nd, err := d.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []NodeListing
+	err = findLargeFiles(ctx, d.dagService, nd, "", minSize, &out)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Size > out[j].Size
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func findLargeFiles(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, prefix string, minSize int64, out *[]NodeListing) error {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return err
+	}
+
+	return dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		name := gopath.Join(prefix, l.Name)
+
+		var size int64
+		switch cnd := cnd.(type) {
+		case *dag.ProtoNode:
+			fsn, err := ft.FSNodeFromBytes(cnd.Data())
+			if err != nil {
+				return err
+			}
+			switch fsn.Type() {
+			case ft.TDirectory, ft.THAMTShard:
+				return findLargeFiles(ctx, dserv, cnd, name, minSize, out)
+			case ft.TFile, ft.TRaw:
+				size = int64(fsn.FileSize())
+			default:
+				return nil
+			}
+		case *dag.RawNode:
+			size = int64(len(cnd.RawData()))
+		default:
+			return nil
+		}
+
+		if size > minSize {
+			*out = append(*out, NodeListing{
+				Name: name,
+				Type: int(TFile),
+				Size: size,
+				Hash: cnd.Cid().String(),
+			})
+		}
+		return nil
+	})
+}
+
+// FindEmptyDirs returns the (sorted) paths, relative to 'd', of the
+// directories under 'd' without entries. The subtree is walked in the DAG
+// from the current node of 'd' (without caching its entries). See
+// `Directory.PruneEmptyDirs` to remove them.
+func FindEmptyDirs(ctx context.Context, d *Directory) ([]string, error) {
+	nd, err := d.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	_, err = findEmptyDirs(ctx, d.dagService, nd, "", &out)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// findEmptyDirs appends to 'out' the paths of the empty directories under
+// the directory node 'nd' and reports if 'nd' itself is empty.
+func findEmptyDirs(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, prefix string, out *[]string) (bool, error) {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return false, err
+	}
+
+	empty := true
+	err = dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		empty = false
+		if l.Cid.Type() == cid.Raw {
+			return nil
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		if !isDirNode(cnd) {
+			return nil
+		}
+
+		name := gopath.Join(prefix, l.Name)
+		cempty, err := findEmptyDirs(ctx, dserv, cnd, name, out)
+		if err != nil {
+			return err
+		}
+		if cempty {
+			*out = append(*out, name)
+		}
+		return nil
+	})
+	return empty, err
+}
+
+// FindNearThreshold returns the (sorted) paths, relative to 'd' ("." for
+// 'd' itself), of the basic directories under 'd' that the next additions
+// would switch to sharding: the ones with at least `Root.ShardingThreshold`
+// minus 'withinEntries' entries, or all of them if directories are always
+// sharded (`uio.UseHAMTSharding`, `Root.AlwaysShard`), none if neither is
+// set. The subtree is walked in the DAG from the current node of 'd'
+// (without caching its entries), sharded directories aren't descended.
+func FindNearThreshold(ctx context.Context, d *Directory, withinEntries int) ([]string, error) {
+	var minEntries int
+	switch {
+	case d.useSharding():
+	case d.root != nil && d.root.ShardingThreshold > 0:
+		minEntries = d.root.ShardingThreshold - withinEntries
+	default:
+		return nil, nil
+	}
+
+	nd, err := d.GetNode()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	err = findNearThreshold(ctx, d.dagService, nd, ".", minEntries, &out)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// findNearThreshold appends to 'out' the path 'pth' of the directory node
+// 'nd', if it's a basic directory with at least 'minEntries' entries, and
+// the ones of the directories under it.
+func findNearThreshold(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, pth string, minEntries int, out *[]string) error {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.(*uio.BasicDirectory); !ok {
+		return nil
+	}
+
+	links, err := dir.Links(ctx)
+	if err != nil {
+		return err
+	}
+	if len(links) >= minEntries {
+		*out = append(*out, pth)
+	}
+
+	for _, l := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if l.Cid.Type() == cid.Raw {
+			continue
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		if !isDirNode(cnd) {
+			continue
+		}
+		err = findNearThreshold(ctx, dserv, cnd, gopath.Join(pth, l.Name), minEntries, out)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneProgressInterval is the number of entries removed by `PruneSubtree`
+// between calls to its progress function.
+const pruneProgressInterval = 100
+
+// PruneSubtree removes all the entries under the directory 'd' (which is
+// kept), bottom-up, calling 'fn' (if set) with the number of entries
+// removed so far every `pruneProgressInterval` of them and once at the end.
+// If 'ctx' is cancelled it stops before the next removal returning its
+// error: every entry is removed in a single step, so the tree is left
+// consistent with the entries not yet reached still in place.
+func PruneSubtree(ctx context.Context, d *Directory, fn func(removed int)) error {
+	removed := 0
+	err := pruneSubtree(ctx, d, func() {
+		removed++
+		if fn != nil && removed%pruneProgressInterval == 0 {
+			fn(removed)
+		}
+	})
+	if fn != nil && removed%pruneProgressInterval != 0 {
+		fn(removed)
+	}
+	return err
+}
+
+// pruneSubtree implements `PruneSubtree` calling 'onRemove' after every
+// entry removed.
+func pruneSubtree(ctx context.Context, d *Directory, onRemove func()) error {
+	names, err := d.ListNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c, err := d.ChildContext(ctx, name)
+		if err != nil {
+			return err
+		}
+		if dir, ok := c.(*Directory); ok {
+			err = pruneSubtree(ctx, dir, onRemove)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = d.UnlinkContext(ctx, name)
+		if err != nil {
+			return err
+		}
+		onRemove()
+	}
+	return nil
+}
+
+// Flatten moves all the entries of the subdirectory 'childName' of 'd' into
+// 'd' and then removes the (now empty) subdirectory. An entry whose name is
+// already taken in 'd' (including by 'childName' itself, or by another
+// entry moved before it) is moved with the name returned by 'onConflict';
+// if that name is taken too, or 'onConflict' is nil, `os.ErrExist` is
+// returned, and `ErrInvalidName` if it's empty or contains a "/". All the
+// names are resolved before moving any entry, and the entries are moved
+// with the locks of both directories taken, undoing the moves done if one
+// fails, so an error leaves both directories untouched.
+func Flatten(ctx context.Context, d *Directory, childName string, onConflict func(name string) string) error {
+	defer d.checkDirtyBudget()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	c, err := d.childUnsync(ctx, childName)
+	if err != nil {
+		return err
+	}
+	sub, ok := c.(*Directory)
+	if !ok {
+		return fmt.Errorf("%s is not a directory", childName)
+	}
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	var names []string
+	err = sub.unixfsDir.ForEachLink(ctx, func(l *ipld.Link) error {
+		names = append(names, l.Name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	targets, err := flattenTargets(ctx, d, names, onConflict)
+	if err != nil {
+		return err
+	}
+
+	// The mutations are logged once all the entries are moved.
+	var log []Mutation
+	d.pendingLog, sub.pendingLog = &log, &log
+	defer func() { d.pendingLog, sub.pendingLog = nil, nil }()
+
+	var undo []func() error
+	err = flattenEntries(ctx, d, sub, names, targets, &undo)
+	if err == nil {
+		err = d.unlinkUnsync(ctx, childName)
+	}
+	if err != nil {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				return fmt.Errorf("%w (undoing the flatten failed: %s)", err, uerr)
+			}
+		}
+		return err
+	}
+
+	if d.root != nil && d.root.MutationLogger != nil {
+		for _, m := range log {
+			d.root.MutationLogger.LogMutation(m)
+		}
+	}
+	return nil
+}
+
+// flattenTargets returns the names the entries 'names' are moved with into
+// 'd' by `Flatten`. It must be called with the lock of 'd' taken.
+func flattenTargets(ctx context.Context, d *Directory, names []string, onConflict func(name string) string) ([]string, error) {
+	key := func(name string) string {
+		if d.caseInsensitive() {
+			return foldCase(name)
+		}
+		return name
+	}
+	planned := make(map[string]bool, len(names))
+	taken := func(name string) (bool, error) {
+		if planned[key(name)] {
+			return true, nil
+		}
+		_, err := d.childUnsync(ctx, name)
+		switch err {
+		case nil:
+			return true, nil
+		case os.ErrNotExist:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	targets := make([]string, len(names))
+	for i, name := range names {
+		target := name
+		conflict, err := taken(target)
+		if err != nil {
+			return nil, err
+		}
+		if conflict {
+			if onConflict == nil {
+				return nil, os.ErrExist
+			}
+			target = onConflict(name)
+			if target == "" || strings.Contains(target, "/") {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidName, target)
+			}
+			if err := d.checkName(target); err != nil {
+				return nil, err
+			}
+			conflict, err = taken(target)
+			if err != nil {
+				return nil, err
+			}
+			if conflict {
+				return nil, os.ErrExist
+			}
+		}
+		targets[i] = target
+		planned[key(target)] = true
+	}
+	return targets, nil
+}
+
+// flattenEntries moves the entries 'names' of 'sub' into 'd' with the
+// names 'targets' for `Flatten`, recording in 'undo' how to revert each
+// step done. It must be called with the locks of both directories taken.
+func flattenEntries(ctx context.Context, d, sub *Directory, names, targets []string, undo *[]func() error) error {
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fsn, err := sub.childUnsync(ctx, name)
+		if err != nil {
+			return err
+		}
+		nd, err := fsn.GetNode()
+		if err != nil {
+			return err
+		}
+		cached := sub.entriesCache[name]
+		modTime, hasModTime := sub.entryModTimes[name]
+
+		if err := sub.unlinkUnsync(ctx, name); err != nil {
+			return err
+		}
+		name := name
+		*undo = append(*undo, func() error {
+			if err := sub.addUnixFSChild(sub.ctx, child{name, nd}); err != nil {
+				return err
+			}
+			if cached != nil {
+				sub.entriesCache[name] = cached
+				if cdir, ok := cached.(*Directory); ok {
+					cdir.detached = false
+				}
+			}
+			if hasModTime {
+				sub.entryModTimes[name] = modTime
+			}
+			return nil
+		})
+
+		target := targets[i]
+		if _, err := d.addChildUnsync(ctx, target, nd, AddChildOpts{}); err != nil {
+			return err
+		}
+		*undo = append(*undo, func() error {
+			return d.unlinkUnsync(d.ctx, target)
+		})
+	}
+	return nil
+}
+
+// ManifestEntry is a line of the manifest written by `ExportManifest`.
+type ManifestEntry struct {
+	// Path relative to the exported directory.
+	Path string `json:"path"`
+	// Type is "directory", "file" or "symlink".
+	Type string `json:"type"`
+	// Size is the size of the file contents (zero for directories and
+	// symlinks).
+	Size uint64 `json:"size"`
+	Cid  string `json:"cid"`
+}
+
+// ExportManifest writes to 'w' a `ManifestEntry` (JSON encoded, one per line)
+// for every entry under the directory 'd', walking the subtree in the DAG
+// from the current node of 'd' (directories before their entries). Only the
+// root nodes of files are fetched (for their size), not their contents, the
+// size of raw leaves is taken from their links.
+func ExportManifest(ctx context.Context, d *Directory, w io.Writer) error {
+	nd, err := d.GetNode()
+	if err != nil {
+		return err
+	}
+
+	return exportManifest(ctx, d.dagService, nd, "", json.NewEncoder(w))
+}
+
+func exportManifest(ctx context.Context, dserv ipld.DAGService, nd ipld.Node, prefix string, enc *json.Encoder) error {
+	dir, err := uio.NewDirectoryFromNode(dserv, nd)
+	if err != nil {
+		return err
+	}
+
+	return dir.ForEachLink(ctx, func(l *ipld.Link) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry := ManifestEntry{
+			Path: gopath.Join(prefix, l.Name),
+			Type: "file",
+			Cid:  l.Cid.String(),
+		}
+		if l.Cid.Type() == cid.Raw {
+			entry.Size = l.Size
+			return enc.Encode(entry)
+		}
+
+		cnd, err := l.GetNode(ctx, dserv)
+		if err != nil {
+			return err
+		}
+		pbnd, ok := cnd.(*dag.ProtoNode)
+		if !ok {
+			return enc.Encode(entry)
+		}
+		fsn, err := ft.FSNodeFromBytes(pbnd.Data())
+		if err != nil {
+			return err
+		}
+
+		switch fsn.Type() {
+		case ft.TDirectory, ft.THAMTShard:
+			entry.Type = "directory"
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+			return exportManifest(ctx, dserv, pbnd, entry.Path, enc)
+		case ft.TSymlink:
+			entry.Type = "symlink"
+		default:
+			entry.Size = fsn.FileSize()
+		}
+		return enc.Encode(entry)
+	})
+}
+
+// MutationOp is the kind of a `Mutation`.
+type MutationOp int
+
+const (
+	// MutationAdd adds the node `Cid` at `Path` (see `Directory.AddChild`).
+	MutationAdd MutationOp = iota
+	// MutationUnlink removes the entry at `Path`.
+	MutationUnlink
+	// MutationMkdir creates an empty directory at `Path`, or the directory
+	// node `Cid` if it was populated from a template (see `SetTemplate`).
+	MutationMkdir
+	// MutationSwap exchanges the entries at `Path` and `Dest`.
+	MutationSwap
+	// MutationReplace replaces the entry at `Path` with the node `Cid`
+	// (see `ReplaceSubtree`).
+	MutationReplace
+	// MutationWrite sets the content of the file at `Path` to the node
+	// `Cid` (e.g., flushing a `FileDescriptor` with writes, or through
+	// `Directory.UpdateFileContent`).
+	MutationWrite
+)
+
+// Mutation describes a change in the structure of the MFS, as notified to
+// the `MutationLogger` of the `Root`. Moves are logged as the addition of
+// the destination followed by the unlink of the source. Writes to the
+// content of files are logged when their descriptors are flushed.
+type Mutation struct {
+	Op   MutationOp
+	Path string
+	// Dest is the second entry of a `MutationSwap`.
+	Dest string
+	// Cid is the node added by a `MutationAdd`, which replaced an entry
+	// of another type if `Replace` is set, by a `MutationReplace` or a
+	// `MutationMkdir` from a template, or the new content of a
+	// `MutationWrite`.
+	Cid     cid.Cid
+	Replace bool
+	Time    time.Time
+}
+
+// MutationLogger receives the mutations of an MFS (see `Root.MutationLogger`)
+// as they are applied, e.g., to append them to an audit log. It's called
+// synchronously with the lock of the mutated directory taken, it shouldn't
+// call back into the MFS.
+type MutationLogger interface {
+	LogMutation(Mutation)
+}
+
+// ReplayLog reapplies the logged 'entries' to the MFS of 'rt' in order. The
+// nodes added by the mutations must be available in the DAG service of 'rt'.
+func ReplayLog(ctx context.Context, rt *Root, entries []Mutation) error {
+	for i, m := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		err := replayMutation(ctx, rt, m)
+		if err != nil {
+			return fmt.Errorf("replaying mutation %d of %s: %s", i, m.Path, err)
+		}
+	}
+	return nil
+}
+
+func replayMutation(ctx context.Context, rt *Root, m Mutation) error {
+	pdir, name, err := SplitPath(ctx, rt, m.Path)
+	if err != nil {
+		return err
+	}
+
+	switch m.Op {
+	case MutationAdd:
+		nd, err := pdir.dagService.Get(ctx, m.Cid)
+		if err != nil {
+			return err
+		}
+		return pdir.AddChildWithOpts(name, nd, AddChildOpts{ReplaceOtherType: m.Replace})
+	case MutationUnlink:
+		return pdir.UnlinkContext(ctx, name)
+	case MutationMkdir:
+		if m.Cid.Defined() {
+			nd, err := pdir.dagService.Get(ctx, m.Cid)
+			if err != nil {
+				return err
+			}
+			return pdir.AddChild(name, nd)
+		}
+		_, err := pdir.MkdirContext(ctx, name)
+		return err
+	case MutationSwap:
+		return pdir.SwapContext(ctx, name, gopath.Base(m.Dest))
+	case MutationReplace, MutationWrite:
+		nd, err := pdir.dagService.Get(ctx, m.Cid)
+		if err != nil {
+			return err
+		}
+		_, err = pdir.replaceChild(ctx, name, nd)
+		return err
+	default:
+		return fmt.Errorf("unknown mutation: %d", m.Op)
+	}
+}
+
+// Batch accumulates operations on the MFS of a `Root` to apply them all
+// together through `Commit` (see `NewBatch`).
+type Batch struct {
+	rt  *Root
+	ops []batchOp
+}
+
+type batchOpKind int
+
+const (
+	batchMkdir batchOpKind = iota
+	batchMv
+	batchRemove
+)
+
+type batchOp struct {
+	kind     batchOpKind
+	pth, dst string
+	opts     MkdirOpts
+}
+
+func (op batchOp) String() string {
+	switch op.kind {
+	case batchMkdir:
+		return "mkdir " + op.pth
+	case batchMv:
+		return "mv " + op.pth + " " + op.dst
+	default:
+		return "rm " + op.pth
+	}
+}
+
+// NewBatch creates an empty `Batch` of operations on the MFS of 'rt'.
+func NewBatch(rt *Root) *Batch {
+	return &Batch{rt: rt}
+}
+
+// Mkdir adds the creation of the directory 'pth' to the batch (as
+// `mfs.Mkdir`, `opts.Flush` is ignored).
+func (b *Batch) Mkdir(pth string, opts MkdirOpts) {
+	opts.Flush = false
+	b.ops = append(b.ops, batchOp{kind: batchMkdir, pth: pth, opts: opts})
+}
+
+// Mv adds the move of 'src' to 'dst' to the batch (as `mfs.Mv`).
+func (b *Batch) Mv(src, dst string) {
+	b.ops = append(b.ops, batchOp{kind: batchMv, pth: src, dst: dst})
+}
+
+// Remove adds the removal of the file or directory (with all of its
+// contents) at 'pth' to the batch.
+func (b *Batch) Remove(pth string) {
+	b.ops = append(b.ops, batchOp{kind: batchRemove, pth: pth})
+}
+
+// Commit applies the operations of the batch in order and flushes the root
+// once at the end. All of them are validated first, against the MFS as the
+// operations before each one leave it, and if any would fail nothing is
+// modified and its error is returned. The directories along the paths of
+// the operations stay locked from the validation until all of them are
+// applied, so concurrent mutations of those directories wait for the commit
+// (and the ones elsewhere are unaffected), and flushes through the `Root`
+// wait for the flush of the commit. The mutations are notified to the
+// `MutationLogger` of the root only once all of them are applied.
+//
+// Some failures can only be detected while applying the operations (e.g.,
+// errors fetching nodes, or a moved directory nesting others beyond the
+// `MaxDepth` of the root), the operations applied by then are undone in
+// that case.
+func (b *Batch) Commit(ctx context.Context) error {
+	b.rt.flushLock.Lock()
+	defer b.rt.flushLock.Unlock()
+
+	if b.rt.GetDirectory() == nil {
+		return ErrFileRoot
+	}
+
+	c := &batchCommit{
+		ctx:      ctx,
+		rt:       b.rt,
+		isLocked: make(map[*Directory]bool),
+		changed:  make(map[string]batchEntry),
+	}
+	err := c.run(b.ops)
+	c.unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = b.rt.flush(ctx)
+	return err
+}
+
+type batchStepKind int
+
+const (
+	batchStepMkdir batchStepKind = iota
+	batchStepSetBuilder
+	batchStepUnlink
+	batchStepMove
+)
+
+// batchStep is one of the modifications the operations of a `Batch` are
+// validated into: of the entry 'name' of the directory at the path 'dir'
+// (as the steps before it leave the MFS), or of that directory itself for
+// `batchStepSetBuilder`.
+type batchStep struct {
+	op      int
+	kind    batchStepKind
+	dir     string
+	name    string
+	builder cid.Builder
+
+	// Destination of a `batchStepMove`.
+	dstDir  string
+	dstName string
+}
+
+// batchEntry is the state of an entry of the MFS for the validation of a
+// `Batch`.
+type batchEntry struct {
+	exists bool
+	dir    bool
+
+	// Path a directory had before the commit, the entries not modified by
+	// the batch are the ones of the directory there. Empty for directories
+	// created by the batch.
+	origin string
+}
+
+// batchCommit holds the state of the commit of a `Batch`: the directories
+// it locked (top-down from the root, in that order), the entries modified
+// by the operations validated so far, keyed by their (folded, see `key`)
+// path, and the mutations held back from the `MutationLogger` and how to
+// undo the steps applied.
+type batchCommit struct {
+	ctx      context.Context
+	rt       *Root
+	locked   []*Directory
+	isLocked map[*Directory]bool
+	changed  map[string]batchEntry
+	log      []Mutation
+	undo     []func() error
+}
+
+func (c *batchCommit) run(ops []batchOp) error {
+	var steps []batchStep
+	for i, op := range ops {
+		err := c.ctx.Err()
+		if err == nil {
+			var s []batchStep
+			s, err = c.validate(op)
+			for j := range s {
+				s[j].op = i
+			}
+			steps = append(steps, s...)
+		}
+		if err != nil {
+			return fmt.Errorf("batch operation %d (%s): %w", i, op, err)
+		}
+	}
+
+	for _, s := range steps {
+		err := c.apply(s)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("batch operation %d (%s): %w", s.op, ops[s.op], err)
+		for i := len(c.undo) - 1; i >= 0; i-- {
+			if uerr := c.undo[i](); uerr != nil {
+				return fmt.Errorf("%w (undoing the batch failed: %s)", err, uerr)
+			}
+		}
+		return err
+	}
+
+	for _, m := range c.log {
+		c.rt.MutationLogger.LogMutation(m)
+	}
+	return nil
+}
+
+// lock takes the lock of 'd', unless the commit already holds it, holding
+// back the mutations it logs.
+func (c *batchCommit) lock(d *Directory) {
+	if c.isLocked[d] {
+		return
+	}
+	d.lock.Lock()
+	d.pendingLog = &c.log
+	c.isLocked[d] = true
+	c.locked = append(c.locked, d)
+}
+
+// unlock releases the locks taken by the commit, bottom-up.
+func (c *batchCommit) unlock() {
+	for i := len(c.locked) - 1; i >= 0; i-- {
+		c.locked[i].pendingLog = nil
+		c.locked[i].lock.Unlock()
+	}
+	c.locked = nil
+}
+
+// dir returns the directory at 'pth' locking all the ones on the way
+// from the root.
+func (c *batchCommit) dir(pth string) (*Directory, error) {
+	cur := c.rt.GetDirectory()
+	c.lock(cur)
+	for _, name := range strings.Split(pth, "/") {
+		if name == "" {
+			continue
+		}
+		fsn, err := cur.childUnsync(c.ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		next, ok := fsn.(*Directory)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a directory", pth)
+		}
+		c.lock(next)
+		cur = next
+	}
+	return cur, nil
+}
+
+// key returns the key of the (clean) path 'pth' in `changed`, folding
+// its case if the root does (see `Root.CaseInsensitive`).
+func (c *batchCommit) key(pth string) string {
+	if c.rt.CaseInsensitive {
+		return foldCase(pth)
+	}
+	return pth
+}
+
+// stat returns the state of the entry at the (clean) path 'pth' once the
+// operations validated so far are applied.
+func (c *batchCommit) stat(pth string) (batchEntry, error) {
+	if pth == "/" {
+		return batchEntry{exists: true, dir: true, origin: "/"}, nil
+	}
+	if e, ok := c.changed[c.key(pth)]; ok {
+		return e, nil
+	}
+
+	dirp, name := gopath.Split(pth)
+	parent, err := c.stat(gopath.Clean(dirp))
+	if err != nil || !parent.exists || !parent.dir || parent.origin == "" {
+		return batchEntry{}, err
+	}
+	pdir, err := c.dir(parent.origin)
+	if err != nil {
+		return batchEntry{}, err
+	}
+	fsn, err := pdir.childUnsync(c.ctx, name)
+	if err == os.ErrNotExist {
+		return batchEntry{}, nil
+	} else if err != nil {
+		return batchEntry{}, err
+	}
+	if fsn.Type() != TDir {
+		return batchEntry{exists: true}, nil
+	}
+	return batchEntry{exists: true, dir: true, origin: gopath.Join(parent.origin, name)}, nil
+}
+
+// statDir checks there is a directory at 'pth' as `stat`.
+func (c *batchCommit) statDir(pth string) error {
+	e, err := c.stat(pth)
+	if err != nil {
+		return err
+	}
+	if !e.exists {
+		return os.ErrNotExist
+	}
+	if !e.dir {
+		return fmt.Errorf("%s is not a directory", pth)
+	}
+	return nil
+}
+
+// set records 'e' as the new state of the entry at 'pth', replacing the
+// one of its descendants.
+func (c *batchCommit) set(pth string, e batchEntry) {
+	prefix := c.key(pth) + "/"
+	for k := range c.changed {
+		if strings.HasPrefix(k, prefix) {
+			delete(c.changed, k)
+		}
+	}
+	c.changed[c.key(pth)] = e
+}
+
+// move records the move of the entry 'e' at 'src' (with its modified
+// descendants) to 'dst'.
+func (c *batchCommit) move(src, dst string, e batchEntry) {
+	srcPrefix := c.key(src) + "/"
+	moved := make(map[string]batchEntry)
+	for k, v := range c.changed {
+		if strings.HasPrefix(k, srcPrefix) {
+			moved[c.key(dst)+"/"+k[len(srcPrefix):]] = v
+		}
+	}
+	c.set(src, batchEntry{})
+	c.set(dst, e)
+	for k, v := range moved {
+		c.changed[k] = v
+	}
+}
+
+// validate checks 'op' can be applied once the operations validated
+// before it are, recording its effect, and returns the steps to apply it.
+func (c *batchCommit) validate(op batchOp) ([]batchStep, error) {
+	switch op.kind {
+	case batchMkdir:
+		return c.validateMkdir(op.pth, op.opts)
+	case batchMv:
+		return c.validateMv(op.pth, op.dst)
+	default:
+		return c.validateRemove(op.pth)
+	}
+}
+
+func (c *batchCommit) validateMkdir(pth string, opts MkdirOpts) ([]batchStep, error) {
+	if pth == "" {
+		return nil, fmt.Errorf("no path given to Mkdir")
+	}
+	pth = gopath.Clean("/" + pth)
+	if pth == "/" {
+		if opts.Mkparents {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot create directory '/': Already exists")
+	}
+
+	var steps []batchStep
+	parts := strings.Split(pth[1:], "/")
+	cur := "/"
+	for i, name := range parts {
+		next := gopath.Join(cur, name)
+		last := i == len(parts)-1
+		e, err := c.stat(next)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case e.exists && !last && !e.dir:
+			return nil, fmt.Errorf("%s was not a directory", next)
+		case e.exists && last:
+			if !opts.Mkparents || !e.dir {
+				return nil, os.ErrExist
+			}
+			if opts.CidBuilder != nil {
+				steps = append(steps, batchStep{kind: batchStepSetBuilder, dir: next, builder: opts.CidBuilder})
+			}
+		case !e.exists && !last && !opts.Mkparents:
+			return nil, os.ErrNotExist
+		case !e.exists:
+			if err := c.rt.GetDirectory().checkName(name); err != nil {
+				return nil, err
+			}
+			if c.rt.MaxDepth > 0 && i+1 > c.rt.MaxDepth {
+				return nil, ErrTooDeep
+			}
+			c.set(next, batchEntry{exists: true, dir: true})
+			steps = append(steps, batchStep{kind: batchStepMkdir, dir: cur, name: name, builder: opts.CidBuilder})
+		}
+		cur = next
+	}
+	return steps, nil
+}
+
+func (c *batchCommit) validateMv(src, dst string) ([]batchStep, error) {
+	srcDirName, srcFname := gopath.Split(src)
+	if srcFname == "" {
+		return nil, fmt.Errorf("invalid source path: %s", src)
+	}
+	var dstDirName, dstFname string
+	if dst == "" {
+		return nil, fmt.Errorf("no destination path given to Mv")
+	} else if dst[len(dst)-1] == '/' {
+		dstDirName = dst
+		dstFname = srcFname
+	} else {
+		dstDirName, dstFname = gopath.Split(dst)
+	}
+	srcDir := gopath.Clean("/" + srcDirName)
+	dstDir := gopath.Clean("/" + dstDirName)
+
+	if err := c.statDir(dstDir); err != nil {
+		return nil, err
+	}
+	if err := c.statDir(srcDir); err != nil {
+		return nil, err
+	}
+	srcPath := gopath.Join(srcDir, srcFname)
+	se, err := c.stat(srcPath)
+	if err != nil {
+		return nil, err
+	}
+	if !se.exists {
+		return nil, os.ErrNotExist
+	}
+	within := func(pth string) bool {
+		return se.dir && (pth == srcPath || strings.HasPrefix(pth, srcPath+"/"))
+	}
+	if within(dstDir) {
+		return nil, ErrCycleDetected
+	}
+
+	var steps []batchStep
+	dstPath := gopath.Join(dstDir, dstFname)
+	if dstPath != srcPath && c.key(dstPath) == c.key(srcPath) {
+		// Only changing the case of the name (see `Root.CaseInsensitive`).
+		if err := c.rt.GetDirectory().checkName(dstFname); err != nil {
+			return nil, err
+		}
+		c.move(srcPath, dstPath, se)
+		return []batchStep{{kind: batchStepMove, dir: srcDir, name: srcFname, dstDir: dstDir, dstName: dstFname}}, nil
+	}
+
+	de, err := c.stat(dstPath)
+	if err != nil {
+		return nil, err
+	}
+	if de.exists {
+		switch {
+		case dstPath == srcPath && se.dir:
+			return nil, ErrCycleDetected
+		case dstPath == srcPath:
+			// Moving a file over itself.
+			return nil, nil
+		case !de.dir:
+			c.set(dstPath, batchEntry{})
+			steps = append(steps, batchStep{kind: batchStepUnlink, dir: dstDir, name: dstFname})
+		default:
+			dstDir, dstFname = dstPath, srcFname
+			dstPath = gopath.Join(dstDir, dstFname)
+			if dstPath == srcPath {
+				// The source itself (as the destination is its parent).
+				if se.dir {
+					return nil, ErrCycleDetected
+				}
+				return nil, nil
+			}
+			de, err := c.stat(dstPath)
+			if err != nil {
+				return nil, err
+			}
+			if de.exists {
+				return nil, ErrDirExists
+			}
+		}
+	}
+
+	if err := c.rt.GetDirectory().checkName(dstFname); err != nil {
+		return nil, err
+	}
+	c.move(srcPath, dstPath, se)
+	return append(steps, batchStep{kind: batchStepMove, dir: srcDir, name: srcFname, dstDir: dstDir, dstName: dstFname}), nil
+}
+
+func (c *batchCommit) validateRemove(pth string) ([]batchStep, error) {
+	pth = gopath.Clean("/" + pth)
+	if pth == "/" {
+		return nil, fmt.Errorf("the root directory has no parent")
+	}
+	dirp, name := gopath.Split(pth)
+	dirp = gopath.Clean(dirp)
+	if err := c.statDir(dirp); err != nil {
+		return nil, err
+	}
+	e, err := c.stat(pth)
+	if err != nil {
+		return nil, err
+	}
+	if !e.exists {
+		return nil, os.ErrNotExist
+	}
+	c.set(pth, batchEntry{})
+	return []batchStep{{kind: batchStepUnlink, dir: dirp, name: name}}, nil
+}
+
+// apply applies the step 's' with the unsynced methods of the directories
+// (locked by the commit), recording how to undo it.
+func (c *batchCommit) apply(s batchStep) error {
+	dir, err := c.dir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	switch s.kind {
+	case batchStepMkdir:
+		ndir, err := dir.mkdirUnsync(c.ctx, s.name, s.builder, dir.templateForUnsync())
+		if err != nil {
+			return err
+		}
+		c.undo = append(c.undo, func() error {
+			return dir.unlinkUnsync(dir.ctx, s.name)
+		})
+		if s.builder != nil {
+			ndir.SetCidBuilder(s.builder)
+		}
+	case batchStepSetBuilder:
+		old := dir.GetCidBuilder()
+		dir.SetCidBuilder(s.builder)
+		c.undo = append(c.undo, func() error {
+			dir.SetCidBuilder(old)
+			return nil
+		})
+	case batchStepUnlink:
+		return c.unlink(dir, s.name)
+	case batchStepMove:
+		fsn, err := dir.childUnsync(c.ctx, s.name)
+		if err != nil {
+			return err
+		}
+		nd, err := c.nodeOf(fsn)
+		if err != nil {
+			return err
+		}
+		if err := c.unlink(dir, s.name); err != nil {
+			return err
+		}
+		dst, err := c.dir(s.dstDir)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.addChildUnsync(c.ctx, s.dstName, nd, AddChildOpts{}); err != nil {
+			return err
+		}
+		c.undo = append(c.undo, func() error {
+			return dst.unlinkUnsync(dst.ctx, s.dstName)
+		})
+	}
+	return nil
+}
+
+// unlink removes the entry 'name' of 'dir' (locked by the commit),
+// recording how to restore it.
+func (c *batchCommit) unlink(dir *Directory, name string) error {
+	fsn, err := dir.childUnsync(c.ctx, name)
+	if err != nil {
+		return err
+	}
+	nd, err := c.nodeOf(fsn)
+	if err != nil {
+		return err
+	}
+	cached := dir.entriesCache[name]
+	modTime, hasModTime := dir.entryModTimes[name]
+
+	if err := dir.unlinkUnsync(c.ctx, name); err != nil {
+		return err
+	}
+	c.undo = append(c.undo, func() error {
+		if err := dir.addUnixFSChild(dir.ctx, child{name, nd}); err != nil {
+			return err
+		}
+		if cached != nil {
+			dir.entriesCache[name] = cached
+			if cdir, ok := cached.(*Directory); ok {
+				cdir.detached = false
+			}
+		}
+		if hasModTime {
+			dir.entryModTimes[name] = modTime
+		}
+		return nil
+	})
+	return nil
+}
+
+// nodeOf returns the current node of 'fsn' as `GetNode`, syncing the
+// directories locked by the commit without taking their locks again.
+func (c *batchCommit) nodeOf(fsn FSNode) (ipld.Node, error) {
+	d, ok := fsn.(*Directory)
+	if !ok || !c.isLocked[d] {
+		return fsn.GetNode()
+	}
+
+	for name, entry := range d.entriesCache {
+		fi, isFile := entry.(*File)
+		changed := isFile && fi.isUnsynced()
+		nd, err := c.nodeOf(entry)
+		if err != nil {
+			return nil, err
+		}
+		if dir, ok := entry.(*Directory); ok {
+			if !c.isLocked[dir] {
+				dir.lock.Lock()
+			}
+			changed = !dir.flushedCid.Equals(nd.Cid())
+			if !c.isLocked[dir] {
+				dir.lock.Unlock()
+			}
+		}
+		if err := d.addUnixFSChild(c.ctx, child{name, nd}); err != nil {
+			return nil, err
+		}
+		// As in `Directory.sync`.
+		if changed {
+			d.markDirty()
+		}
+		switch entry := entry.(type) {
+		case *Directory:
+			if c.isLocked[entry] {
+				entry.markClean()
+				entry.flushedCid = nd.Cid()
+			} else {
+				entry.setFlushed(nd)
+			}
+		case *File:
+			entry.markSynced(nd)
+		}
+	}
+
+	nd, err := d.unixfsDir.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.addNode(c.ctx, nd); err != nil {
+		return nil, err
+	}
+	return nd.Copy(), nil
+}
+
+// carHeader is the (dag-cbor) header of a CAR (v1) stream.
+type carHeader struct {
+	Roots   []cid.Cid `refmt:"roots"`
+	Version uint64    `refmt:"version"`
+}
+
+func init() {
+	cbor.RegisterCborType(carHeader{})
+}
+
+// maxCarSection bounds the size of the sections of a CAR stream read by
+// `ReadCar`, to avoid allocating whatever a corrupt length asks for.
+const maxCarSection = 32 << 20
+
+// ReadCar reads the CAR (v1) stream 'r', adding all its blocks to the DAG
+// service of 'dst', and adds its root (it must have exactly one, a UnixFS
+// directory or file) as the entry 'name' of 'dst'. The CID of each block
+// is verified against its data. If 'name' already exists `ErrDirExists`
+// is returned before reading anything.
+func ReadCar(ctx context.Context, dst *Directory, name string, r io.Reader) error {
+	if _, err := dst.ChildContext(ctx, name); err == nil {
+		return ErrDirExists
+	} else if err != os.ErrNotExist {
+		return err
+	}
+
+	br := bufio.NewReader(r)
+	data, err := readCarSection(br)
+	if err != nil {
+		return fmt.Errorf("cannot read CAR header: %s", err)
+	}
+	var h carHeader
+	err = cbor.DecodeInto(data, &h)
+	if err != nil {
+		return fmt.Errorf("invalid CAR header: %s", err)
+	}
+	if h.Version != 1 {
+		return fmt.Errorf("unsupported CAR version: %d", h.Version)
+	}
+	if len(h.Roots) != 1 {
+		return fmt.Errorf("expected a single CAR root, got %d", len(h.Roots))
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		data, err := readCarSection(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read CAR block: %s", err)
+		}
+		nd, err := decodeCarBlock(data)
+		if err != nil {
+			return err
+		}
+		err = dst.dagService.Add(ctx, nd)
+		if err != nil {
+			return err
+		}
+	}
+
+	nd, err := dst.dagService.Get(ctx, h.Roots[0])
+	if err != nil {
+		return fmt.Errorf("cannot get CAR root %s: %s", h.Roots[0], err)
+	}
+	if err := checkChildNode(nd); err != nil || isSymlinkNode(nd) {
+		return fmt.Errorf("CAR root %s is not a UnixFS directory or file", nd.Cid())
+	}
+	return dst.AddChildContext(ctx, name, nd, AddChildOpts{})
+}
+
+// readCarSection reads a (varint) length prefixed section of a CAR stream,
+// returning `io.EOF` only if the stream ends before the section starts.
+func readCarSection(br *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if size == 0 || size > maxCarSection {
+		return nil, fmt.Errorf("invalid section size: %d", size)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(br, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// decodeCarBlock decodes the block section 'data' of a CAR stream (its
+// CID followed by its data) into a node, verifying the CID.
+func decodeCarBlock(data []byte) (ipld.Node, error) {
+	n, err := carCidLen(data)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cid.Cast(data[:n])
+	if err != nil {
+		return nil, fmt.Errorf("invalid CID in CAR block: %s", err)
+	}
+
+	chk, err := c.Prefix().Sum(data[n:])
+	if err != nil {
+		return nil, err
+	}
+	if !chk.Equals(c) {
+		return nil, fmt.Errorf("CAR block %s doesn't match its data", c)
+	}
+
+	blk, err := blocks.NewBlockWithCid(data[n:], c)
+	if err != nil {
+		return nil, err
+	}
+	return ipld.Decode(blk)
+}
+
+// carCidLen returns the length of the binary CID 'data' starts with.
+func carCidLen(data []byte) (int, error) {
+	// A CIDv0 is a bare sha2-256 multihash.
+	if len(data) >= 34 && data[0] == 0x12 && data[1] == 0x20 {
+		return 34, nil
+	}
+
+	// A CIDv1 is its version, codec, multihash code and digest length
+	// (all varints) followed by the digest.
+	n := 0
+	var fields [4]uint64
+	for i := range fields {
+		v, l := binary.Uvarint(data[n:])
+		if l <= 0 {
+			return 0, fmt.Errorf("invalid CID in CAR block")
+		}
+		fields[i] = v
+		n += l
+	}
+	if fields[3] > uint64(len(data)-n) {
+		return 0, fmt.Errorf("invalid CID in CAR block")
+	}
+	return n + int(fields[3]), nil
+}
@@ -4,14 +4,20 @@
 package mfs
 
 import (
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
+	gopath "path"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	dag "github.com/ipfs/go-merkledag"
 	ft "github.com/ipfs/go-unixfs"
 
+	cid "github.com/ipfs/go-cid"
 	ipld "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 )
@@ -22,9 +28,16 @@ var ErrClosed = errors.New("file closed")
 
 var log = logging.Logger("mfs")
 
-// TODO: Remove if not used.
 var ErrIsDirectory = errors.New("error: is a directory")
 
+var ErrCASFailed = errors.New("root changed since the expected CID")
+
+var ErrFileRoot = errors.New("root is a single file, not a directory")
+
+// DefaultScrubReadsPerSecond is the rate of DAG reads of `StartScrub` if
+// `Root.ScrubReadsPerSecond` isn't set.
+const DefaultScrubReadsPerSecond = 100
+
 // The information that an MFS `Directory` has about its children
 // when updating one of its entries: when a child mutates it signals
 // its parent directory to update its entry (under `Name`) with the
@@ -59,6 +72,10 @@ type NodeType int
 const (
 	TFile NodeType = iota
 	TDir
+
+	// TSymlink is only reported by `PathType`, the `File` of a symlink
+	// has type `TFile`.
+	TSymlink
 )
 
 // FSNode abstracts the `Directory` and `File` structures, it represents
@@ -83,13 +100,274 @@ func IsFile(fsn FSNode) bool {
 	return fsn.Type() == TFile
 }
 
-// Root represents the root of a filesystem tree.
+// NodeTransformer transforms the nodes of the entries of the MFS between
+// the form they are stored in the DAG service and the one MFS operates on,
+// e.g., to build an encryption or compression layer (see
+// `Root.NodeTransformer`).
+type NodeTransformer interface {
+	// Encode returns the node stored in place of 'nd' when it's linked
+	// from a directory. It should be deterministic, encoding a node that
+	// hasn't changed is expected to give the same CID.
+	Encode(ctx context.Context, nd ipld.Node) (ipld.Node, error)
+
+	// Decode returns the node 'nd' (read from the DAG service) was
+	// encoded from.
+	Decode(ctx context.Context, nd ipld.Node) (ipld.Node, error)
+}
+
+// Root represents the root of a filesystem tree. Its exported configuration
+// fields must be set before the `Root` is used.
 type Root struct {
 
 	// Root directory of the MFS layout.
 	dir *Directory
 
+	// Root file of a single-file `Root` (see `NewFileRoot`), set instead
+	// of `dir`.
+	file *File
+
 	repub *Republisher
+
+	// Set while publishing is paused (see `PauseRepublish`), with the
+	// last root node persisted meanwhile (undefined if none).
+	repubLock    sync.Mutex
+	repubPaused  bool
+	repubPending cid.Cid
+
+	// Serializes the flushes of the MFS, the ones requested through the
+	// `Root` API and `Directory.Flush` (also taken by `FlushMemFree` and
+	// `Close`).
+	flushLock sync.Mutex
+
+	// CID and time of the last root node persisted (see `LastFlush`).
+	lastFlushLock sync.Mutex
+	lastFlushCid  cid.Cid
+	lastFlushTime time.Time
+
+	// Errors of the last auto flush started (see `StartAutoFlush`).
+	autoFlushLock sync.Mutex
+	autoFlushErrs chan error
+
+	// MaxDepth limits how deep directories can be nested under the root
+	// directory (which has depth zero), creating one beyond it returns
+	// `ErrTooDeep`. Adding a prebuilt directory node walks its subtree
+	// (down to the limit) to check its descendants. Zero means no limit.
+	MaxDepth int
+
+	// ShardWidth is the fanout of the HAMT used when directories are
+	// switched to sharding (see `uio.UseHAMTSharding`), it must be a
+	// power of two. Zero means `uio.DefaultShardWidth`. (The hash function
+	// isn't configurable, murmur3 is the only one supported by the HAMT.)
+	ShardWidth int
+
+	// AlwaysShard makes directories sharded from the start, regardless of
+	// `uio.UseHAMTSharding`: `Mkdir` creates empty HAMT directories (of
+	// `ShardWidth`) and basic directories (e.g., loaded from the DAG) are
+	// switched to sharding on their first addition.
+	AlwaysShard bool
+
+	// ShardingThreshold switches a basic directory to sharding when an
+	// entry is added to it with `ShardingThreshold` entries already in it
+	// (as `uio.UseHAMTSharding` does on any addition). Zero disables it.
+	// See `FindNearThreshold` to find the directories about to switch.
+	ShardingThreshold int
+
+	// MaxConcurrentAdds limits how many `Add`/`AddMany` calls (from the
+	// whole MFS, e.g., flushing directories from different goroutines)
+	// run at once on the DAG service passed to `NewRoot`, to avoid
+	// saturating a remote backend. Zero means no limit.
+	MaxConcurrentAdds int
+
+	addSemOnce sync.Once
+	addSem     chan struct{}
+
+	// MaxOpenReaders limits how many readers of file contents (read-only
+	// `FileDescriptor`s, `File.ReadAt` and `File.DetectContentType` calls)
+	// are open at once in the whole MFS, bounding the memory used by their
+	// buffered DAG nodes. Opening one more blocks until another is closed
+	// (or the context of the call, e.g., the one passed to
+	// `File.OpenContext`, is done). The calls reading a file with an open
+	// read-only descriptor share its slot. Zero means no limit.
+	MaxOpenReaders int
+
+	readSemOnce sync.Once
+	readSem     chan struct{}
+
+	// Number of directories switched to a HAMT, and of the nodes (and
+	// their bytes) added to the DAG service doing so (see `FlushMeasured`),
+	// and their values at the last flush of the root (protected by the
+	// `flushLock`).
+	shardSwitches int64
+	shardNodes    int64
+	shardBytes    int64
+	lastShards    shardStats
+
+	// EventLogger, if set, is notified of internal events useful to
+	// diagnose latency spikes.
+	EventLogger EventLogger
+
+	// MutationLogger, if set, is notified of every mutation of the
+	// structure of the MFS (see `Mutation`).
+	MutationLogger MutationLogger
+
+	// DirCacheSize is the number of directories evicted from the cache of
+	// their parents (see `Directory.Uncache` and `FlushMemFree`) kept in a
+	// cache shared by the whole MFS, keyed by CID, so loading them again
+	// reuses the already constructed `Directory` (e.g., with the shards of
+	// a HAMT already fetched). Zero disables it.
+	DirCacheSize int
+
+	// CaseInsensitive makes the lookups of entries (`Directory.Child`
+	// and hence paths) and the checks for existing ones (`AddChild`,
+	// `Mkdir`, `Mv`, `RenameEach`) fold case, for interoperability with
+	// case-insensitive file systems. Names are stored as given. A lookup
+	// not matching the exact name has to scan all the links of the
+	// directory.
+	CaseInsensitive bool
+
+	// ScrubReadsPerSecond limits the DAG reads of `StartScrub`, to avoid
+	// starving foreground traffic. Zero means `DefaultScrubReadsPerSecond`.
+	ScrubReadsPerSecond int
+
+	// EmptyFiles selects the node used for the empty files created by the
+	// write APIs (`OpenFile` with `os.O_CREATE`, `Directory.AddFileFromReader`)
+	// and for files truncated to zero length when flushed.
+	EmptyFiles EmptyFileFormat
+
+	// MaxDirtyDirs limits how many directories can be dirty (modified but
+	// not yet flushed to their parent) at once, bounding the memory held by
+	// unflushed changes: a mutation of a directory that leaves more of them
+	// dirty flushes (`Directory.Flush`) the ones dirty for longest, before
+	// returning, until within the limit. The check is skipped while a flush
+	// through the `Root` (including a `Batch` commit) is in progress, and the
+	// flushes it triggers aren't undone by a `DirTx.Rollback`. Flush errors
+	// are only logged. Zero means no limit.
+	MaxDirtyDirs int
+
+	// Dirty directories (see `MaxDirtyDirs`), oldest first.
+	dirtyLock  sync.Mutex
+	dirtyDirs  *list.List
+	dirtyElems map[*Directory]*list.Element
+
+	// RequireValidUTF8Names makes the additions of new names (`AddChild`
+	// and its variants, `Mkdir`, `RenameEach`, and hence the `Mv`,
+	// `PutNode`, `OpenFile` and `Mkdir` operations) reject the ones that
+	// aren't valid UTF-8 or contain control characters, returning
+	// `ErrInvalidName`, so they can be safely used in JSON or URLs.
+	// Existing entries aren't checked.
+	RequireValidUTF8Names bool
+
+	// SkipUnchangedWrites makes `Directory.UpdateFileContent` a no-op when
+	// the new content has the CID of the existing one: nothing is stored in
+	// the DAG service nor modified (e.g., modification times). The content
+	// read is compared block by block with the existing one as it's
+	// chunked, only the blocks that changed are stored.
+	SkipUnchangedWrites bool
+
+	// NodeTransformer, if set, encodes the node of each entry when it's
+	// linked from its directory and decodes it when the entry is loaded,
+	// so the CIDs of the links are the ones of the encoded nodes, while
+	// `GetNode` of an entry returns the decoded one. Only the nodes of the
+	// entries are transformed, not the node of the root directory nor the
+	// rest of the DAG of a file (e.g., its leaves). Only the encoded nodes
+	// of the entries are added to the DAG service, so `GetNode` of an entry
+	// returns a node that isn't stored. Helpers that walk the DAG directly
+	// (e.g., `CollectCids`) see the encoded nodes.
+	NodeTransformer NodeTransformer
+
+	dirCacheOnce sync.Once
+	dirCache     *dirCache
+}
+
+// dirCache is the LRU cache of evicted directories of a `Root` (see
+// `Root.DirCacheSize`). A cached directory is only reused if it's loaded
+// again from the same parent and name and it hasn't been modified since
+// it was evicted (i.e., its node still has the CID it's cached under),
+// otherwise the entry is dropped.
+type dirCache struct {
+	lock  sync.Mutex
+	size  int
+	ll    *list.List
+	items map[cid.Cid]*list.Element
+}
+
+type dirCacheEntry struct {
+	c   cid.Cid
+	dir *Directory
+}
+
+// sharedDirCache returns the cache of evicted directories of the `Root`,
+// nil if disabled.
+func (kr *Root) sharedDirCache() *dirCache {
+	kr.dirCacheOnce.Do(func() {
+		if kr.DirCacheSize > 0 {
+			kr.dirCache = &dirCache{
+				size:  kr.DirCacheSize,
+				ll:    list.New(),
+				items: make(map[cid.Cid]*list.Element),
+			}
+		}
+	})
+	return kr.dirCache
+}
+
+func (dc *dirCache) put(c cid.Cid, dir *Directory) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if e, ok := dc.items[c]; ok {
+		e.Value.(*dirCacheEntry).dir = dir
+		dc.ll.MoveToFront(e)
+		return
+	}
+	dc.items[c] = dc.ll.PushFront(&dirCacheEntry{c, dir})
+	if dc.ll.Len() > dc.size {
+		last := dc.ll.Back()
+		dc.ll.Remove(last)
+		delete(dc.items, last.Value.(*dirCacheEntry).c)
+	}
+}
+
+func (dc *dirCache) get(c cid.Cid) *Directory {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	e, ok := dc.items[c]
+	if !ok {
+		return nil
+	}
+	dc.ll.MoveToFront(e)
+	return e.Value.(*dirCacheEntry).dir
+}
+
+// remove drops the entry of 'c' if it's still 'dir'.
+func (dc *dirCache) remove(c cid.Cid, dir *Directory) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if e, ok := dc.items[c]; ok && e.Value.(*dirCacheEntry).dir == dir {
+		dc.ll.Remove(e)
+		delete(dc.items, c)
+	}
+}
+
+// EventLogger receives notifications of internal MFS events. Its methods
+// are called synchronously (with locks of the MFS taken), they shouldn't
+// block nor call back into the MFS.
+type EventLogger interface {
+	// ShardingSwitched is called when the directory at 'path', with
+	// 'entries' entries, is converted from a basic directory to a HAMT.
+	ShardingSwitched(path string, entries int)
+
+	// FlushStarted and FlushFinished are called around every flush of
+	// the `Root`, reporting how many nodes were stored in the DAG service
+	// during the flush, how long it took and its error.
+	FlushStarted()
+	FlushFinished(nodes int, elapsed time.Duration, err error)
+
+	// CacheEvicted is called when the cached entry at 'path' is dropped
+	// from the cache of its directory.
+	CacheEvicted(path string)
 }
 
 // NewRoot creates a new Root and starts up a republisher routine for it.
@@ -118,7 +396,7 @@ func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf
 
 	switch fsn.Type() {
 	case ft.TDirectory, ft.THAMTShard:
-		newDir, err := NewDirectory(parent, node.String(), node, root, ds)
+		newDir, err := NewDirectory(parent, node.String(), node, root, &throttledDagServ{DAGService: ds, root: root})
 		if err != nil {
 			return nil, err
 		}
@@ -134,24 +412,488 @@ func NewRoot(parent context.Context, ds ipld.DAGService, node *dag.ProtoNode, pf
 	return root, nil
 }
 
-// GetDirectory returns the root directory.
+// NewFileRoot creates a `Root` of the single file 'node' (instead of a
+// directory), for example to publish it through the republisher. The
+// file is at the root path "/" (see `Lookup`, `OpenFile`) and every write
+// flushed to it updates (and publishes) the root, while the operations
+// that need a root directory return `ErrFileRoot`.
+func NewFileRoot(parent context.Context, ds ipld.DAGService, node ipld.Node, pf PubFunc) (*Root, error) {
+	if isDirNode(node) {
+		return nil, fmt.Errorf("root file is a directory: %s", node.Cid())
+	}
+
+	var repub *Republisher
+	if pf != nil {
+		repub = NewRepublisher(parent, pf, time.Millisecond*300, time.Second*3)
+		go repub.Run(node.Cid())
+	}
+
+	root := &Root{
+		repub: repub,
+	}
+
+	fi, err := NewFile("", node, root, &throttledDagServ{DAGService: ds, root: root})
+	if err != nil {
+		return nil, err
+	}
+	root.file = fi
+	return root, nil
+}
+
+// EmptyRoot creates a `Root` (without republisher) of a new empty directory
+// built with the CID builder 'b' (the default one if nil), adding its node
+// to 'ds'.
+func EmptyRoot(ctx context.Context, ds ipld.DAGService, b cid.Builder) (*Root, error) {
+	nd := ft.EmptyDirNode()
+	if b != nil {
+		nd.SetCidBuilder(b)
+	}
+
+	err := ds.Add(ctx, nd)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRoot(ctx, ds, nd, nil)
+}
+
+// GetDirectory returns the root directory, nil for a single-file `Root`
+// (see `NewFileRoot`).
 func (kr *Root) GetDirectory() *Directory {
 	return kr.dir
 }
 
+// GetFile returns the root file of a single-file `Root` (see
+// `NewFileRoot`), nil if the root is a directory.
+func (kr *Root) GetFile() *File {
+	return kr.file
+}
+
+// rootNode returns the root directory or file.
+func (kr *Root) rootNode() FSNode {
+	if kr.file != nil {
+		return kr.file
+	}
+	return kr.dir
+}
+
+// context returns the context of the root directory, the one used by the
+// operations of the root without their own (e.g., `Flush`).
+func (kr *Root) context() context.Context {
+	if kr.dir != nil {
+		return kr.dir.ctx
+	}
+	return context.Background()
+}
+
+// dagService returns the DAG service of the root directory or file.
+func (kr *Root) dagService() ipld.DAGService {
+	if kr.file != nil {
+		return kr.file.dagService
+	}
+	return kr.dir.dagService
+}
+
+// transformsNodes reports whether the nodes of the entries are transformed
+// (see `NodeTransformer`), 'kr' may be nil.
+func (kr *Root) transformsNodes() bool {
+	return kr != nil && kr.NodeTransformer != nil
+}
+
+// flushedCid returns the CID of the last node of the root directory or
+// file propagated to the root.
+func (kr *Root) flushedCid() cid.Cid {
+	if kr.file != nil {
+		nd, _ := kr.file.GetNode()
+		return nd.Cid()
+	}
+
+	kr.dir.lock.Lock()
+	defer kr.dir.lock.Unlock()
+	return kr.dir.flushedCid
+}
+
 // Flush signals that an update has occurred since the last publish,
 // and updates the Root republisher.
 // TODO: We are definitely abusing the "flush" terminology here.
 func (kr *Root) Flush() error {
-	nd, err := kr.GetDirectory().GetNode()
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+
+	_, err := kr.flush(kr.context())
+	return err
+}
+
+// FlushStats reports the DAG service additions of a flush (see
+// `FlushWithStats`).
+type FlushStats struct {
+	// Nodes added to the DAG service.
+	Adds int
+
+	// Directory nodes not added again as they were unchanged since they
+	// were last added.
+	Skipped int
+}
+
+// FlushWithStats flushes the root as `Flush`, reporting the nodes added to
+// the DAG service by the flush (not the ones added concurrently by other
+// operations of the MFS). The tree is flushed bottom-up, each directory
+// being synced (and its node added) once after all its cached descendants,
+// and the directories whose node didn't change aren't added again if the
+// DAG service confirms they're still stored (see `LocalChecker`).
+func (kr *Root) FlushWithStats() (FlushStats, error) {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+
+	var counter addCounter
+	_, err := kr.flush(withAddCounter(kr.context(), &counter))
+	return FlushStats{
+		Adds:    int(atomic.LoadInt64(&counter.nodes)),
+		Skipped: int(atomic.LoadInt64(&counter.skipped)),
+	}, err
+}
+
+// FlushResult summarizes a flush of the root (see `FlushMeasured`).
+type FlushResult struct {
+	// Cid of the root node flushed.
+	Cid cid.Cid
+
+	// Nodes added to the DAG service, and the size of their raw data.
+	Nodes int
+	Bytes int64
+
+	// Directory nodes not added again as they were unchanged since they
+	// were last added.
+	Skipped int
+
+	// ShardingSwitches is the number of directories converted to a HAMT
+	// since the previous flush of the root, and ShardingNodes and
+	// ShardingBytes the nodes added to the DAG service converting them
+	// (and the size of their raw data), when they were converted: they're
+	// only part of `Nodes` for the conversions made by the flush itself.
+	ShardingSwitches int
+	ShardingNodes    int
+	ShardingBytes    int64
+
+	// Duration of the flush (wall-clock time).
+	Duration time.Duration
+}
+
+// FlushMeasured flushes the root as `Flush` returning a summary of the work
+// done, e.g., to log or export which commits are expensive. As with
+// `FlushWithStats` only the additions made by the flush are counted. The
+// flush is aborted (with the directories synced so far kept) once 'ctx' is
+// done.
+func (kr *Root) FlushMeasured(ctx context.Context) (FlushResult, error) {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return FlushResult{}, err
+	}
+
+	start := time.Now()
+	shards := kr.lastShards
+	var counter addCounter
+	nd, err := kr.flush(withAddCounter(ctx, &counter))
+	res := FlushResult{
+		Nodes:            int(atomic.LoadInt64(&counter.nodes)),
+		Bytes:            atomic.LoadInt64(&counter.bytes),
+		Skipped:          int(atomic.LoadInt64(&counter.skipped)),
+		ShardingSwitches: int(kr.lastShards.switches - shards.switches),
+		ShardingNodes:    int(kr.lastShards.nodes - shards.nodes),
+		ShardingBytes:    kr.lastShards.bytes - shards.bytes,
+		Duration:         time.Since(start),
+	}
 	if err != nil {
-		return err
+		return res, err
 	}
+	res.Cid = nd.Cid()
+	return res, nil
+}
 
-	if kr.repub != nil {
-		kr.repub.Update(nd.Cid())
+// shardStats are the values of the sharding counters of a `Root`.
+type shardStats struct {
+	switches, nodes, bytes int64
+}
+
+// countShardSwitch accounts for a directory switched to a HAMT adding the
+// nodes counted by 'c'.
+func (kr *Root) countShardSwitch(c *addCounter) {
+	atomic.AddInt64(&kr.shardSwitches, 1)
+	atomic.AddInt64(&kr.shardNodes, atomic.LoadInt64(&c.nodes))
+	atomic.AddInt64(&kr.shardBytes, atomic.LoadInt64(&c.bytes))
+}
+
+// flush implements `Flush`, it must be called with the `flushLock` taken.
+// The nodes it adds are counted in the `addCounter` of 'ctx', if any.
+func (kr *Root) flush(ctx context.Context) (_ ipld.Node, retErr error) {
+	if kr.EventLogger != nil {
+		counter := addCounterFrom(ctx)
+		if counter == nil {
+			counter = new(addCounter)
+			ctx = withAddCounter(ctx, counter)
+		}
+		kr.EventLogger.FlushStarted()
+		start := time.Now()
+		defer func() {
+			nodes := int(atomic.LoadInt64(&counter.nodes))
+			kr.EventLogger.FlushFinished(nodes, time.Since(start), retErr)
+		}()
 	}
-	return nil
+
+	var nd ipld.Node
+	var err error
+	if kr.file != nil {
+		nd, err = kr.file.GetNode()
+	} else {
+		nd, err = kr.dir.getNode(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kr.dir != nil {
+		kr.dir.setFlushed(nd)
+	}
+	kr.setLastFlush(nd.Cid())
+	kr.lastShards = shardStats{
+		switches: atomic.LoadInt64(&kr.shardSwitches),
+		nodes:    atomic.LoadInt64(&kr.shardNodes),
+		bytes:    atomic.LoadInt64(&kr.shardBytes),
+	}
+
+	kr.republish(nd.Cid())
+	return nd, nil
+}
+
+func (kr *Root) setLastFlush(c cid.Cid) {
+	kr.lastFlushLock.Lock()
+	defer kr.lastFlushLock.Unlock()
+	kr.lastFlushCid = c
+	kr.lastFlushTime = time.Now()
+}
+
+// LastFlush returns the CID of the last root node persisted, either by
+// flushing the root or by propagating an update of one of its descendants
+// (e.g., `Directory.Flush`), and when it happened. The last value is false
+// if neither has happened yet.
+func (kr *Root) LastFlush() (cid.Cid, time.Time, bool) {
+	kr.lastFlushLock.Lock()
+	defer kr.lastFlushLock.Unlock()
+	return kr.lastFlushCid, kr.lastFlushTime, kr.lastFlushCid.Defined()
+}
+
+// FlushIfMatches flushes the root (as `Flush`) only if the last persisted
+// root node, the one from the last flush or update propagated to the root,
+// is still `expected`, returning the CID of the new root node. Otherwise it
+// returns `ErrCASFailed`, signaling a concurrent commit from another writer
+// of this `Root`.
+func (kr *Root) FlushIfMatches(ctx context.Context, expected cid.Cid) (cid.Cid, error) {
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return cid.Undef, err
+	}
+
+	if !kr.flushedCid().Equals(expected) {
+		return cid.Undef, ErrCASFailed
+	}
+
+	nd, err := kr.flush(ctx)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+// StartAutoFlush launches a goroutine that flushes the root (as `Flush`)
+// every 'interval' if it has changes since the last flush. Calling `stop`
+// terminates the goroutine, after a final flush, and waits for it to exit.
+// Flush errors are sent to the channel returned by `AutoFlushErrors` (they
+// are only logged if the previous one hasn't been received yet).
+func (kr *Root) StartAutoFlush(interval time.Duration) (stop func()) {
+	errs := make(chan error, 1)
+	kr.autoFlushLock.Lock()
+	kr.autoFlushErrs = errs
+	kr.autoFlushLock.Unlock()
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kr.autoFlush(errs)
+			case <-done:
+				kr.autoFlush(errs)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-exited
+			close(errs)
+		})
+	}
+}
+
+// AutoFlushErrors returns the channel where the last auto flush started
+// reports its errors (see `StartAutoFlush`), closed when it's stopped.
+// It's nil if no auto flush was ever started.
+func (kr *Root) AutoFlushErrors() <-chan error {
+	kr.autoFlushLock.Lock()
+	defer kr.autoFlushLock.Unlock()
+	return kr.autoFlushErrs
+}
+
+func (kr *Root) autoFlush(errs chan<- error) {
+	// The writes to a root file are propagated as they are flushed.
+	if kr.dir == nil || !kr.dir.hasChanges() {
+		return
+	}
+
+	err := kr.Flush()
+	if err == nil {
+		return
+	}
+	select {
+	case errs <- err:
+	default:
+		log.Warningf("auto flush failed: %s", err)
+	}
+}
+
+// FsckError is a problem found verifying the blocks of the MFS: the node
+// 'Cid', in the DAG of the entry at 'Path', couldn't be read.
+type FsckError struct {
+	Path string
+	Cid  cid.Cid
+	Err  error
+}
+
+func (e FsckError) Error() string {
+	return fmt.Sprintf("%s: block %s: %s", e.Path, e.Cid, e.Err)
+}
+
+// StartScrub launches a goroutine that every 'interval' walks the whole
+// DAG of the last flushed root (see `LastFlush`) verifying that all of its
+// blocks can be read from the DAG service, calling 'fn' (from the goroutine)
+// for every one that can't (and isn't then walked). Reads are limited to
+// `ScrubReadsPerSecond`. Calling `stop` (or cancelling 'ctx') terminates the
+// goroutine, interrupting the walk in progress, `stop` waits for it to exit.
+func (kr *Root) StartScrub(ctx context.Context, interval time.Duration, fn func(FsckError)) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				kr.scrub(ctx, fn)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cancel()
+			<-exited
+		})
+	}
+}
+
+// scrub does a single pass of `StartScrub`.
+func (kr *Root) scrub(ctx context.Context, fn func(FsckError)) {
+	c, _, ok := kr.LastFlush()
+	if !ok {
+		c = kr.flushedCid()
+	}
+
+	rate := kr.ScrubReadsPerSecond
+	if rate <= 0 {
+		rate = DefaultScrubReadsPerSecond
+	}
+	limiter := time.NewTicker(time.Second / time.Duration(rate))
+	defer limiter.Stop()
+
+	s := &scrubber{
+		dserv:   kr.dagService(),
+		limiter: limiter.C,
+		visited: cid.NewSet(),
+		fn:      fn,
+	}
+	s.walk(ctx, c, "/")
+}
+
+type scrubber struct {
+	dserv   ipld.DAGService
+	limiter <-chan time.Time
+	visited *cid.Set
+	fn      func(FsckError)
+}
+
+// walk verifies the node 'c' (of the entry at 'pth') and all the nodes
+// under it, returning false if the walk was interrupted.
+func (s *scrubber) walk(ctx context.Context, c cid.Cid, pth string) bool {
+	if !s.visited.Visit(c) {
+		return true
+	}
+
+	select {
+	case <-s.limiter:
+	case <-ctx.Done():
+		return false
+	}
+
+	nd, err := s.dserv.Get(ctx, c)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		s.fn(FsckError{Path: pth, Cid: c, Err: err})
+		return true
+	}
+
+	// Only the links of directories are entries, the ones of HAMT
+	// shards are prefixed with their index (or only that for the
+	// links to child shards); file nodes link to their own blocks.
+	padLen := -1
+	if pbnd, ok := nd.(*dag.ProtoNode); ok {
+		if fsn, err := ft.FSNodeFromBytes(pbnd.Data()); err == nil {
+			switch fsn.Type() {
+			case ft.TDirectory:
+				padLen = 0
+			case ft.THAMTShard:
+				padLen = len(fmt.Sprintf("%X", fsn.Fanout()-1))
+			}
+		}
+	}
+
+	for _, l := range nd.Links() {
+		cpth := pth
+		if padLen >= 0 && len(l.Name) > padLen {
+			cpth = gopath.Join(pth, l.Name[padLen:])
+		}
+		if !s.walk(ctx, l.Cid, cpth) {
+			return false
+		}
+	}
+	return true
 }
 
 // FlushMemFree flushes the root directory and then uncaches all of its links.
@@ -166,22 +908,137 @@ func (kr *Root) Flush() error {
 // refactored.
 func (kr *Root) FlushMemFree(ctx context.Context) error {
 	dir := kr.GetDirectory()
+	if dir == nil {
+		return ErrFileRoot
+	}
+
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
 
-	if err := dir.Flush(); err != nil {
+	if err := dir.flush(); err != nil {
 		return err
 	}
 
 	dir.lock.Lock()
 	defer dir.lock.Unlock()
 
-	for name := range dir.entriesCache {
+	for name, entry := range dir.entriesCache {
 		delete(dir.entriesCache, name)
+		dir.logEviction(name)
+		dir.keepEvicted(entry)
 	}
 	// TODO: Can't we just create new maps?
 
 	return nil
 }
 
+// trackDirty records the directory 'd' as dirty (see `MaxDirtyDirs`).
+func (kr *Root) trackDirty(d *Directory) {
+	kr.dirtyLock.Lock()
+	defer kr.dirtyLock.Unlock()
+
+	if kr.dirtyDirs == nil {
+		kr.dirtyDirs = list.New()
+		kr.dirtyElems = make(map[*Directory]*list.Element)
+	}
+	if _, ok := kr.dirtyElems[d]; !ok {
+		kr.dirtyElems[d] = kr.dirtyDirs.PushBack(d)
+	}
+}
+
+// untrackDirty drops the directory 'd' from the dirty ones.
+func (kr *Root) untrackDirty(d *Directory) {
+	kr.dirtyLock.Lock()
+	defer kr.dirtyLock.Unlock()
+
+	if e, ok := kr.dirtyElems[d]; ok {
+		kr.dirtyDirs.Remove(e)
+		delete(kr.dirtyElems, d)
+	}
+}
+
+// oldestDirtyOverBudget returns the directory dirty for longest if there
+// are more than `MaxDirtyDirs` of them, nil otherwise.
+func (kr *Root) oldestDirtyOverBudget() *Directory {
+	kr.dirtyLock.Lock()
+	defer kr.dirtyLock.Unlock()
+
+	if kr.dirtyDirs == nil || kr.dirtyDirs.Len() <= kr.MaxDirtyDirs {
+		return nil
+	}
+	return kr.dirtyDirs.Front().Value.(*Directory)
+}
+
+// enforceDirtyBudget flushes the directories dirty for longest until there
+// are at most `MaxDirtyDirs` of them. It must be called without any lock
+// of the MFS taken.
+func (kr *Root) enforceDirtyBudget() {
+	if kr.MaxDirtyDirs <= 0 || !kr.flushLock.TryLock() {
+		return
+	}
+	defer kr.flushLock.Unlock()
+
+	for {
+		dir := kr.oldestDirtyOverBudget()
+		if dir == nil {
+			return
+		}
+
+		err := dir.flush()
+		if err == ErrDetached {
+			// Can't be flushed (nor reached) anymore.
+			kr.untrackDirty(dir)
+			continue
+		}
+		if err != nil {
+			log.Warningf("flush of %s over the dirty budget failed: %s", dir.Path(), err)
+			return
+		}
+	}
+}
+
+// Warm resolves each of 'paths' (as `Lookup`), loading and caching the
+// entries along them (e.g., the directories) so later operations on them
+// don't have to fetch their nodes from the DAG service. It returns the
+// first error, including the one of a path that doesn't exist, without
+// warming the rest of the paths.
+func (kr *Root) Warm(ctx context.Context, paths []string) error {
+	dir := kr.GetDirectory()
+	if dir == nil {
+		return ErrFileRoot
+	}
+
+	for _, pth := range paths {
+		cur := dir
+		parts := strings.Split(strings.Trim(gopath.Clean("/"+pth), "/"), "/")
+		for i, name := range parts {
+			if name == "" {
+				break
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			cur.lock.Lock()
+			c, err := cur.childUnsync(ctx, name)
+			cur.lock.Unlock()
+			if err != nil {
+				return err
+			}
+
+			next, ok := c.(*Directory)
+			if !ok {
+				if i < len(parts)-1 {
+					return fmt.Errorf("cannot access %s: Not a directory", gopath.Join(parts[:i+1]...))
+				}
+				break
+			}
+			cur = next
+		}
+	}
+	return nil
+}
+
 // updateChildEntry implements the `parent` interface, and signals
 // to the publisher that there are changes ready to be published.
 // This is the only thing that separates a `Root` from a `Directory`.
@@ -190,21 +1047,425 @@ func (kr *Root) FlushMemFree(ctx context.Context) error {
 // the top), document it and maybe make it an anonymous variable (if
 // that's possible).
 func (kr *Root) updateChildEntry(c child) error {
-	err := kr.GetDirectory().dagService.Add(context.TODO(), c.Node)
+	err := kr.dagService().Add(context.TODO(), c.Node)
 	if err != nil {
 		return err
 	}
 	// TODO: Why are we not using the inner directory lock nor
 	// applying the same procedure as `Directory.updateChildEntry`?
+	kr.setLastFlush(c.Node.Cid())
+	kr.republish(c.Node.Cid())
+	return nil
+}
 
-	if kr.repub != nil {
-		kr.repub.Update(c.Node.Cid())
+// republish passes the new root node 'c' to the republisher, if any,
+// unless publishing is paused (then it's published on resume).
+func (kr *Root) republish(c cid.Cid) {
+	if kr.repub == nil {
+		return
+	}
+
+	kr.repubLock.Lock()
+	defer kr.repubLock.Unlock()
+	if kr.repubPaused {
+		kr.repubPending = c
+		return
+	}
+	kr.repub.Update(c)
+}
+
+// PauseRepublish stops passing the new root nodes to the republisher, so a
+// batch of edits doesn't publish its intermediate states, until
+// `ResumeRepublish` is called. It has no effect on a `Root` without
+// republisher.
+func (kr *Root) PauseRepublish() {
+	kr.repubLock.Lock()
+	defer kr.repubLock.Unlock()
+	kr.repubPaused = true
+}
+
+// ResumeRepublish resumes the publishing paused by `PauseRepublish`, the
+// last root node persisted while paused (if any) is published, once.
+func (kr *Root) ResumeRepublish() {
+	kr.repubLock.Lock()
+	defer kr.repubLock.Unlock()
+
+	kr.repubPaused = false
+	if kr.repub != nil && kr.repubPending.Defined() {
+		kr.repub.Update(kr.repubPending)
+	}
+	kr.repubPending = cid.Undef
+}
+
+// RepublishNow publishes the last root node persisted (see `LastFlush`)
+// without waiting for the delay of the republisher, even if publishing is
+// paused, returning once it's published or 'ctx' is done.
+func (kr *Root) RepublishNow(ctx context.Context) error {
+	if kr.repub == nil {
+		return fmt.Errorf("root has no republisher")
+	}
+
+	kr.repubLock.Lock()
+	c, _, ok := kr.LastFlush()
+	if ok {
+		kr.repub.Update(c)
+	}
+	kr.repubPending = cid.Undef
+	kr.repubLock.Unlock()
+
+	return kr.repub.WaitPub(ctx)
+}
+
+// ValidateFlushable checks that the root can be fully flushed, without
+// committing anything: it materializes the nodes of every cached directory
+// (the ones that may have unflushed changes) as `Flush` would, but over an
+// in-memory overlay of the DAG service (see `Directory.computeNode`). The
+// first node that fails to materialize (e.g., a missing or corrupt block)
+// is reported.
+func (kr *Root) ValidateFlushable(ctx context.Context) error {
+	if kr.dir == nil {
+		// A root file has nothing cached to materialize.
+		return nil
+	}
+	_, err := kr.GetDirectory().computeNode(ctx, newOverlayDagServ(kr.GetDirectory().dagService))
+	return err
+}
+
+// overlayDagServ is a DAG service that keeps the added nodes in memory
+// (serving them along with the ones of the underlying DAG service)
+// instead of storing them.
+type overlayDagServ struct {
+	ipld.DAGService
+
+	lk    sync.Mutex
+	added map[cid.Cid]ipld.Node
+}
+
+func newOverlayDagServ(dserv ipld.DAGService) *overlayDagServ {
+	return &overlayDagServ{
+		DAGService: dserv,
+		added:      make(map[cid.Cid]ipld.Node),
+	}
+}
+
+func (ods *overlayDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	ods.lk.Lock()
+	nd, ok := ods.added[c]
+	ods.lk.Unlock()
+	if ok {
+		return nd, nil
 	}
+	return ods.DAGService.Get(ctx, c)
+}
+
+func (ods *overlayDagServ) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := ods.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (ods *overlayDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	ods.lk.Lock()
+	defer ods.lk.Unlock()
+	ods.added[nd.Cid()] = nd
 	return nil
 }
 
+func (ods *overlayDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := ods.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ods *overlayDagServ) Remove(ctx context.Context, c cid.Cid) error {
+	ods.lk.Lock()
+	defer ods.lk.Unlock()
+	delete(ods.added, c)
+	return nil
+}
+
+func (ods *overlayDagServ) RemoveMany(ctx context.Context, cids []cid.Cid) error {
+	for _, c := range cids {
+		if err := ods.Remove(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unchangedDagServ is a DAG service that doesn't store the nodes of a file
+// being imported that are the same as the ones of its existing content (see
+// `Root.SkipUnchangedWrites`). The importer adds the nodes in post-order, so
+// they're compared block by block with the existing DAG walked the same way,
+// loading its nodes as needed (not its raw leaves).
+type unchangedDagServ struct {
+	ipld.DAGService
+	ctx context.Context
+
+	// Nodes of the existing DAG whose children are being walked, along
+	// with the links of each left to walk.
+	stack []unchangedFrame
+}
+
+type unchangedFrame struct {
+	c     cid.Cid
+	links []*ipld.Link
+}
+
+func newUnchangedDagServ(ctx context.Context, dserv ipld.DAGService, old ipld.Node) *unchangedDagServ {
+	return &unchangedDagServ{
+		DAGService: dserv,
+		ctx:        ctx,
+		stack:      []unchangedFrame{{old.Cid(), old.Links()}},
+	}
+}
+
+// next returns the CID of the next node of the existing DAG in post-order,
+// undefined once it's walked entirely (or a node of it can't be loaded).
+func (uds *unchangedDagServ) next() cid.Cid {
+	for len(uds.stack) > 0 {
+		top := &uds.stack[len(uds.stack)-1]
+		if len(top.links) == 0 {
+			uds.stack = uds.stack[:len(uds.stack)-1]
+			return top.c
+		}
+		l := top.links[0]
+		top.links = top.links[1:]
+		if l.Cid.Type() == cid.Raw {
+			return l.Cid
+		}
+
+		nd, err := uds.DAGService.Get(uds.ctx, l.Cid)
+		if err != nil {
+			uds.stack = nil
+			return cid.Undef
+		}
+		uds.stack = append(uds.stack, unchangedFrame{nd.Cid(), nd.Links()})
+	}
+	return cid.Undef
+}
+
+func (uds *unchangedDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	if nd.Cid().Equals(uds.next()) {
+		return nil
+	}
+	return uds.DAGService.Add(ctx, nd)
+}
+
+func (uds *unchangedDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	changed := make([]ipld.Node, 0, len(nds))
+	for _, nd := range nds {
+		if !nd.Cid().Equals(uds.next()) {
+			changed = append(changed, nd)
+		}
+	}
+	return uds.DAGService.AddMany(ctx, changed)
+}
+
+// heldDagServ is a DAG service holding back the node added last to the
+// underlying DAG service until another one is added, used to write the DAG
+// of a file with a `Root.NodeTransformer`: once the DAG is complete the
+// node held is its root, which is dropped (see `release`) as only its
+// encoded form is stored.
+type heldDagServ struct {
+	ipld.DAGService
+
+	lk   sync.Mutex
+	held ipld.Node
+}
+
+func (hds *heldDagServ) Get(ctx context.Context, c cid.Cid) (ipld.Node, error) {
+	hds.lk.Lock()
+	held := hds.held
+	hds.lk.Unlock()
+	if held != nil && held.Cid().Equals(c) {
+		return held, nil
+	}
+	return hds.DAGService.Get(ctx, c)
+}
+
+func (hds *heldDagServ) GetMany(ctx context.Context, cids []cid.Cid) <-chan *ipld.NodeOption {
+	out := make(chan *ipld.NodeOption, len(cids))
+	go func() {
+		defer close(out)
+		for _, c := range cids {
+			nd, err := hds.Get(ctx, c)
+			select {
+			case out <- &ipld.NodeOption{Node: nd, Err: err}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (hds *heldDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	hds.lk.Lock()
+	defer hds.lk.Unlock()
+	if hds.held != nil && !hds.held.Cid().Equals(nd.Cid()) {
+		if err := hds.DAGService.Add(ctx, hds.held); err != nil {
+			return err
+		}
+	}
+	hds.held = nd
+	return nil
+}
+
+func (hds *heldDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	for _, nd := range nds {
+		if err := hds.Add(ctx, nd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release stores the node held, unless it's the root 'root' of the DAG
+// written, which is dropped.
+func (hds *heldDagServ) release(ctx context.Context, root cid.Cid) error {
+	hds.lk.Lock()
+	defer hds.lk.Unlock()
+	held := hds.held
+	hds.held = nil
+	if held == nil || held.Cid().Equals(root) {
+		return nil
+	}
+	return hds.DAGService.Add(ctx, held)
+}
+
+// throttledDagServ is a DAG service limiting the concurrent additions
+// to the underlying DAG service to `Root.MaxConcurrentAdds`.
+type throttledDagServ struct {
+	ipld.DAGService
+	root *Root
+}
+
+// acquire waits for an addition slot (if there is a limit), returning
+// the function that releases it.
+func (tds *throttledDagServ) acquire(ctx context.Context) (func(), error) {
+	kr := tds.root
+	kr.addSemOnce.Do(func() {
+		if kr.MaxConcurrentAdds > 0 {
+			kr.addSem = make(chan struct{}, kr.MaxConcurrentAdds)
+		}
+	})
+	if kr.addSem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case kr.addSem <- struct{}{}:
+		return func() { <-kr.addSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireReader waits for a reader slot (if there is a limit, see
+// `MaxOpenReaders`), returning the function that releases it.
+func (kr *Root) acquireReader(ctx context.Context) (func(), error) {
+	kr.readSemOnce.Do(func() {
+		if kr.MaxOpenReaders > 0 {
+			kr.readSem = make(chan struct{}, kr.MaxOpenReaders)
+		}
+	})
+	if kr.readSem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case kr.readSem <- struct{}{}:
+		return func() { <-kr.readSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (tds *throttledDagServ) Add(ctx context.Context, nd ipld.Node) error {
+	release, err := tds.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	addCounterFrom(ctx).count(nd)
+	return tds.DAGService.Add(ctx, nd)
+}
+
+func (tds *throttledDagServ) AddMany(ctx context.Context, nds []ipld.Node) error {
+	release, err := tds.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	addCounterFrom(ctx).count(nds...)
+	return tds.DAGService.AddMany(ctx, nds)
+}
+
+// addCounter counts the nodes added to the DAG service by a flush (or a
+// switch to sharding), and the size of their raw data, along with the
+// directory nodes not added again (see `FlushWithStats`). It's carried by
+// the context of the operation (see `withAddCounter`), so additions made
+// concurrently by other operations aren't counted. The additions are also
+// counted by the 'parent' counter, if any, e.g., of the flush making a
+// switch.
+type addCounter struct {
+	nodes   int64
+	bytes   int64
+	skipped int64
+
+	parent *addCounter
+}
+
+type addCounterKey struct{}
+
+// withAddCounter returns a copy of 'ctx' counting the nodes added with it
+// in 'c'.
+func withAddCounter(ctx context.Context, c *addCounter) context.Context {
+	return context.WithValue(ctx, addCounterKey{}, c)
+}
+
+// addCounterFrom returns the `addCounter` of 'ctx', nil if it has none.
+func addCounterFrom(ctx context.Context) *addCounter {
+	c, _ := ctx.Value(addCounterKey{}).(*addCounter)
+	return c
+}
+
+// count counts the addition of 'nds', 'c' may be nil.
+func (c *addCounter) count(nds ...ipld.Node) {
+	for ; c != nil; c = c.parent {
+		atomic.AddInt64(&c.nodes, int64(len(nds)))
+		for _, nd := range nds {
+			atomic.AddInt64(&c.bytes, int64(len(nd.RawData())))
+		}
+	}
+}
+
+// skip counts a directory node not added again, 'c' may be nil.
+func (c *addCounter) skip() {
+	for ; c != nil; c = c.parent {
+		atomic.AddInt64(&c.skipped, 1)
+	}
+}
+
 func (kr *Root) Close() error {
-	nd, err := kr.GetDirectory().GetNode()
+	kr.flushLock.Lock()
+	defer kr.flushLock.Unlock()
+
+	nd, err := kr.rootNode().GetNode()
 	if err != nil {
 		return err
 	}